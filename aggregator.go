@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// changeSubmission is a change batch waiting in a changeAggregator.
+type changeSubmission struct {
+	// The changes to submit.
+	changes []*route53.Change
+
+	// The event the changes were submitted for, for audit entries.
+	event invocation
+
+	// The channel that receives the result of the submission.
+	result chan error
+}
+
+// changeAggregator coalesces change batches submitted for the same hosted
+// zone within a short window into a single Route 53 change batch, so that
+// a large scaling event results in a handful of ChangeResourceRecordSets and
+// GetChange calls, instead of one set per instance. This is only useful in
+// the long-running server and worker modes, where many messages are
+// processed by the same process at once.
+//
+// Exact duplicate changes are only submitted once. Submissions that touch
+// the same resource record set as an earlier submission in a different way
+// cannot be merged, and are deferred to the next window.
+//
+// If Route 53 rejects a merged batch outright, each of its submissions is
+// retried on its own, so that a single bad change does not fail every
+// pending lifecycle action. Any other failure, such as a batch that was
+// accepted but did not sync in time, is returned to every submission, as
+// sending the changes again would apply them twice.
+type changeAggregator struct {
+	// The function that sends a change batch to Route 53 and waits for it to
+	// sync. events are the events that contributed changes to the batch.
+	send func(zoneID string, batch []*route53.Change, events []invocation) error
+
+	// How long to buffer changes for before submitting them.
+	window time.Duration
+
+	// The pending submissions by zone ID, and the lock that protects them.
+	mu      sync.Mutex
+	pending map[string][]*changeSubmission
+}
+
+// newChangeAggregator returns a changeAggregator that sends batches through
+// client, buffering them for window. Audit entries for the batches are
+// recorded against the events that contributed to them, rather than the
+// event of client.
+func newChangeAggregator(client *awsClient, window time.Duration) *changeAggregator {
+	return &changeAggregator{
+		send: func(zoneID string, batch []*route53.Change, events []invocation) error {
+			return client.forContributors(events).SendRoute53ChangeBatch(zoneID, batch)
+		},
+		window:  window,
+		pending: make(map[string][]*changeSubmission),
+	}
+}
+
+// Submit adds batch, for event, to the pending changes for zoneID, and blocks
+// until the merged batch it ends up in has been sent and synced. The result
+// of the merged batch is returned.
+func (a *changeAggregator) Submit(zoneID string, batch []*route53.Change, event invocation) error {
+	sub := &changeSubmission{changes: batch, event: event, result: make(chan error, 1)}
+	a.enqueue(zoneID, sub)
+	return <-sub.result
+}
+
+// enqueue adds submissions to the pending changes for zoneID, starting the
+// window timer if there were no changes pending.
+func (a *changeAggregator) enqueue(zoneID string, subs ...*changeSubmission) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.pending[zoneID]) == 0 {
+		time.AfterFunc(a.window, func() { a.flush(zoneID) })
+	}
+	a.pending[zoneID] = append(a.pending[zoneID], subs...)
+}
+
+// flush merges and sends the pending changes for zoneID, and sends the
+// result to each submission.
+func (a *changeAggregator) flush(zoneID string) {
+	a.mu.Lock()
+	subs := a.pending[zoneID]
+	delete(a.pending, zoneID)
+	a.mu.Unlock()
+
+	merged, included, deferred := mergeSubmissions(subs)
+	if len(deferred) > 0 {
+		defaultLogger.With("zone_id", zoneID).Warnf("Deferring %d conflicting submissions for zone ID %s to the next batch", len(deferred), zoneID)
+		a.enqueue(zoneID, deferred...)
+	}
+
+	if len(merged) < 1 {
+		for _, sub := range included {
+			sub.result <- nil
+		}
+		return
+	}
+
+	defaultLogger.With("zone_id", zoneID).Infof("Sending %d merged changes from %d submissions to zone ID %s", len(merged), len(included), zoneID)
+	events := []invocation{}
+	for _, sub := range included {
+		events = append(events, sub.event)
+	}
+	err := a.send(zoneID, merged, events)
+	if _, rejected := err.(*changeBatchError); rejected && len(included) > 1 {
+		defaultLogger.With("zone_id", zoneID).Warnf("Merged change batch failed, retrying %d submissions individually: %v", len(included), err)
+		for _, sub := range included {
+			sub.result <- a.send(zoneID, sub.changes, []invocation{sub.event})
+		}
+		return
+	}
+
+	for _, sub := range included {
+		sub.result <- err
+	}
+}
+
+// rrSetKey returns a key identifying the resource record set that a change
+// operates on.
+func rrSetKey(change *route53.Change) string {
+	rrSet := change.ResourceRecordSet
+	name := strings.ToLower(aws.StringValue(rrSet.Name))
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return strings.Join([]string{name, aws.StringValue(rrSet.Type), aws.StringValue(rrSet.SetIdentifier)}, "|")
+}
+
+// changeKey returns a key identifying the full content of a change.
+func changeKey(change *route53.Change) string {
+	raw, _ := json.Marshal(change)
+	return string(raw)
+}
+
+// mergeSubmissions merges the changes in subs into a single batch, dropping
+// exact duplicates. Submissions that change a resource record set that an
+// earlier submission also changes, in a different way, are returned in
+// deferred and are not part of the merged batch.
+func mergeSubmissions(subs []*changeSubmission) (merged []*route53.Change, included, deferred []*changeSubmission) {
+	seen := make(map[string]bool)
+	owners := make(map[string]int)
+
+	for n, sub := range subs {
+		conflict := false
+		for _, change := range sub.changes {
+			owner, ok := owners[rrSetKey(change)]
+			if ok && owner != n && !seen[changeKey(change)] {
+				conflict = true
+				break
+			}
+		}
+		if conflict {
+			deferred = append(deferred, sub)
+			continue
+		}
+
+		for _, change := range sub.changes {
+			key := changeKey(change)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if _, ok := owners[rrSetKey(change)]; !ok {
+				owners[rrSetKey(change)] = n
+			}
+			merged = append(merged, change)
+		}
+		included = append(included, sub)
+	}
+	return merged, included, deferred
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/paybyphone/asg53/teststubs"
+)
+
+// testChange returns a simple A record change.
+func testChange(action, name, value string) *route53.Change {
+	return &route53.Change{
+		Action: aws.String(action),
+		ResourceRecordSet: &route53.ResourceRecordSet{
+			Name: aws.String(name),
+			TTL:  aws.Int64(60),
+			Type: aws.String("A"),
+			ResourceRecords: []*route53.ResourceRecord{
+				&route53.ResourceRecord{Value: aws.String(value)},
+			},
+		},
+	}
+}
+
+// testSubmission returns a changeSubmission for the supplied changes.
+func testSubmission(changes ...*route53.Change) *changeSubmission {
+	return &changeSubmission{changes: changes, result: make(chan error, 1)}
+}
+
+func TestMergeSubmissions(t *testing.T) {
+	subs := []*changeSubmission{
+		testSubmission(testChange("UPSERT", "a.example.com.", "10.0.0.1")),
+		testSubmission(testChange("UPSERT", "b.example.com.", "10.0.0.2")),
+		// Exact duplicate of the first submission.
+		testSubmission(testChange("UPSERT", "a.example.com.", "10.0.0.1")),
+		// Conflicts with the first submission.
+		testSubmission(testChange("UPSERT", "A.example.com", "10.0.0.3")),
+		// A DELETE and CREATE pair on the same record set is fine.
+		testSubmission(
+			testChange("DELETE", "c.example.com.", "10.0.0.4"),
+			testChange("CREATE", "c.example.com.", "10.0.0.5"),
+		),
+	}
+
+	merged, included, deferred := mergeSubmissions(subs)
+	if len(merged) != 4 {
+		t.Fatalf("Expected 4 merged changes, got %d", len(merged))
+	}
+	if len(included) != 4 {
+		t.Fatalf("Expected 4 included submissions, got %d", len(included))
+	}
+	if len(deferred) != 1 || deferred[0] != subs[3] {
+		t.Fatalf("Expected the conflicting submission to be deferred, got %#v", deferred)
+	}
+}
+
+func TestChangeAggregator(t *testing.T) {
+	var mu sync.Mutex
+	batches := [][]*route53.Change{}
+	a := &changeAggregator{
+		send: func(zoneID string, batch []*route53.Change, events []invocation) error {
+			mu.Lock()
+			defer mu.Unlock()
+			batches = append(batches, batch)
+			return nil
+		},
+		window:  time.Millisecond * 50,
+		pending: make(map[string][]*changeSubmission),
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for _, name := range []string{"a.example.com.", "b.example.com.", "a.example.com."} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			errs <- a.Submit("ABCDEF0123456789", []*route53.Change{testChange("UPSERT", name, "10.0.0.1")}, invocation{})
+		}(name)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Bad: %v", err)
+		}
+	}
+	if len(batches) != 1 || len(batches[0]) != 2 {
+		t.Fatalf("Expected 1 batch of 2 changes, got %#v", batches)
+	}
+}
+
+func TestChangeAggregator_individualRetry(t *testing.T) {
+	a := &changeAggregator{
+		send: func(zoneID string, batch []*route53.Change, events []invocation) error {
+			for _, change := range batch {
+				if *change.ResourceRecordSet.Name == "bad.example.com." {
+					return &changeBatchError{err: errors.New("error")}
+				}
+			}
+			return nil
+		},
+		window:  time.Millisecond * 50,
+		pending: make(map[string][]*changeSubmission),
+	}
+
+	good := make(chan error, 1)
+	bad := make(chan error, 1)
+	go func() {
+		good <- a.Submit("ABCDEF0123456789", []*route53.Change{testChange("UPSERT", "good.example.com.", "10.0.0.1")}, invocation{})
+	}()
+	go func() {
+		bad <- a.Submit("ABCDEF0123456789", []*route53.Change{testChange("UPSERT", "bad.example.com.", "10.0.0.2")}, invocation{})
+	}()
+
+	if err := <-good; err != nil {
+		t.Fatalf("Expected good submission to succeed, got %v", err)
+	}
+	if err := <-bad; err == nil {
+		t.Fatal("Expected bad submission to fail, got no error")
+	}
+}
+
+func TestChangeAggregator_audit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "asg53")
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink := newJSONLAuditSink(filepath.Join(dir, "audit.jsonl"))
+	client := testAwsClient()
+	client.audit = sink
+	a := newChangeAggregator(client, time.Millisecond*50)
+
+	events := []invocation{
+		{AutoScalingGroupName: "ASGName", InstanceID: "i-123456789", LifecycleHookName: "Hook"},
+		{AutoScalingGroupName: "ASGName", InstanceID: "i-987654321", LifecycleHookName: "Hook"},
+	}
+	var wg sync.WaitGroup
+	for n, event := range events {
+		wg.Add(1)
+		go func(name string, event invocation) {
+			defer wg.Done()
+			if err := a.Submit("ABCDEF0123456789", []*route53.Change{testChange("UPSERT", name, "10.0.0.1")}, event); err != nil {
+				t.Errorf("Bad: %v", err)
+			}
+		}(fmt.Sprintf("%d.example.com.", n), event)
+	}
+	wg.Wait()
+
+	history, err := sink.History("0.example.com.", "")
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if len(history) != 1 || !reflect.DeepEqual(history[0].Contributors, events) && !reflect.DeepEqual(history[0].Contributors, []invocation{events[1], events[0]}) {
+		t.Fatalf("Expected 1 audit entry with both events as contributors, got %#v", history)
+	}
+	if history[0].InstanceID != "" {
+		t.Fatalf("Expected no single event on a merged entry, got %#v", history[0])
+	}
+
+	// A submission on its own is recorded against its event.
+	if err := a.Submit("ABCDEF0123456789", []*route53.Change{testChange("UPSERT", "2.example.com.", "10.0.0.1")}, events[0]); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	history, err = sink.History("2.example.com.", "")
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if len(history) != 1 || history[0].InstanceID != "i-123456789" || len(history[0].Contributors) != 0 {
+		t.Fatalf("Expected 1 audit entry for i-123456789, got %#v", history)
+	}
+}
+
+func TestChangeAggregator_syncFailure(t *testing.T) {
+	defer teststubs.ResetRoute53ChangeLog()
+	defer teststubs.ResetRoute53Errors()
+	teststubs.ResetRoute53ChangeLog()
+
+	// The merged batch is accepted, but waiting for it to sync fails.
+	teststubs.InjectRoute53Errors("GetChange", "InvalidInput")
+	a := newChangeAggregator(testAwsClient(), time.Millisecond*50)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for _, name := range []string{"a.example.com.", "b.example.com."} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			errs <- a.Submit("ABCDEF0123456789", []*route53.Change{testChange("CREATE", name, "10.0.0.1")}, invocation{})
+		}(name)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err == nil {
+			t.Fatal("Expected every submission to get the sync error, got none")
+		}
+	}
+	if log := teststubs.Route53ChangeLog(); len(log) != 1 || len(log[0].ChangeBatch.Changes) != 2 {
+		t.Fatalf("Expected the merged batch to be sent once, got %d change batches", len(log))
+	}
+}
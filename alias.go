@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// cloudFrontHostedZoneID is the canonical hosted zone ID for all CloudFront
+// distributions.
+const cloudFrontHostedZoneID = "Z2FDTNDATAQYW2"
+
+// elbHostedZoneIDs are the canonical hosted zone IDs for classic and
+// application load balancers, by region.
+var elbHostedZoneIDs = map[string]string{
+	"us-east-1":      "Z35SXDOTRQ7X7K",
+	"us-east-2":      "Z3AADJGX6KTTL2",
+	"us-west-1":      "Z368ELLRRE2KJ0",
+	"us-west-2":      "Z1H1FL5HABSF5",
+	"ca-central-1":   "ZQSVJUPU6J1EY",
+	"eu-west-1":      "Z32O12XQLNTSW2",
+	"eu-west-2":      "ZHURV8PSTC4K8",
+	"eu-central-1":   "Z215JYRZR1TBD5",
+	"ap-south-1":     "ZP97RAFLXTNZK",
+	"ap-northeast-1": "Z14GRHDCWA56QT",
+	"ap-northeast-2": "ZWKZPGTI48KDX",
+	"ap-southeast-1": "Z1LMS91P8CMLE5",
+	"ap-southeast-2": "Z1GM3OXH4ZPM65",
+	"sa-east-1":      "Z2P70J7HTTTPLU",
+}
+
+// s3WebsiteHostedZoneIDs are the canonical hosted zone IDs for S3 website
+// endpoints, by region.
+var s3WebsiteHostedZoneIDs = map[string]string{
+	"us-east-1":      "Z3AQBSTGFYJSTF",
+	"us-east-2":      "Z2O1EMRO9K5GLX",
+	"us-west-1":      "Z2F56UZL2M1ACD",
+	"us-west-2":      "Z3BJ6K6RIION7M",
+	"ca-central-1":   "Z1QDHH18159H29",
+	"eu-west-1":      "Z1BKCTXD74EZPE",
+	"eu-west-2":      "Z3GKZC51ZF0DB4",
+	"eu-central-1":   "Z21DNDUVLTQW6Q",
+	"ap-south-1":     "Z11RGJOFQNVJUP",
+	"ap-northeast-1": "Z2M4EHUR26P7ZW",
+	"ap-northeast-2": "Z3W03O7B5YMIYP",
+	"ap-southeast-1": "Z3O0J2DXBE1FTB",
+	"ap-southeast-2": "Z1WCIGYICN2BYD",
+	"sa-east-1":      "Z7KQH4QJS55SO",
+}
+
+var (
+	// elbDNSPattern matches classic and application load balancer DNS names,
+	// capturing the region.
+	elbDNSPattern = regexp.MustCompile(`^(?:dualstack\.)?[^.]+\.([a-z0-9-]+)\.elb\.amazonaws\.com\.?$`)
+
+	// s3WebsiteDNSPattern matches S3 website endpoints, capturing the region.
+	s3WebsiteDNSPattern = regexp.MustCompile(`(?:^|\.)s3-website[.-]([a-z0-9-]+)\.amazonaws\.com\.?$`)
+
+	// cloudFrontDNSPattern matches CloudFront distribution DNS names.
+	cloudFrontDNSPattern = regexp.MustCompile(`\.cloudfront\.net\.?$`)
+)
+
+// aliasTargetKind is the kind of resource an alias target points to.
+type aliasTargetKind int
+
+const (
+	// aliasTargetRecord is another record in the same hosted zone.
+	aliasTargetRecord aliasTargetKind = iota
+
+	// aliasTargetELB is a classic or application load balancer.
+	aliasTargetELB
+
+	// aliasTargetS3Website is an S3 website endpoint.
+	aliasTargetS3Website
+
+	// aliasTargetCloudFront is a CloudFront distribution.
+	aliasTargetCloudFront
+)
+
+// canonicalHostedZone works out what kind of resource an alias target DNS
+// name points to, and returns its canonical hosted zone ID. An empty ID is
+// returned for records in the same zone. An error is returned for AWS
+// endpoints in unknown regions, or of an unsupported type.
+func canonicalHostedZone(dnsName string) (aliasTargetKind, string, error) {
+	name := strings.ToLower(dnsName)
+	if m := elbDNSPattern.FindStringSubmatch(name); m != nil {
+		if id, ok := elbHostedZoneIDs[m[1]]; ok {
+			return aliasTargetELB, id, nil
+		}
+		return aliasTargetELB, "", fmt.Errorf("Unknown region %q for load balancer %s, supply AliasTarget.HostedZoneId", m[1], dnsName)
+	}
+	if m := s3WebsiteDNSPattern.FindStringSubmatch(name); m != nil {
+		if id, ok := s3WebsiteHostedZoneIDs[m[1]]; ok {
+			return aliasTargetS3Website, id, nil
+		}
+		return aliasTargetS3Website, "", fmt.Errorf("Unknown region %q for S3 website endpoint %s, supply AliasTarget.HostedZoneId", m[1], dnsName)
+	}
+	if cloudFrontDNSPattern.MatchString(name) {
+		return aliasTargetCloudFront, cloudFrontHostedZoneID, nil
+	}
+	if strings.HasSuffix(strings.TrimSuffix(name, "."), ".amazonaws.com") {
+		return aliasTargetRecord, "", fmt.Errorf("Cannot determine the canonical hosted zone for %s, supply AliasTarget.HostedZoneId", dnsName)
+	}
+	return aliasTargetRecord, "", nil
+}
+
+// completeAliasTargets fills in and validates the alias targets in batch,
+// which is to be sent to zoneID. batch is updated in place.
+//
+// If AliasTarget.HostedZoneId is not set, it is filled in with the canonical
+// hosted zone ID for the target's DNS name - the regional zone for load
+// balancers and S3 website endpoints, the global zone for CloudFront
+// distributions, or zoneID for anything else, which is treated as another
+// record in the same zone. If it is set, it needs to match the canonical
+// zone for AWS endpoints.
+//
+// If EvaluateTargetHealth is not set, it defaults to true for load
+// balancers, and false for everything else. CloudFront and S3 website
+// targets cannot evaluate target health.
+//
+// Records in the same zone need to exist already with the same type, or be
+// created by an earlier change in the batch. Alias record sets cannot have a
+// TTL or resource records.
+func (c *awsClient) completeAliasTargets(zoneID string, batch []*route53.Change) error {
+	for n, change := range batch {
+		rrSet := change.ResourceRecordSet
+		alias := rrSet.AliasTarget
+		if alias == nil {
+			continue
+		}
+		if rrSet.TTL != nil || len(rrSet.ResourceRecords) > 0 {
+			return fmt.Errorf("Alias record set %s cannot have a TTL or resource records", aws.StringValue(rrSet.Name))
+		}
+		if aws.StringValue(alias.DNSName) == "" {
+			return fmt.Errorf("Alias record set %s is missing AliasTarget.DNSName", aws.StringValue(rrSet.Name))
+		}
+
+		kind, canonical, err := canonicalHostedZone(*alias.DNSName)
+		if err != nil && alias.HostedZoneId == nil {
+			return err
+		}
+		if kind == aliasTargetRecord {
+			canonical = zoneID
+		}
+		switch {
+		case alias.HostedZoneId == nil:
+			alias.HostedZoneId = aws.String(canonical)
+		case canonical != "" && *alias.HostedZoneId != canonical:
+			return fmt.Errorf("Alias target %s has HostedZoneId %s, expected %s", *alias.DNSName, *alias.HostedZoneId, canonical)
+		}
+
+		if alias.EvaluateTargetHealth == nil {
+			alias.EvaluateTargetHealth = aws.Bool(kind == aliasTargetELB)
+		}
+		if *alias.EvaluateTargetHealth && (kind == aliasTargetCloudFront || kind == aliasTargetS3Website) {
+			return fmt.Errorf("Alias target %s cannot evaluate target health", *alias.DNSName)
+		}
+
+		if kind == aliasTargetRecord && *alias.HostedZoneId == zoneID && aws.StringValue(change.Action) != route53.ChangeActionDelete {
+			if err := c.validateAliasRecordTarget(zoneID, *alias.DNSName, aws.StringValue(rrSet.Type), batch[:n]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateAliasRecordTarget checks that the record set an alias points to
+// exists in the zone with the supplied type, or is created or upserted by a
+// change in earlier.
+func (c *awsClient) validateAliasRecordTarget(zoneID, target, rrType string, earlier []*route53.Change) error {
+	for _, change := range earlier {
+		if aws.StringValue(change.Action) != route53.ChangeActionDelete &&
+			rrSetNameMatches(aws.StringValue(change.ResourceRecordSet.Name), target) &&
+			aws.StringValue(change.ResourceRecordSet.Type) == rrType {
+			return nil
+		}
+	}
+
+	// Any record set with the name and type will do, including those with a
+	// SetIdentifier, so this does not need an exact match.
+	existing, err := c.firstRoute53ResourceRecordSet(zoneID, target, rrType, "")
+	if err != nil {
+		return err
+	}
+	if existing == nil || !rrSetNameMatches(aws.StringValue(existing.Name), target) || aws.StringValue(existing.Type) != rrType {
+		return fmt.Errorf("Alias target %s %s does not exist in zone ID %s", target, rrType, zoneID)
+	}
+	return nil
+}
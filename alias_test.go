@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// testAliasChange returns a change for an alias record set.
+func testAliasChange(action, name, rrType string, alias *route53.AliasTarget) *route53.Change {
+	return &route53.Change{
+		Action: aws.String(action),
+		ResourceRecordSet: &route53.ResourceRecordSet{
+			Name:        aws.String(name),
+			Type:        aws.String(rrType),
+			AliasTarget: alias,
+		},
+	}
+}
+
+func TestCanonicalHostedZone(t *testing.T) {
+	cases := []struct {
+		DNSName  string
+		Kind     aliasTargetKind
+		Expected string
+		Err      bool
+	}{
+		{"my-lb-1234567890.us-west-2.elb.amazonaws.com", aliasTargetELB, "Z1H1FL5HABSF5", false},
+		{"dualstack.internal-my-lb-1234567890.eu-west-1.elb.amazonaws.com.", aliasTargetELB, "Z32O12XQLNTSW2", false},
+		{"my-lb-1234567890.mars-north-1.elb.amazonaws.com", aliasTargetELB, "", true},
+		{"s3-website-us-east-1.amazonaws.com", aliasTargetS3Website, "Z3AQBSTGFYJSTF", false},
+		{"www.example.com.s3-website.eu-central-1.amazonaws.com", aliasTargetS3Website, "Z21DNDUVLTQW6Q", false},
+		{"d111111abcdef8.cloudfront.net.", aliasTargetCloudFront, "Z2FDTNDATAQYW2", false},
+		{"my-env.us-west-2.elasticbeanstalk.amazonaws.com", aliasTargetRecord, "", true},
+		{"www.example.com.", aliasTargetRecord, "", false},
+	}
+
+	for _, c := range cases {
+		kind, id, err := canonicalHostedZone(c.DNSName)
+		if c.Err != (err != nil) {
+			t.Fatalf("%s: expected error to be %t, got %v", c.DNSName, c.Err, err)
+		}
+		if kind != c.Kind || id != c.Expected {
+			t.Fatalf("%s: expected %d %q, got %d %q", c.DNSName, c.Kind, c.Expected, kind, id)
+		}
+	}
+}
+
+func TestCompleteAliasTargets(t *testing.T) {
+	client := testAwsClient()
+	batch := []*route53.Change{
+		testAliasChange("UPSERT", "lb.example.com.", "A", &route53.AliasTarget{DNSName: aws.String("my-lb-1234567890.us-west-2.elb.amazonaws.com")}),
+		testAliasChange("UPSERT", "cdn.example.com.", "A", &route53.AliasTarget{DNSName: aws.String("d111111abcdef8.cloudfront.net")}),
+		testAliasChange("UPSERT", "apex.example.com.", "A", &route53.AliasTarget{DNSName: aws.String("i-123456789.example.com.")}),
+		testChange("CREATE", "new.example.com.", "10.0.0.1"),
+		testAliasChange("UPSERT", "alias.example.com.", "A", &route53.AliasTarget{DNSName: aws.String("new.example.com."), EvaluateTargetHealth: aws.Bool(true)}),
+	}
+
+	if err := client.completeAliasTargets("ABCDEF0123456789", batch); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	expected := []struct {
+		HostedZoneID         string
+		EvaluateTargetHealth bool
+	}{
+		{"Z1H1FL5HABSF5", true},
+		{"Z2FDTNDATAQYW2", false},
+		{"ABCDEF0123456789", false},
+		{},
+		{"ABCDEF0123456789", true},
+	}
+	for n, e := range expected {
+		alias := batch[n].ResourceRecordSet.AliasTarget
+		if alias == nil {
+			continue
+		}
+		if *alias.HostedZoneId != e.HostedZoneID || *alias.EvaluateTargetHealth != e.EvaluateTargetHealth {
+			t.Fatalf("Expected change %d to have %s %t, got %s %t", n, e.HostedZoneID, e.EvaluateTargetHealth, *alias.HostedZoneId, *alias.EvaluateTargetHealth)
+		}
+	}
+}
+
+func TestCompleteAliasTargets_invalid(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Change *route53.Change
+	}{
+		{"missing target", testAliasChange("UPSERT", "a.example.com.", "A", &route53.AliasTarget{DNSName: aws.String("missing.example.com.")})},
+		{"wrong type", testAliasChange("UPSERT", "a.example.com.", "AAAA", &route53.AliasTarget{DNSName: aws.String("i-123456789.example.com.")})},
+		{"wrong zone", testAliasChange("UPSERT", "a.example.com.", "A", &route53.AliasTarget{DNSName: aws.String("d111111abcdef8.cloudfront.net"), HostedZoneId: aws.String("Z1H1FL5HABSF5")})},
+		{"target health", testAliasChange("UPSERT", "a.example.com.", "A", &route53.AliasTarget{DNSName: aws.String("d111111abcdef8.cloudfront.net"), EvaluateTargetHealth: aws.Bool(true)})},
+		{"no DNS name", testAliasChange("UPSERT", "a.example.com.", "A", &route53.AliasTarget{})},
+		{"TTL", &route53.Change{
+			Action: aws.String("UPSERT"),
+			ResourceRecordSet: &route53.ResourceRecordSet{
+				Name:        aws.String("a.example.com."),
+				Type:        aws.String("A"),
+				TTL:         aws.Int64(60),
+				AliasTarget: &route53.AliasTarget{DNSName: aws.String("d111111abcdef8.cloudfront.net")},
+			},
+		}},
+	}
+
+	client := testAwsClient()
+	for _, c := range cases {
+		if err := client.completeAliasTargets("ABCDEF0123456789", []*route53.Change{c.Change}); err == nil {
+			t.Fatalf("%s: expected error, got none", c.Name)
+		}
+	}
+
+	// Deleting an alias to a record that no longer exists is fine.
+	deletion := testAliasChange("DELETE", "a.example.com.", "A", &route53.AliasTarget{DNSName: aws.String("missing.example.com.")})
+	if err := client.completeAliasTargets("ABCDEF0123456789", []*route53.Change{deletion}); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+}
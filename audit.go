@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// Environment variables that configure the audit trail. If none are set,
+// no audit entries are written.
+const (
+	// The path of a local JSONL file that audit entries are appended to.
+	auditFileEnvVar = "ASG53_AUDIT_FILE"
+
+	// The S3 bucket that audit entries are written to, one object per entry.
+	auditS3BucketEnvVar = "ASG53_AUDIT_S3_BUCKET"
+
+	// The key prefix for audit entries in the S3 bucket.
+	auditS3PrefixEnvVar = "ASG53_AUDIT_S3_PREFIX"
+
+	// The endpoint of an S3-compatible service to use instead of S3.
+	auditS3EndpointEnvVar = "ASG53_AUDIT_S3_ENDPOINT"
+)
+
+// invocation identifies the event that a client is processing. It is
+// recorded in audit entries for the change batches sent for the event.
+type invocation struct {
+	// The Lambda request ID, if running under Lambda.
+	RequestID string
+
+	// The auto scaling group name, instance ID, and lifecycle hook name of the
+	// event.
+	AutoScalingGroupName string
+	InstanceID           string
+	LifecycleHookName    string
+}
+
+// auditEntry is the record of a change batch that was applied to Route 53.
+type auditEntry struct {
+	// The time the change batch was accepted by Route 53.
+	Time time.Time
+
+	// The event the change batch was sent for.
+	RequestID            string `json:",omitempty"`
+	AutoScalingGroupName string `json:",omitempty"`
+	InstanceID           string `json:",omitempty"`
+	LifecycleHookName    string `json:",omitempty"`
+
+	// The events whose changes were coalesced into the change batch, if there
+	// was more than one. The fields above are empty in that case.
+	Contributors []invocation `json:",omitempty"`
+
+	// The hosted zone ID, and the change ID returned by Route 53.
+	HostedZoneID string
+	ChangeID     string
+
+	// The rendered changes, as sent.
+	Changes []*route53.Change
+
+	// The resource record sets that the changes replaced or deleted, as they
+	// existed before the change batch was sent. Record sets that did not
+	// exist are left out.
+	Previous []*route53.ResourceRecordSet `json:",omitempty"`
+
+	// The difference each change made, in the order of Changes.
+	Diff []rrSetDiff `json:",omitempty"`
+}
+
+// changesRecord returns true if any of the entry's changes are to a resource
+// record set with the supplied name.
+func (e *auditEntry) changesRecord(name string) bool {
+	for _, change := range e.Changes {
+		if normalizeZoneName(aws.StringValue(change.ResourceRecordSet.Name)) == normalizeZoneName(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventString returns the event or events that the entry's change batch was
+// sent for, for display, as "asg:instance:hook", separated by commas.
+func (e *auditEntry) eventString() string {
+	events := e.Contributors
+	if len(events) == 0 {
+		events = []invocation{{AutoScalingGroupName: e.AutoScalingGroupName, InstanceID: e.InstanceID, LifecycleHookName: e.LifecycleHookName}}
+	}
+	parts := []string{}
+	for _, ev := range events {
+		parts = append(parts, strings.Join([]string{ev.AutoScalingGroupName, ev.InstanceID, ev.LifecycleHookName}, ":"))
+	}
+	return strings.Join(parts, ",")
+}
+
+// auditSink stores audit entries.
+type auditSink interface {
+	// Record stores an audit entry.
+	Record(entry *auditEntry) error
+
+	// History returns the stored entries with changes to the resource record
+	// sets with the supplied name, oldest first. If zoneID is not empty, only
+	// entries for that hosted zone are returned.
+	History(name, zoneID string) ([]*auditEntry, error)
+}
+
+// jsonlAuditSink is an auditSink that appends entries to a local file, as
+// one JSON object per line.
+type jsonlAuditSink struct {
+	// The path of the file, and the lock that serializes writes to it.
+	mu   sync.Mutex
+	path string
+}
+
+// newJSONLAuditSink returns a jsonlAuditSink that writes to the supplied
+// path.
+func newJSONLAuditSink(path string) *jsonlAuditSink {
+	return &jsonlAuditSink{path: path}
+}
+
+// Record implements auditSink for jsonlAuditSink.
+func (s *jsonlAuditSink) Record(entry *auditEntry) error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(raw, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// History implements auditSink for jsonlAuditSink.
+func (s *jsonlAuditSink) History(name, zoneID string) ([]*auditEntry, error) {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []*auditEntry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) < 1 {
+			continue
+		}
+		entry := &auditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return nil, fmt.Errorf("Error parsing %s line %d: %v", s.path, line, err)
+		}
+		if (zoneID == "" || entry.HostedZoneID == zoneID) && entry.changesRecord(name) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// s3AuditSink is an auditSink that writes each entry to its own object in an
+// S3 bucket, or a bucket in an S3-compatible service. Objects are keyed on
+// the prefix, hosted zone ID, time, and change ID, so that history for a
+// zone can be listed in order.
+type s3AuditSink struct {
+	// The S3 client.
+	s3 *s3Client
+
+	// The bucket, and the key prefix of the entries.
+	bucket string
+	prefix string
+}
+
+// newS3AuditSink returns an s3AuditSink that writes to the supplied bucket
+// and key prefix, using the supplied config provider (usually a session).
+// If endpoint is not empty, it is used instead of the S3 endpoint.
+func newS3AuditSink(p client.ConfigProvider, bucket, prefix, endpoint string) *s3AuditSink {
+	cfgs := []*aws.Config{}
+	if endpoint != "" {
+		cfgs = append(cfgs, &aws.Config{Endpoint: aws.String(endpoint)})
+	}
+	return &s3AuditSink{s3: newS3Client(p, cfgs...), bucket: bucket, prefix: prefix}
+}
+
+// key returns the object key for an entry.
+func (s *s3AuditSink) key(entry *auditEntry) string {
+	changeID := strings.TrimPrefix(entry.ChangeID, "/change/")
+	return fmt.Sprintf("%s%s/%s-%s.json", s.prefix, entry.HostedZoneID, entry.Time.UTC().Format("20060102T150405.000000000Z"), changeID)
+}
+
+// Record implements auditSink for s3AuditSink.
+func (s *s3AuditSink) Record(entry *auditEntry) error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return s.s3.PutObject(s.bucket, s.key(entry), raw)
+}
+
+// History implements auditSink for s3AuditSink. Every entry under the
+// prefix (or under the zone, if zoneID is set) is read, so this can be slow
+// for large trails.
+func (s *s3AuditSink) History(name, zoneID string) ([]*auditEntry, error) {
+	prefix := s.prefix
+	if zoneID != "" {
+		prefix += zoneID + "/"
+	}
+	keys, err := s.s3.ListObjectKeys(s.bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*auditEntry{}
+	for _, key := range keys {
+		raw, err := s.s3.GetObject(s.bucket, key)
+		if err != nil {
+			return nil, err
+		}
+		entry := &auditEntry{}
+		if err := json.Unmarshal(raw, entry); err != nil {
+			return nil, fmt.Errorf("Error parsing %s: %v", key, err)
+		}
+		if entry.changesRecord(name) {
+			entries = append(entries, entry)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	return entries, nil
+}
+
+// loadAuditSink returns the auditSink configured in the environment, using
+// the supplied config provider for S3. nil is returned if no audit trail is
+// configured.
+func loadAuditSink(p client.ConfigProvider) (auditSink, error) {
+	path := os.Getenv(auditFileEnvVar)
+	bucket := os.Getenv(auditS3BucketEnvVar)
+	switch {
+	case path != "" && bucket != "":
+		return nil, fmt.Errorf("Only one of %s and %s can be set", auditFileEnvVar, auditS3BucketEnvVar)
+	case path != "":
+		return newJSONLAuditSink(path), nil
+	case bucket != "":
+		return newS3AuditSink(p, bucket, os.Getenv(auditS3PrefixEnvVar), os.Getenv(auditS3EndpointEnvVar)), nil
+	}
+	return nil, nil
+}
+
+// recordAudit writes an audit entry for a change batch that Route 53 has
+// accepted, if the client has an audit sink. The changes have already been
+// applied at this point, so errors are logged rather than returned.
+func (c *awsClient) recordAudit(zoneID, changeID string, batch []*route53.Change, previous []*route53.ResourceRecordSet, diffs []rrSetDiff) {
+	if c.audit == nil {
+		return
+	}
+	entry := &auditEntry{
+		Time:                 time.Now().UTC(),
+		RequestID:            c.event.RequestID,
+		AutoScalingGroupName: c.event.AutoScalingGroupName,
+		InstanceID:           c.event.InstanceID,
+		LifecycleHookName:    c.event.LifecycleHookName,
+		Contributors:         c.contributors,
+		HostedZoneID:         zoneID,
+		ChangeID:             changeID,
+		Changes:              batch,
+		Previous:             previous,
+		Diff:                 diffs,
+	}
+	if err := c.audit.Record(entry); err != nil {
+		c.logger().With("zone_id", zoneID).Errorf("Error writing audit entry for change ID %s: %v", changeID, err)
+	}
+}
+
+// writeHistory writes a line for each change to name in entries to w.
+func writeHistory(w io.Writer, name string, entries []*auditEntry) {
+	for _, entry := range entries {
+		event := entry.eventString()
+		for _, change := range entry.Changes {
+			rrSet := change.ResourceRecordSet
+			if normalizeZoneName(aws.StringValue(rrSet.Name)) != normalizeZoneName(name) {
+				continue
+			}
+			fmt.Fprintf(w, "%s %s %s %s %s %s %s %s\n",
+				entry.Time.UTC().Format(time.RFC3339),
+				entry.HostedZoneID,
+				entry.ChangeID,
+				event,
+				aws.StringValue(change.Action),
+				aws.StringValue(rrSet.Name),
+				aws.StringValue(rrSet.Type),
+				strings.Join(rrSetValues(rrSet), ","),
+			)
+		}
+	}
+}
+
+// rrSetValues returns the values of a resource record set, or its alias
+// target.
+func rrSetValues(rrSet *route53.ResourceRecordSet) []string {
+	values := []string{}
+	for _, rr := range rrSet.ResourceRecords {
+		values = append(values, aws.StringValue(rr.Value))
+	}
+	if rrSet.AliasTarget != nil {
+		values = append(values, "ALIAS "+aws.StringValue(rrSet.AliasTarget.DNSName))
+	}
+	return values
+}
+
+// runHistory is the entry point for the history command. It prints the
+// audit trail for a resource record set name, from the audit sink
+// configured in the environment.
+func runHistory(args []string) error {
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	name := flags.String("name", "", "The resource record set name to show the history of.")
+	zoneID := flags.String("zone-id", "", "If set, only show changes to this hosted zone ID.")
+	raw := flags.Bool("json", false, "Print the full audit entries as JSON lines.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" {
+		return &usageError{errors.New("-name is required")}
+	}
+
+	client, err := newAWSClient()
+	if err != nil {
+		return err
+	}
+	if client.audit == nil {
+		return fmt.Errorf("No audit trail configured, set %s or %s", auditFileEnvVar, auditS3BucketEnvVar)
+	}
+
+	entries, err := client.audit.History(*name, *zoneID)
+	if err != nil {
+		return fmt.Errorf("Error reading audit trail: %v", err)
+	}
+	if !*raw {
+		writeHistory(os.Stdout, *name, entries)
+		return nil
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// testAuditEntry returns an audit entry with a single change to name in the
+// supplied zone.
+func testAuditEntry(zoneID, changeID, name string) *auditEntry {
+	return &auditEntry{
+		Time:         time.Now().UTC(),
+		InstanceID:   "i-123456789",
+		HostedZoneID: zoneID,
+		ChangeID:     changeID,
+		Changes: []*route53.Change{
+			{
+				Action: aws.String(route53.ChangeActionUpsert),
+				ResourceRecordSet: &route53.ResourceRecordSet{
+					Name:            aws.String(name),
+					Type:            aws.String(route53.RRTypeA),
+					TTL:             aws.Int64(60),
+					ResourceRecords: []*route53.ResourceRecord{{Value: aws.String("10.0.0.1")}},
+				},
+			},
+		},
+	}
+}
+
+// testAuditSinkHistory checks that the history of a sink is filtered by
+// record name and zone.
+func testAuditSinkHistory(t *testing.T, sink auditSink) {
+	entries := []*auditEntry{
+		testAuditEntry("ABCDEF0123456789", "/change/C1", "www.example.com."),
+		testAuditEntry("ABCDEF0123456789", "/change/C2", "api.example.com."),
+		testAuditEntry("0123456789ABCDEF", "/change/C3", "www.example.com"),
+	}
+	for _, entry := range entries {
+		if err := sink.Record(entry); err != nil {
+			t.Fatalf("Bad: %v", err)
+		}
+	}
+
+	history, err := sink.History("www.example.com", "")
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if len(history) != 2 || history[0].ChangeID != "/change/C1" || history[1].ChangeID != "/change/C3" {
+		t.Fatalf("Expected changes C1 and C3, got %#v", history)
+	}
+
+	history, err = sink.History("www.example.com.", "0123456789ABCDEF")
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if len(history) != 1 || history[0].ChangeID != "/change/C3" {
+		t.Fatalf("Expected change C3, got %#v", history)
+	}
+}
+
+func TestJSONLAuditSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "asg53")
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink := newJSONLAuditSink(filepath.Join(dir, "audit.jsonl"))
+	history, err := sink.History("www.example.com.", "")
+	if err != nil || len(history) != 0 {
+		t.Fatalf("Expected no history for missing file, got %v, %v", history, err)
+	}
+	testAuditSinkHistory(t, sink)
+}
+
+// testS3Server is an in-memory S3-compatible server, supporting just enough
+// of the API for s3AuditSink.
+func testS3Server() *httptest.Server {
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		switch {
+		case r.Method == "PUT" && len(parts) == 2:
+			objects[parts[1]], _ = ioutil.ReadAll(r.Body)
+		case r.Method == "GET" && len(parts) == 2:
+			content, ok := objects[parts[1]]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, "<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>")
+				return
+			}
+			w.Write(content)
+		case r.Method == "GET":
+			keys := []string{}
+			for key := range objects {
+				if strings.HasPrefix(key, r.URL.Query().Get("prefix")) && key > r.URL.Query().Get("marker") {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			// Return one key per page, to exercise paging.
+			fmt.Fprint(w, "<ListBucketResult>")
+			if len(keys) > 0 {
+				fmt.Fprintf(w, "<Contents><Key>%s</Key></Contents>", keys[0])
+			}
+			fmt.Fprintf(w, "<IsTruncated>%t</IsTruncated></ListBucketResult>", len(keys) > 1)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+}
+
+// testS3AuditSink returns an s3AuditSink that sends requests to the supplied
+// test server.
+func testS3AuditSink(ts *httptest.Server) *s3AuditSink {
+	sess := session.New(&aws.Config{
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+	})
+	return newS3AuditSink(sess, "audit-bucket", "asg53/", ts.URL)
+}
+
+func TestS3AuditSink(t *testing.T) {
+	ts := testS3Server()
+	defer ts.Close()
+
+	testAuditSinkHistory(t, testS3AuditSink(ts))
+}
+
+func TestS3AuditSink_error(t *testing.T) {
+	ts := testS3Server()
+	defer ts.Close()
+
+	_, err := testS3AuditSink(ts).s3.GetObject("audit-bucket", "missing")
+	if err == nil || !strings.Contains(err.Error(), "NoSuchKey") {
+		t.Fatalf("Expected NoSuchKey error, got %v", err)
+	}
+}
+
+func TestProcessMessage_audit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "asg53")
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	message, err := parseInnerSNSMessage([]byte(testMessageJSON))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+	message.LifecycleTransition = transitionLaunch
+	args, err := parseSNSMetadata([]byte(testMetadataJSON))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+
+	sink := newJSONLAuditSink(filepath.Join(dir, "audit.jsonl"))
+	client := testAwsClient()
+	client.audit = sink
+	client.event.RequestID = "abc-123"
+	if err := processMessage(client, message, args); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	history, err := sink.History("www.example.com.", "")
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if len(history) != 1 {
+		t.Fatalf("Expected 1 audit entry, got %d", len(history))
+	}
+	entry := history[0]
+	if entry.RequestID != "abc-123" || entry.AutoScalingGroupName != message.AutoScalingGroupName ||
+		entry.InstanceID != message.EC2InstanceID || entry.LifecycleHookName != message.LifecycleHookName {
+		t.Fatalf("Unexpected event in audit entry: %#v", entry)
+	}
+	if entry.HostedZoneID != args.HostedZoneID || entry.ChangeID == "" || len(entry.Changes) != len(args.Changes) {
+		t.Fatalf("Unexpected change batch in audit entry: %#v", entry)
+	}
+	if len(entry.Previous) != 2 || aws.StringValue(entry.Previous[1].Name) != "www.example.com." {
+		t.Fatalf("Expected previous record sets for both changes, got %#v", entry.Previous)
+	}
+}
+
+func TestRunHistory_usage(t *testing.T) {
+	if _, ok := runHistory([]string{"-zone-id", "ABCDEF0123456789"}).(*usageError); !ok {
+		t.Fatal("Expected *usageError without -name")
+	}
+}
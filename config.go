@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// configEnvVar is the environment variable that holds an inline JSON
+// configuration document.
+const configEnvVar = "ASG53_CONFIG"
+
+// configFileEnvVar is the environment variable that holds the path to a JSON
+// configuration document. ASG53_CONFIG takes priority if both are set.
+const configFileEnvVar = "ASG53_CONFIG_FILE"
+
+// groupConfig holds the launch and termination arguments for a specific
+// configuration key, such as an auto scaling group name. This is used for
+// events that do not carry their own notification metadata, such as plain
+// auto scaling notifications.
+//
+// Example:
+//
+//   {
+//   	"ASGName": {
+//   		"Launch": {
+//   			"HostedZoneID": "ABCDEF0123456789",
+//   			"Changes": [...]
+//   		},
+//   		"Terminate": {
+//   			"HostedZoneID": "ABCDEF0123456789",
+//   			"Changes": [...]
+//   		}
+//   	}
+//   }
+//
+// Each entry is a messageArgs document, and follows the same rules as if it
+// were supplied in lifecycle hook metadata.
+type groupConfig struct {
+	// The arguments to use on instance launch.
+	Launch *messageArgs
+
+	// The arguments to use on instance termination.
+	Terminate *messageArgs
+}
+
+// argsFor returns the messageArgs for the supplied lifecycle transition. An
+// error is returned if the transition is not configured.
+func (c groupConfig) argsFor(transition string) (messageArgs, error) {
+	var args *messageArgs
+	switch transition {
+	case transitionLaunch:
+		args = c.Launch
+	case transitionTerminate:
+		args = c.Terminate
+	default:
+		return messageArgs{}, fmt.Errorf("Unsupported lifecycle transition %q", transition)
+	}
+	if args == nil {
+		return messageArgs{}, fmt.Errorf("No configuration present for lifecycle transition %q", transition)
+	}
+	return *args, nil
+}
+
+// configSource supplies groupConfig data by key.
+type configSource interface {
+	// Lookup returns the groupConfig for the supplied key. An error is
+	// returned if the key cannot be found.
+	Lookup(key string) (groupConfig, error)
+}
+
+// jsonConfigSource is a configSource backed by a JSON document, keyed on
+// the top-level object's field names.
+//
+// Entries are stored raw and parsed on every lookup, as the template
+// rendering process modifies the change batch in place.
+type jsonConfigSource struct {
+	// The raw configuration entries.
+	entries map[string]json.RawMessage
+}
+
+// newJSONConfigSource returns a jsonConfigSource from the supplied raw JSON
+// document.
+func newJSONConfigSource(raw []byte) (*jsonConfigSource, error) {
+	src := jsonConfigSource{}
+	if err := json.Unmarshal(raw, &src.entries); err != nil {
+		return nil, fmt.Errorf("Error parsing configuration JSON: %v", err)
+	}
+	return &src, nil
+}
+
+// Lookup implements configSource for jsonConfigSource.
+func (s *jsonConfigSource) Lookup(key string) (groupConfig, error) {
+	defaultLogger.Infof("Looking up configuration for key: %s", key)
+	parsed := groupConfig{}
+	raw, ok := s.entries[key]
+	if !ok {
+		return parsed, fmt.Errorf("No configuration found for key %q", key)
+	}
+	if err := decodeStrict(raw, &parsed); err != nil {
+		return parsed, fmt.Errorf("Error parsing configuration for key %q: %v", key, err)
+	}
+	errs := schemaErrors{}
+	if parsed.Launch != nil {
+		parsed.Launch.validate(&errs, "$.Launch")
+	}
+	if parsed.Terminate != nil {
+		parsed.Terminate.validate(&errs, "$.Terminate")
+	}
+	if len(errs) > 0 {
+		return parsed, fmt.Errorf("Error in configuration for key %q: %v", key, errs)
+	}
+	return parsed, nil
+}
+
+// loadConfigSource loads the configSource from the environment, either from
+// ASG53_CONFIG or the file referenced in ASG53_CONFIG_FILE.
+func loadConfigSource() (configSource, error) {
+	if raw := os.Getenv(configEnvVar); raw != "" {
+		return newJSONConfigSource([]byte(raw))
+	}
+	if path := os.Getenv(configFileEnvVar); path != "" {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading configuration file: %v", err)
+		}
+		return newJSONConfigSource(raw)
+	}
+	return nil, errors.New("No configuration source present - set either " + configEnvVar + " or " + configFileEnvVar)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// testConfigJSON is a test configuration document in JSON form.
+const testConfigJSON = `
+{
+  "ASGName": {
+    "Launch": {
+      "HostedZoneID": "ABCDEF0123456789",
+      "Changes": [
+        {
+          "Action": "UPSERT",
+          "ResourceRecordSet": {
+            "Name": "{{.InstanceID}}.example.com.",
+            "TTL": 3600,
+            "Type": "A",
+            "ResourceRecords": [
+              {
+                "Value": "{{.InstancePublicIPAddress}}"
+              }
+            ]
+          }
+        }
+      ]
+    }
+  }
+}
+`
+
+func TestJSONConfigSourceLookup(t *testing.T) {
+	src, err := newJSONConfigSource([]byte(testConfigJSON))
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	cfg, err := src.Lookup("ASGName")
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	args, err := cfg.argsFor(transitionLaunch)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	if args.HostedZoneID != "ABCDEF0123456789" {
+		t.Fatalf("Expected HostedZoneID to be ABCDEF0123456789, got %s", args.HostedZoneID)
+	}
+	if len(args.Changes) != 1 {
+		t.Fatalf("Expected 1 change, got %d", len(args.Changes))
+	}
+}
+
+func TestJSONConfigSourceLookup_freshCopy(t *testing.T) {
+	src, err := newJSONConfigSource([]byte(testConfigJSON))
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	first, _ := src.Lookup("ASGName")
+	*first.Launch.Changes[0].ResourceRecordSet.Name = "modified"
+
+	second, _ := src.Lookup("ASGName")
+	if *second.Launch.Changes[0].ResourceRecordSet.Name == "modified" {
+		t.Fatal("Expected lookups to return independent copies")
+	}
+}
+
+func TestJSONConfigSourceLookup_shouldError(t *testing.T) {
+	src, err := newJSONConfigSource([]byte(testConfigJSON))
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	if _, err := src.Lookup("bad"); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+}
+
+func TestGroupConfigArgsFor_shouldError(t *testing.T) {
+	src, err := newJSONConfigSource([]byte(testConfigJSON))
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	cfg, err := src.Lookup("ASGName")
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	if _, err := cfg.argsFor(transitionTerminate); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+}
+
+func TestLoadConfigSource(t *testing.T) {
+	os.Setenv(configEnvVar, testConfigJSON)
+	defer os.Unsetenv(configEnvVar)
+
+	src, err := loadConfigSource()
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	if _, err := src.Lookup("ASGName"); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+}
+
+func TestLoadConfigSource_shouldError(t *testing.T) {
+	os.Unsetenv(configEnvVar)
+	os.Unsetenv(configFileEnvVar)
+
+	if _, err := loadConfigSource(); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+}
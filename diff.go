@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// diffEnvVar is the environment variable that turns off diffing change
+// batches against the current record sets before they are sent, when set to
+// false.
+const diffEnvVar = "ASG53_DIFF"
+
+// loadDiffDisabled returns true if diffing is turned off with ASG53_DIFF.
+func loadDiffDisabled() (bool, error) {
+	raw := os.Getenv(diffEnvVar)
+	if raw == "" {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("Invalid %s %q: %v", diffEnvVar, raw, err)
+	}
+	return !enabled, nil
+}
+
+// dryRunHealthCheckID is the health check ID that templates see in a dry
+// run, as the health check is not created.
+const dryRunHealthCheckID = "dry-run-health-check-id"
+
+// rrSetDiff is the difference that a change makes to a resource record set.
+type rrSetDiff struct {
+	// The action of the change.
+	Action string
+
+	// The resource record set the change is for.
+	Name          string
+	Type          string
+	SetIdentifier string `json:",omitempty"`
+
+	// The values that the change adds and removes. Alias targets are shown as
+	// "ALIAS <DNS name>".
+	Added   []string `json:",omitempty"`
+	Removed []string `json:",omitempty"`
+
+	// The TTL before and after the change, if either is set and they differ.
+	OldTTL *int64 `json:",omitempty"`
+	NewTTL *int64 `json:",omitempty"`
+}
+
+// String returns a one-line summary of the diff, such as
+// "UPSERT www.example.com. CNAME: +new.example.com. -old.example.com. (TTL 300 -> 60)".
+func (d rrSetDiff) String() string {
+	parts := []string{}
+	for _, v := range d.Added {
+		parts = append(parts, "+"+v)
+	}
+	for _, v := range d.Removed {
+		parts = append(parts, "-"+v)
+	}
+	if d.OldTTL != nil || d.NewTTL != nil {
+		parts = append(parts, fmt.Sprintf("(TTL %s -> %s)", ttlString(d.OldTTL), ttlString(d.NewTTL)))
+	}
+	if len(parts) < 1 {
+		parts = append(parts, "(no change)")
+	}
+
+	name := d.Name
+	if d.SetIdentifier != "" {
+		name += " [" + d.SetIdentifier + "]"
+	}
+	return fmt.Sprintf("%s %s %s: %s", d.Action, name, d.Type, strings.Join(parts, " "))
+}
+
+// ttlString returns a TTL for display, or "none" if it is not set.
+func ttlString(ttl *int64) string {
+	if ttl == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%d", *ttl)
+}
+
+// valuesMinus returns the values in a that are not in b, in order.
+func valuesMinus(a, b []string) []string {
+	in := make(map[string]bool)
+	for _, v := range b {
+		in[v] = true
+	}
+	out := []string{}
+	for _, v := range a {
+		if !in[v] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// diffChange returns the difference that change makes to existing, which is
+// the resource record set as it exists before the change, or nil if it does
+// not exist.
+func diffChange(change *route53.Change, existing *route53.ResourceRecordSet) rrSetDiff {
+	rrSet := change.ResourceRecordSet
+	d := rrSetDiff{
+		Action:        aws.StringValue(change.Action),
+		Name:          aws.StringValue(rrSet.Name),
+		Type:          aws.StringValue(rrSet.Type),
+		SetIdentifier: aws.StringValue(rrSet.SetIdentifier),
+	}
+
+	before := []string{}
+	var oldTTL *int64
+	if existing != nil {
+		before = rrSetValues(existing)
+		oldTTL = existing.TTL
+	}
+
+	after := rrSetValues(rrSet)
+	newTTL := rrSet.TTL
+	if d.Action == route53.ChangeActionDelete {
+		if existing == nil {
+			// Report the values the change expected to remove.
+			before = after
+			oldTTL = rrSet.TTL
+		}
+		after = []string{}
+		newTTL = nil
+	}
+
+	d.Added = valuesMinus(after, before)
+	d.Removed = valuesMinus(before, after)
+	if aws.Int64Value(oldTTL) != aws.Int64Value(newTTL) || (oldTTL == nil) != (newTTL == nil) {
+		d.OldTTL = oldTTL
+		d.NewTTL = newTTL
+	}
+	return d
+}
+
+// diffChanges looks up the current state of the resource record sets that
+// the changes in batch operate on, and returns the diff for each change,
+// along with the record sets that exist before the batch is sent. Changes to
+// a record set that an earlier change in the batch operates on are diffed
+// against the result of the earlier change.
+func (c *awsClient) diffChanges(zoneID string, batch []*route53.Change) ([]rrSetDiff, []*route53.ResourceRecordSet, error) {
+	diffs := []rrSetDiff{}
+	previous := []*route53.ResourceRecordSet{}
+	current := make(map[string]*route53.ResourceRecordSet)
+	for _, change := range batch {
+		key := rrSetKey(change)
+		existing, ok := current[key]
+		if !ok {
+			var err error
+			if existing, err = c.findExistingRRSet(zoneID, change); err != nil {
+				return nil, nil, err
+			}
+			if existing != nil {
+				previous = append(previous, existing)
+			}
+		}
+		diffs = append(diffs, diffChange(change, existing))
+
+		if aws.StringValue(change.Action) == route53.ChangeActionDelete {
+			current[key] = nil
+		} else {
+			current[key] = change.ResourceRecordSet
+		}
+	}
+	return diffs, previous, nil
+}
+
+// zonePlan is the set of diffs that would be made to a hosted zone.
+type zonePlan struct {
+	HostedZoneID string
+	Diffs        []rrSetDiff
+}
+
+// planZoneBatches returns the diffs that sending batches would make, without
+// sending them. This includes the changes for SRV pool updates.
+func (c *awsClient) planZoneBatches(batches []zoneBatch) ([]zonePlan, error) {
+	plans := []zonePlan{}
+	for _, b := range batches {
+		client := b.clientFor(c)
+		poolChanges, err := client.poolChanges(b.ZoneID, b.pools)
+		if err != nil {
+			return nil, err
+		}
+		changes := append(append([]*route53.Change{}, b.Changes...), poolChanges...)
+		diffs, _, err := client.diffChanges(b.ZoneID, changes)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, zonePlan{HostedZoneID: b.ZoneID, Diffs: diffs})
+	}
+	return plans, nil
+}
+
+// writePlan writes a line for each diff in plans to w.
+func writePlan(w io.Writer, plans []zonePlan) {
+	for _, plan := range plans {
+		for _, d := range plan.Diffs {
+			fmt.Fprintf(w, "%s %s\n", plan.HostedZoneID, d)
+		}
+	}
+}
+
+// logPlan logs the diffs in plans.
+func (c *awsClient) logPlan(plans []zonePlan) {
+	for _, plan := range plans {
+		for _, d := range plan.Diffs {
+			c.logger().With("zone_id", plan.HostedZoneID).Infof("Planned change: %s", d)
+		}
+	}
+}
+
+// planDryRun logs the plan for batches, and any change policy violations,
+// in place of sending them for a dry run.
+func (c *awsClient) planDryRun(batches []zoneBatch) error {
+	plans, err := c.planZoneBatches(batches)
+	if err != nil {
+		c.logger().Errorf("Error planning changes: %v", err)
+		return err
+	}
+	c.logPlan(plans)
+	if err := c.checkPolicy(batches); err != nil {
+		c.logger().Warnf("%v", err)
+	}
+	c.logger().Infof("Dry run - not sending changes")
+	return nil
+}
+
+// runPlan is the entry point for the plan command. It renders the changes in
+// a metadata document for an instance, and prints the diffs they would make,
+// without sending them.
+func runPlan(args []string) error {
+	flags := flag.NewFlagSet("plan", flag.ContinueOnError)
+	metadataPath := flags.String("metadata", "", "The path to the hook metadata JSON document, or - for stdin.")
+	instanceID := flags.String("instance-id", "", "The instance ID to render the changes for.")
+	transition := flags.String("transition", "launch", "The lifecycle transition to render the changes for: launch or terminate.")
+	raw := flags.Bool("json", false, "Print the plan as JSON.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *metadataPath == "" || *instanceID == "" {
+		return &usageError{errors.New("-metadata and -instance-id are required")}
+	}
+
+	transitions := map[string]string{"launch": transitionLaunch, "terminate": transitionTerminate}
+	t, ok := transitions[*transition]
+	if !ok {
+		return &usageError{fmt.Errorf("Unknown transition %q, expected launch or terminate", *transition)}
+	}
+
+	var metadata []byte
+	var err error
+	if *metadataPath == "-" {
+		metadata, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		metadata, err = ioutil.ReadFile(*metadataPath)
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading metadata: %v", err)
+	}
+	parsed, err := parseSNSMetadata(metadata)
+	if err != nil {
+		return err
+	}
+	parsed.DryRun = true
+
+	client, err := newAWSClient()
+	if err != nil {
+		return err
+	}
+	batches, _, err := renderInstanceChanges(client.forEvent("", *instanceID, ""), *instanceID, parsed, t)
+	if err != nil {
+		return err
+	}
+	plans, err := client.planZoneBatches(batches)
+	if err != nil {
+		return err
+	}
+
+	if *raw {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plans)
+	}
+	writePlan(os.Stdout, plans)
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/paybyphone/asg53/teststubs"
+)
+
+// testDiffChange returns a change to www.example.com. with the supplied
+// action, TTL, and values.
+func testDiffChange(action string, ttl int64, values ...string) *route53.Change {
+	rrSet := &route53.ResourceRecordSet{
+		Name: aws.String("www.example.com."),
+		Type: aws.String(route53.RRTypeA),
+		TTL:  aws.Int64(ttl),
+	}
+	for _, v := range values {
+		rrSet.ResourceRecords = append(rrSet.ResourceRecords, &route53.ResourceRecord{Value: aws.String(v)})
+	}
+	return &route53.Change{Action: aws.String(action), ResourceRecordSet: rrSet}
+}
+
+func TestDiffChange(t *testing.T) {
+	existing := testDiffChange(route53.ChangeActionCreate, 300, "10.0.0.1", "10.0.0.2").ResourceRecordSet
+	cases := []struct {
+		change   *route53.Change
+		existing *route53.ResourceRecordSet
+		expected string
+	}{
+		{testDiffChange(route53.ChangeActionCreate, 60, "10.0.0.1"), nil, "CREATE www.example.com. A: +10.0.0.1 (TTL none -> 60)"},
+		{testDiffChange(route53.ChangeActionUpsert, 60, "10.0.0.2", "10.0.0.3"), existing, "UPSERT www.example.com. A: +10.0.0.3 -10.0.0.1 (TTL 300 -> 60)"},
+		{testDiffChange(route53.ChangeActionUpsert, 300, "10.0.0.1", "10.0.0.2"), existing, "UPSERT www.example.com. A: (no change)"},
+		{testDiffChange(route53.ChangeActionDelete, 300, "10.0.0.1", "10.0.0.2"), existing, "DELETE www.example.com. A: -10.0.0.1 -10.0.0.2 (TTL 300 -> none)"},
+		{testDiffChange(route53.ChangeActionDelete, 60, "10.0.0.9"), nil, "DELETE www.example.com. A: -10.0.0.9 (TTL 60 -> none)"},
+	}
+	for n, tc := range cases {
+		if actual := diffChange(tc.change, tc.existing).String(); actual != tc.expected {
+			t.Fatalf("Case #%d: expected %q, got %q", n, tc.expected, actual)
+		}
+	}
+}
+
+func TestDiffChanges(t *testing.T) {
+	client := testAwsClient()
+	existing := &route53.Change{
+		Action: aws.String(route53.ChangeActionDelete),
+		ResourceRecordSet: &route53.ResourceRecordSet{
+			Name:            aws.String("_app._tcp.example.com."),
+			Type:            aws.String(route53.RRTypeSrv),
+			TTL:             aws.Int64(60),
+			ResourceRecords: []*route53.ResourceRecord{{Value: aws.String("10 5 8080 i-987654321.example.com.")}},
+		},
+	}
+	replacement := &route53.Change{
+		Action: aws.String(route53.ChangeActionCreate),
+		ResourceRecordSet: &route53.ResourceRecordSet{
+			Name: aws.String("_app._tcp.example.com."),
+			Type: aws.String(route53.RRTypeSrv),
+			TTL:  aws.Int64(60),
+			ResourceRecords: []*route53.ResourceRecord{
+				{Value: aws.String("10 5 8080 i-987654321.example.com.")},
+				{Value: aws.String("10 5 8080 i-123456789.example.com.")},
+			},
+		},
+	}
+
+	diffs, previous, err := client.diffChanges("ABCDEF0123456789", []*route53.Change{existing, replacement})
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if len(previous) != 1 {
+		t.Fatalf("Expected 1 previous record set, got %d", len(previous))
+	}
+	// The CREATE is diffed against the result of the DELETE before it.
+	expected := [][]string{{}, {"10 5 8080 i-987654321.example.com.", "10 5 8080 i-123456789.example.com."}}
+	for n, d := range diffs {
+		if !reflect.DeepEqual(expected[n], d.Added) {
+			t.Fatalf("Diff #%d: expected added %v, got %v", n, expected[n], d.Added)
+		}
+	}
+	if len(diffs[0].Removed) != 1 {
+		t.Fatalf("Expected DELETE to remove 1 value, got %v", diffs[0].Removed)
+	}
+}
+
+func TestProcessMessage_dryRun(t *testing.T) {
+	defer teststubs.ResetRoute53ChangeLog()
+	teststubs.ResetRoute53ChangeLog()
+	defer teststubs.ResetRoute53HealthChecks()
+	teststubs.ResetRoute53HealthChecks()
+
+	message, err := parseInnerSNSMessage([]byte(testMessageJSON))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+	message.LifecycleTransition = transitionLaunch
+	args := testHealthCheckMetadata("ABCDEF0123456789")
+	args.DryRun = true
+
+	if err := processMessage(testAwsClient(), message, args); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if log := teststubs.Route53ChangeLog(); len(log) != 0 {
+		t.Fatalf("Expected no change batches to be sent, got %d", len(log))
+	}
+	if checks := teststubs.Route53HealthChecks(); len(checks) != 0 {
+		t.Fatalf("Expected no health checks to be created, got %d", len(checks))
+	}
+}
+
+func TestPlanZoneBatches(t *testing.T) {
+	client := testAwsClient()
+	args, err := parseSNSMetadata([]byte(testMetadataJSON))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+	args.DryRun = true
+
+	batches, _, err := renderInstanceChanges(client, "i-123456789", args, transitionLaunch)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	plans, err := client.planZoneBatches(batches)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if len(plans) != 1 || plans[0].HostedZoneID != "ABCDEF0123456789" || len(plans[0].Diffs) != 2 {
+		t.Fatalf("Unexpected plan: %#v", plans)
+	}
+	// Both records already exist with the same values in the test zone.
+	for _, d := range plans[0].Diffs {
+		if len(d.Added) != 0 || len(d.Removed) != 0 {
+			t.Fatalf("Expected no value changes, got %s", d)
+		}
+	}
+}
+
+func TestSendRoute53ChangeBatch_liveDiff(t *testing.T) {
+	args, err := parseSNSMetadata([]byte(testMetadataJSON))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+
+	cases := []struct {
+		noDiff   bool
+		expected int
+	}{
+		{false, 2},
+		{true, 0},
+	}
+	for _, tc := range cases {
+		client := testAwsClient()
+		var out bytes.Buffer
+		client.log = newLogger(&out, levelInfo)
+		client.noDiff = tc.noDiff
+		calls := 0
+		client.Route53.Handlers.Send.PushFront(func(r *request.Request) {
+			if r.Operation.Name == "ListResourceRecordSets" {
+				calls++
+			}
+		})
+		if err := client.SendRoute53ChangeBatch(args.HostedZoneID, args.Changes); err != nil {
+			t.Fatalf("Bad: %v", err)
+		}
+		if calls != tc.expected {
+			t.Fatalf("Expected %d ListResourceRecordSets calls with noDiff %t, got %d", tc.expected, tc.noDiff, calls)
+		}
+		if logged := strings.Count(out.String(), "Record diff: "); logged != tc.expected {
+			t.Fatalf("Expected %d diffs to be logged at info with noDiff %t, got %d", tc.expected, tc.noDiff, logged)
+		}
+	}
+}
+
+func TestLoadDiffDisabled(t *testing.T) {
+	defer os.Unsetenv(diffEnvVar)
+
+	cases := map[string]bool{
+		"":      false,
+		"true":  false,
+		"false": true,
+		"0":     true,
+	}
+	for raw, expected := range cases {
+		os.Setenv(diffEnvVar, raw)
+		if disabled, err := loadDiffDisabled(); err != nil || disabled != expected {
+			t.Fatalf("Expected %q to disable diffing: %t, got %t (%v)", raw, expected, disabled, err)
+		}
+	}
+
+	os.Setenv(diffEnvVar, "sometimes")
+	if _, err := loadDiffDisabled(); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+}
+
+func TestRunPlan_usage(t *testing.T) {
+	cases := [][]string{
+		{"-instance-id", "i-123456789"},
+		{"-metadata", "metadata.json"},
+		{"-metadata", "metadata.json", "-instance-id", "i-123456789", "-transition", "reboot"},
+	}
+	for _, args := range cases {
+		if _, ok := runPlan(args).(*usageError); !ok {
+			t.Fatalf("Expected *usageError for %v", args)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// rrSetCache holds the resource record sets looked up by name and type for
+// templates, so that each one is only requested from Route 53 once while an
+// event is being processed.
+type rrSetCache struct {
+	// The record sets, keyed on hosted zone ID, name, and type. Record sets
+	// that do not exist are stored as nil.
+	mu   sync.Mutex
+	sets map[string]*route53.ResourceRecordSet
+}
+
+// newRRSetCache returns an empty rrSetCache.
+func newRRSetCache() *rrSetCache {
+	return &rrSetCache{sets: make(map[string]*route53.ResourceRecordSet)}
+}
+
+// lookupRRSet returns the resource record set with the supplied name and
+// type in zoneID, or nil if it does not exist. Record sets with a
+// SetIdentifier are not matched: a weighted, latency, failover, or
+// geolocation name has one record set per SetIdentifier, so a name and type
+// alone cannot pick one of them. Results are cached in the client's
+// rrSetCache, if it has one.
+func (c *awsClient) lookupRRSet(zoneID, name, rrType string) (*route53.ResourceRecordSet, error) {
+	change := &route53.Change{ResourceRecordSet: &route53.ResourceRecordSet{Name: aws.String(name), Type: aws.String(rrType)}}
+	if c.lookups == nil {
+		return c.findExistingRRSet(zoneID, change)
+	}
+
+	key := zoneID + "|" + rrSetKey(change)
+	c.lookups.mu.Lock()
+	defer c.lookups.mu.Unlock()
+	if rrSet, ok := c.lookups.sets[key]; ok {
+		return rrSet, nil
+	}
+	rrSet, err := c.findExistingRRSet(zoneID, change)
+	if err != nil {
+		return nil, err
+	}
+	c.lookups.sets[key] = rrSet
+	return rrSet, nil
+}
+
+// existingRRSet returns the resource record set with the supplied name and
+// type, from the hosted zone that d is rendering changes for, or the zone
+// inferred from name. nil is returned if the record set does not exist.
+func (d *instanceData) existingRRSet(name, rrType string) (*route53.ResourceRecordSet, error) {
+	zoneID := d.HostedZoneID
+	if d.zoneFor != nil {
+		var err error
+		if zoneID, err = d.zoneFor(name); err != nil {
+			return nil, err
+		}
+	}
+	return d.client.lookupRRSet(zoneID, name, rrType)
+}
+
+// existing is the template function that returns the values of the
+// resource record set with the supplied name and type, as it currently
+// exists in Route 53. An empty list is returned if the record set does not
+// exist.
+func (d *instanceData) existing(name, rrType string) ([]string, error) {
+	rrSet, err := d.existingRRSet(name, rrType)
+	if err != nil || rrSet == nil {
+		return []string{}, err
+	}
+	values := []string{}
+	for _, rr := range rrSet.ResourceRecords {
+		values = append(values, aws.StringValue(rr.Value))
+	}
+	return values, nil
+}
+
+// existingValue is the template function that returns the value at index
+// of the resource record set with the supplied name and type, as it
+// currently exists in Route 53. An error is returned if the record set does
+// not exist, or the index is out of range.
+func (d *instanceData) existingValue(name, rrType string, index int) (string, error) {
+	values, err := d.existing(name, rrType)
+	if err != nil {
+		return "", err
+	}
+	if index < 0 || index >= len(values) {
+		return "", fmt.Errorf("Value index %d out of range for %s %s, which has %d values", index, name, rrType, len(values))
+	}
+	return values[index], nil
+}
+
+// existingTTL is the template function that returns the TTL of the resource
+// record set with the supplied name and type, as it currently exists in
+// Route 53. It can be used in values, such as TXT records, and in
+// comparisons. An error is returned if the record set does not exist.
+func (d *instanceData) existingTTL(name, rrType string) (int64, error) {
+	rrSet, err := d.existingRRSet(name, rrType)
+	if err != nil {
+		return 0, err
+	}
+	if rrSet == nil {
+		return 0, fmt.Errorf("Resource record set %s %s not found", name, rrType)
+	}
+	return aws.Int64Value(rrSet.TTL), nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// testExistingData returns instanceData for the test instance in the test
+// zone, with a client that caches lookups. The returned counter is
+// incremented on every ListResourceRecordSets call.
+func testExistingData(t *testing.T, batch []*route53.Change) (*instanceData, *int) {
+	client := testAwsClient().forEvent("", "i-123456789", "")
+	calls := 0
+	client.Route53.Handlers.Send.PushFront(func(r *request.Request) {
+		if r.Operation.Name == "ListResourceRecordSets" {
+			calls++
+		}
+	})
+	data, err := populate(client, "i-123456789", "ABCDEF0123456789", batch)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	return data, &calls
+}
+
+func TestExistingTemplateFuncs(t *testing.T) {
+	batch := []*route53.Change{
+		{
+			Action: aws.String("UPSERT"),
+			ResourceRecordSet: &route53.ResourceRecordSet{
+				Name: aws.String("www.example.com."),
+				Type: aws.String("CNAME"),
+				TTL:  aws.Int64(60),
+				ResourceRecords: []*route53.ResourceRecord{
+					{Value: aws.String(`{{existingValue "www.example.com" "CNAME" 0}}`)},
+					{Value: aws.String(`{{range existing "i-123456789.example.com." "A"}}{{.}}{{end}}`)},
+					{Value: aws.String(`{{index (existing "www.example.com." "CNAME") 0}}`)},
+					{Value: aws.String(`{{len (existing "missing.example.com." "A")}}`)},
+					{Value: aws.String(`"ttl={{existingTTL "www.example.com." "CNAME"}}"`)},
+				},
+			},
+		},
+	}
+	data, calls := testExistingData(t, batch)
+	if err := data.WriteTemplateFields(); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	expected := []string{"i-123456789.example.com.", "54.0.0.1", "i-123456789.example.com.", "0", `"ttl=3600"`}
+	for n, rr := range batch[0].ResourceRecordSet.ResourceRecords {
+		if *rr.Value != expected[n] {
+			t.Fatalf("Expected value #%d to be %s, got %s", n, expected[n], *rr.Value)
+		}
+	}
+	if *calls != 3 {
+		t.Fatalf("Expected lookups to be cached, got %d ListResourceRecordSets calls", *calls)
+	}
+}
+
+func TestExistingTemplateFuncs_errors(t *testing.T) {
+	data, _ := testExistingData(t, nil)
+	if _, err := data.existingValue("www.example.com.", "CNAME", 1); err == nil || !strings.Contains(err.Error(), "out of range") {
+		t.Fatalf("Expected out of range error, got %v", err)
+	}
+	if _, err := data.existingValue("missing.example.com.", "A", 0); err == nil {
+		t.Fatal("Expected error for missing record set, got none")
+	}
+	if _, err := data.existingTTL("missing.example.com.", "A"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+
+	data.HostedZoneID = "bad"
+	if _, err := data.existing("www.example.com.", "CNAME"); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+}
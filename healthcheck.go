@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// healthCheckRefPrefix is the prefix for the caller references of health
+// checks created by asg53.
+const healthCheckRefPrefix = "asg53-"
+
+// healthCheckTagKey is the EC2 instance tag that holds the ID of the health
+// check created for the instance on launch, so that it can be found on
+// termination.
+const healthCheckTagKey = "asg53:health-check-id"
+
+// maxHealthCheckAttempts is the number of caller references that are tried
+// for a launch before giving up. See healthCheckCallerReference.
+const maxHealthCheckAttempts = 10
+
+// healthCheckGeneration returns the launch generation of the supplied
+// instance, used in the caller reference of its health check. This is the
+// instance's launch time, which is the same for every event about the same
+// launch, and changes when a stopped instance is started again.
+func healthCheckGeneration(instance *ec2.Instance) string {
+	if instance.LaunchTime == nil {
+		return "0"
+	}
+	return strconv.FormatInt(instance.LaunchTime.Unix(), 36)
+}
+
+// healthCheckCallerReference returns the caller reference for the health
+// check of the supplied instance ID, launch generation and configuration.
+// The reference is made up of the instance ID, a hash of the rendered
+// configuration, and the generation, so that concurrent and retried events
+// for the same launch create the same health check.
+//
+// Route 53 does not allow the caller reference of a deleted health check to
+// be used again, so a launch that is retried after its health check was
+// deleted moves on to the next attempt, which is appended to the reference.
+func healthCheckCallerReference(instanceID, generation string, config *route53.HealthCheckConfig, attempt int) (string, error) {
+	raw, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	ref := healthCheckRefPrefix + instanceID + "-" + hex.EncodeToString(sum[:8]) + "-" + generation
+	if attempt > 0 {
+		ref += "-" + strconv.Itoa(attempt)
+	}
+	return ref, nil
+}
+
+// callerReferenceUsedError is returned by CreateRoute53HealthCheck when the
+// caller reference belongs to a health check with a different configuration,
+// or one that has been deleted.
+type callerReferenceUsedError struct {
+	ref string
+}
+
+func (e *callerReferenceUsedError) Error() string {
+	return fmt.Sprintf("Error creating health check: caller reference %s has already been used", e.ref)
+}
+
+// healthCheckAction is a health check that has been created or found for an
+// instance, and needs to be cleaned up once the changes for the instance
+// have been sent.
+type healthCheckAction struct {
+	// The client the health check is managed with.
+	client *awsClient
+
+	// The health check ID.
+	ID string
+
+	// true if the health check was created for a launch transition, and
+	// needs to be deleted if the changes fail.
+	created bool
+
+	// true if the event is a dry run, so the health check must be left alone.
+	// On launch, ID is dryRunHealthCheckID, which does not exist.
+	dryRun bool
+}
+
+// renderHealthCheckConfig renders the template fields in config (IPAddress,
+// FullyQualifiedDomainName, ResourcePath, and SearchString) with the data
+// for the supplied instance ID. config is updated in place.
+func renderHealthCheckConfig(client *awsClient, instanceID string, config *route53.HealthCheckConfig) error {
+	data, err := populate(client, instanceID, "", nil)
+	if err != nil {
+		return err
+	}
+
+	fields := map[string]**string{
+		"IPAddress":                &config.IPAddress,
+		"FullyQualifiedDomainName": &config.FullyQualifiedDomainName,
+		"ResourcePath":             &config.ResourcePath,
+		"SearchString":             &config.SearchString,
+	}
+	for name, field := range fields {
+		if *field == nil {
+			continue
+		}
+		rendered, err := data.render("HealthCheck ."+name, **field)
+		if err != nil {
+			return err
+		}
+		*field = aws.String(rendered)
+	}
+	return nil
+}
+
+// CreateRoute53HealthCheck creates a health check with the supplied caller
+// reference and configuration, and returns its ID. If a health check with
+// the same caller reference and configuration already exists, its ID is
+// returned instead. If the caller reference cannot be used, a
+// *callerReferenceUsedError is returned.
+func (c *awsClient) CreateRoute53HealthCheck(ref string, config *route53.HealthCheckConfig) (string, error) {
+	c.logger().Infof("Creating health check with caller reference: %s", ref)
+	params := &route53.CreateHealthCheckInput{
+		CallerReference:   aws.String(ref),
+		HealthCheckConfig: config,
+	}
+
+	var resp *route53.CreateHealthCheckOutput
+	err := c.retrier().Do("CreateHealthCheck", func() error {
+		var err error
+		resp, err = c.Route53.CreateHealthCheck(params)
+		return err
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "HealthCheckAlreadyExists" {
+		return "", &callerReferenceUsedError{ref: ref}
+	}
+	if err != nil {
+		return "", fmt.Errorf("Error creating health check: %v", err)
+	}
+
+	c.logger().Infof("Health check ID: %s", *resp.HealthCheck.Id)
+	return *resp.HealthCheck.Id, nil
+}
+
+// createInstanceHealthCheck creates the health check for the supplied
+// instance with healthCheckCallerReference, or returns the ID of the one
+// created by an earlier or concurrent event for the same launch. Attempts
+// whose caller reference has already been used are skipped.
+func (c *awsClient) createInstanceHealthCheck(instance *ec2.Instance, config *route53.HealthCheckConfig) (string, error) {
+	for attempt := 0; attempt < maxHealthCheckAttempts; attempt++ {
+		ref, err := healthCheckCallerReference(*instance.InstanceId, healthCheckGeneration(instance), config, attempt)
+		if err != nil {
+			return "", err
+		}
+		id, err := c.CreateRoute53HealthCheck(ref, config)
+		if _, used := err.(*callerReferenceUsedError); used {
+			c.logger().Warnf("%v - trying the next caller reference", err)
+			continue
+		}
+		return id, err
+	}
+	return "", fmt.Errorf("Error creating health check: all %d caller references for instance %s have been used", maxHealthCheckAttempts, *instance.InstanceId)
+}
+
+// DeleteRoute53HealthCheck deletes the supplied health check. Health checks
+// that no longer exist are ignored.
+func (c *awsClient) DeleteRoute53HealthCheck(id string) error {
+	c.logger().Infof("Deleting health check ID: %s", id)
+	params := &route53.DeleteHealthCheckInput{
+		HealthCheckId: aws.String(id),
+	}
+
+	err := c.retrier().Do("DeleteHealthCheck", func() error {
+		_, err := c.Route53.DeleteHealthCheck(params)
+		return err
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "NoSuchHealthCheck" {
+		c.logger().Warnf("Health check ID %s does not exist", id)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error deleting health check: %v", err)
+	}
+	return nil
+}
+
+// prepareHealthCheck gets the health check for the instance ready before its
+// changes are rendered, if args has a HealthCheck. On launch, the health
+// check is created with createInstanceHealthCheck, and its ID is saved in the
+// healthCheckTagKey tag on the instance. On termination, the health check is
+// looked up through the tag, so that DELETE changes can reference it.
+//
+// nil is returned if args does not have a health check, or if the instance
+// does not have a health check tag on termination.
+func prepareHealthCheck(client *awsClient, instanceID string, args messageArgs, transition string) (*healthCheckAction, error) {
+	if args.HealthCheck == nil {
+		return nil, nil
+	}
+
+	hcClient, err := client.forRole(args.RoleARN, args.ExternalID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch transition {
+	case transitionLaunch:
+		if err := renderHealthCheckConfig(hcClient, instanceID, args.HealthCheck); err != nil {
+			return nil, fmt.Errorf("Error rendering health check: %v", err)
+		}
+		if args.DryRun {
+			return &healthCheckAction{client: hcClient, ID: dryRunHealthCheckID, dryRun: true}, nil
+		}
+		instance, err := client.FetchEC2InstanceData(instanceID)
+		if err != nil {
+			return nil, err
+		}
+		id, err := hcClient.createInstanceHealthCheck(instance, args.HealthCheck)
+		if err != nil {
+			return nil, err
+		}
+		hc := &healthCheckAction{client: hcClient, ID: id, created: true}
+		if err := client.TagEC2Instance(instanceID, healthCheckTagKey, id); err != nil {
+			if hcErr := hc.finish(err); hcErr != nil {
+				client.logger().Errorf("Error cleaning up health check: %v", hcErr)
+			}
+			return nil, err
+		}
+		return hc, nil
+	case transitionTerminate:
+		instance, err := client.FetchEC2InstanceData(instanceID)
+		if err != nil {
+			return nil, err
+		}
+		id := instanceTag(instance, healthCheckTagKey)
+		if id == "" {
+			return nil, nil
+		}
+		return &healthCheckAction{client: hcClient, ID: id, dryRun: args.DryRun}, nil
+	}
+	return nil, nil
+}
+
+// healthCheckID returns the ID of the health check, or an empty string if
+// a is nil.
+func (a *healthCheckAction) healthCheckID() string {
+	if a == nil {
+		return ""
+	}
+	return a.ID
+}
+
+// finish cleans up the health check once the changes for the instance have
+// been sent, or have failed with err. A health check found on termination is
+// deleted after its records have been removed. A health check created on
+// launch is deleted if the changes failed, as the instance will not be put
+// in service. a can be nil, in which case nothing is done. Nothing is done
+// in a dry run either.
+func (a *healthCheckAction) finish(err error) error {
+	if a == nil || a.dryRun {
+		return nil
+	}
+	if a.created && err == nil {
+		return nil
+	}
+	if !a.created && err != nil {
+		// The records that reference the health check might still exist, so
+		// it cannot be deleted yet.
+		return nil
+	}
+	return a.client.DeleteRoute53HealthCheck(a.ID)
+}
+
+// renderInstanceChanges prepares the health check for the instance with
+// prepareHealthCheck, and renders the change batches for every hosted zone
+// in args with renderZoneBatches. The health check ID is available to the
+// change batch templates through {{.HealthCheckID}}.
+//
+// If rendering fails, a health check created for a launch is deleted.
+func renderInstanceChanges(client *awsClient, instanceID string, args messageArgs, transition string) ([]zoneBatch, *healthCheckAction, error) {
+	hc, err := prepareHealthCheck(client, instanceID, args, transition)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	batches, err := renderZoneBatches(client, instanceID, args, transition, hc.healthCheckID())
+	if err != nil {
+		if err := hc.finish(err); err != nil {
+			client.logger().Errorf("Error cleaning up health check: %v", err)
+		}
+		return nil, nil, err
+	}
+	return batches, hc, nil
+}
+
+// applyInstanceChanges checks the change batches for an instance against
+// the change policy and sends them with applyZoneBatches, then cleans up the
+// health check, if any, with finish. Nothing is sent if any change violates
+// the policy.
+func (c *awsClient) applyInstanceChanges(batches []zoneBatch, hc *healthCheckAction) error {
+	err := c.checkPolicy(batches)
+	if err == nil && len(batches) > 0 {
+		err = c.applyZoneBatches(batches)
+	}
+	if hcErr := hc.finish(err); hcErr != nil {
+		if err != nil {
+			return fmt.Errorf("%v; additionally, %v", err, hcErr)
+		}
+		return hcErr
+	}
+	return err
+}
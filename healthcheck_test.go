@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/paybyphone/asg53/teststubs"
+)
+
+// testHealthCheckMetadataJSON is a test SNS message in JSON form, with a
+// health check referenced by a weighted record.
+const testHealthCheckMetadataJSON = `
+{
+  "HostedZoneID": "%s",
+  "HealthCheck": {
+    "Type": "HTTP",
+    "IPAddress": "{{.InstancePublicIPAddress}}",
+    "Port": 80,
+    "ResourcePath": "/health/{{.InstanceID}}"
+  },
+  "Changes": [
+    {
+      "Action": "UPSERT",
+      "ResourceRecordSet": {
+        "Name": "www.example.com.",
+        "TTL": 60,
+        "Type": "A",
+        "SetIdentifier": "{{.InstanceID}}",
+        "Weight": 10,
+        "HealthCheckId": "{{.HealthCheckID}}",
+        "ResourceRecords": [
+          {
+            "Value": "{{.InstancePublicIPAddress}}"
+          }
+        ]
+      }
+    }
+  ]
+}
+`
+
+// testHealthCheckMetadata returns the health check test metadata for the
+// supplied zone ID.
+func testHealthCheckMetadata(zoneID string) messageArgs {
+	metadata, err := parseSNSMetadata([]byte(fmt.Sprintf(testHealthCheckMetadataJSON, zoneID)))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+	return metadata
+}
+
+func TestHealthCheckCallerReference(t *testing.T) {
+	config := &route53.HealthCheckConfig{Type: aws.String("TCP"), IPAddress: aws.String("54.0.0.1"), Port: aws.Int64(80)}
+	ref, err := healthCheckCallerReference("i-0123456789abcdef0", "ogdd40", config, 0)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if !strings.HasPrefix(ref, "asg53-i-0123456789abcdef0-") || !strings.HasSuffix(ref, "-ogdd40") || len(ref) > 64 {
+		t.Fatalf("Unexpected caller reference %q", ref)
+	}
+	if again, _ := healthCheckCallerReference("i-0123456789abcdef0", "ogdd40", config, 0); again != ref {
+		t.Fatalf("Expected the same caller reference each time, got %q and %q", ref, again)
+	}
+
+	if next, _ := healthCheckCallerReference("i-0123456789abcdef0", "ogdd40", config, 1); next != ref+"-1" {
+		t.Fatalf("Expected caller reference for the next attempt to be %q, got %q", ref+"-1", next)
+	}
+	if relaunched, _ := healthCheckCallerReference("i-0123456789abcdef0", "ogdd41", config, 0); relaunched == ref {
+		t.Fatal("Expected caller reference to change with the generation")
+	}
+	config.Port = aws.Int64(443)
+	if changed, _ := healthCheckCallerReference("i-0123456789abcdef0", "ogdd40", config, 0); changed == ref {
+		t.Fatal("Expected caller reference to change with the configuration")
+	}
+}
+
+func TestHealthCheckLifecycle(t *testing.T) {
+	defer teststubs.ResetRoute53HealthChecks()
+	defer teststubs.ResetEC2InstanceTags()
+	teststubs.ResetRoute53HealthChecks()
+	teststubs.ResetEC2InstanceTags()
+	client := testAwsClient()
+
+	// A health check for another instance, which must be left alone.
+	if _, err := client.CreateRoute53HealthCheck("asg53-i-987654321-0", &route53.HealthCheckConfig{Type: aws.String("TCP")}); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	batches, hc, err := renderInstanceChanges(client, "i-123456789", testHealthCheckMetadata("ABCDEF0123456789"), transitionLaunch)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	checks := teststubs.Route53HealthChecks()[1:]
+	if len(checks) != 1 {
+		t.Fatalf("Expected 1 new health check, got %d", len(checks))
+	}
+	if *checks[0].HealthCheckConfig.IPAddress != "54.0.0.1" || *checks[0].HealthCheckConfig.ResourcePath != "/health/i-123456789" {
+		t.Fatalf("Health check config not rendered: %v", checks[0].HealthCheckConfig)
+	}
+	if *batches[0].Changes[0].ResourceRecordSet.HealthCheckId != *checks[0].Id {
+		t.Fatalf("Expected HealthCheckId to be %s, got %s", *checks[0].Id, *batches[0].Changes[0].ResourceRecordSet.HealthCheckId)
+	}
+	if err := client.applyInstanceChanges(batches, hc); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	// A retried launch re-uses the health check.
+	if _, _, err := renderInstanceChanges(client, "i-123456789", testHealthCheckMetadata("ABCDEF0123456789"), transitionLaunch); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if len(teststubs.Route53HealthChecks()) != 2 {
+		t.Fatalf("Expected health check to be re-used, got %d", len(teststubs.Route53HealthChecks()))
+	}
+
+	batches, hc, err = renderInstanceChanges(client, "i-123456789", testHealthCheckMetadata("ABCDEF0123456789"), transitionTerminate)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if *batches[0].Changes[0].ResourceRecordSet.HealthCheckId != *checks[0].Id {
+		t.Fatalf("Expected HealthCheckId to be %s on termination, got %s", *checks[0].Id, *batches[0].Changes[0].ResourceRecordSet.HealthCheckId)
+	}
+	if err := client.applyInstanceChanges(batches, hc); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if remaining := teststubs.Route53HealthChecks(); len(remaining) != 1 || *remaining[0].CallerReference != "asg53-i-987654321-0" {
+		t.Fatal("Expected only the instance's health check to be deleted on termination")
+	}
+}
+
+func TestHealthCheckLifecycle_launchFailure(t *testing.T) {
+	defer teststubs.ResetRoute53HealthChecks()
+	defer teststubs.ResetEC2InstanceTags()
+	teststubs.ResetRoute53HealthChecks()
+	teststubs.ResetEC2InstanceTags()
+	client := testAwsClient()
+
+	batches, hc, err := renderInstanceChanges(client, "i-123456789", testHealthCheckMetadata("bad"), transitionLaunch)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if err := client.applyInstanceChanges(batches, hc); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+	if len(teststubs.Route53HealthChecks()) != 0 {
+		t.Fatal("Expected health check to be deleted after failed launch")
+	}
+}
+
+func TestHealthCheckLifecycle_terminateWithout(t *testing.T) {
+	defer teststubs.ResetRoute53HealthChecks()
+	defer teststubs.ResetEC2InstanceTags()
+	teststubs.ResetRoute53HealthChecks()
+	teststubs.ResetEC2InstanceTags()
+
+	hc, err := prepareHealthCheck(testAwsClient(), "i-123456789", testHealthCheckMetadata("ABCDEF0123456789"), transitionTerminate)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if hc != nil {
+		t.Fatalf("Expected no health check, got %#v", hc)
+	}
+}
+
+func TestHealthCheckLifecycle_retryAfterFailure(t *testing.T) {
+	defer teststubs.ResetRoute53HealthChecks()
+	defer teststubs.ResetEC2InstanceTags()
+	teststubs.ResetRoute53HealthChecks()
+	teststubs.ResetEC2InstanceTags()
+	client := testAwsClient()
+
+	batches, hc, err := renderInstanceChanges(client, "i-123456789", testHealthCheckMetadata("bad"), transitionLaunch)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if err := client.applyInstanceChanges(batches, hc); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+
+	// The retry creates a new health check, as the caller reference of the
+	// deleted one cannot be used again.
+	args := testHealthCheckMetadata("ABCDEF0123456789")
+	batches, hc, err = renderInstanceChanges(client, "i-123456789", args, transitionLaunch)
+	if err != nil {
+		t.Fatalf("Expected retry to succeed, got %v", err)
+	}
+	if err := client.applyInstanceChanges(batches, hc); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	checks := teststubs.Route53HealthChecks()
+	if len(checks) != 1 || *checks[0].Id != hc.ID {
+		t.Fatalf("Expected 1 health check from the retry, got %d", len(checks))
+	}
+	if !strings.HasSuffix(*checks[0].CallerReference, "-1") {
+		t.Fatalf("Expected the retry to use the next caller reference, got %s", *checks[0].CallerReference)
+	}
+}
+
+func TestHealthCheckLifecycle_concurrentLaunches(t *testing.T) {
+	defer teststubs.ResetRoute53HealthChecks()
+	defer teststubs.ResetEC2InstanceTags()
+	teststubs.ResetRoute53HealthChecks()
+	teststubs.ResetEC2InstanceTags()
+	client := testAwsClient()
+
+	var wg sync.WaitGroup
+	ids := make([]string, 2)
+	errs := make([]error, 2)
+	for n := range ids {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			var hc *healthCheckAction
+			hc, errs[n] = prepareHealthCheck(client, "i-123456789", testHealthCheckMetadata("ABCDEF0123456789"), transitionLaunch)
+			ids[n] = hc.healthCheckID()
+		}(n)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("Bad: %v", err)
+		}
+	}
+	if checks := teststubs.Route53HealthChecks(); len(checks) != 1 || ids[0] != ids[1] {
+		t.Fatalf("Expected concurrent launches to share 1 health check, got %d (%s and %s)", len(checks), ids[0], ids[1])
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// hostedZoneIDPrefix is the prefix Route 53 adds to hosted zone IDs returned
+// from the API, which is not accepted by most other calls.
+const hostedZoneIDPrefix = "/hostedzone/"
+
+// normalizeZoneName lower-cases name and makes sure that it is fully
+// qualified, so that it can be compared with the names that Route 53 returns.
+func normalizeZoneName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// zoneNameMatches returns true if recordName is zoneName, or is a subdomain
+// of it. Both names need to be normalized with normalizeZoneName.
+func zoneNameMatches(recordName, zoneName string) bool {
+	return recordName == zoneName || strings.HasSuffix(recordName, "."+zoneName)
+}
+
+// hostedZoneResolver resolves hosted zones by name, with optional hints for
+// picking between public and private zones that share the same name. Lookups
+// are cached for the life of the resolver, which should be a single
+// invocation, so that zones that are re-created are picked up on the next
+// event.
+type hostedZoneResolver struct {
+	// An AWS client instance.
+	client *awsClient
+
+	// The hosted zones found by name.
+	byName map[string][]*route53.HostedZone
+
+	// All of the hosted zones in the account, used for inferring zones from
+	// record names. nil until loaded.
+	all []*route53.HostedZone
+
+	// The VPCs associated with private hosted zones, by zone ID.
+	vpcs map[string][]*route53.VPC
+}
+
+// newHostedZoneResolver returns a hostedZoneResolver with an empty cache.
+func newHostedZoneResolver(client *awsClient) *hostedZoneResolver {
+	return &hostedZoneResolver{
+		client: client,
+		byName: make(map[string][]*route53.HostedZone),
+		vpcs:   make(map[string][]*route53.VPC),
+	}
+}
+
+// listHostedZones pages through ListHostedZonesByName, starting at the
+// supplied name (or the start of the list if it is empty), for as long as
+// more returns true for the last zone in each page.
+func (r *hostedZoneResolver) listHostedZones(name string, more func(zone *route53.HostedZone) bool) ([]*route53.HostedZone, error) {
+	params := &route53.ListHostedZonesByNameInput{}
+	if name != "" {
+		params.DNSName = aws.String(name)
+	}
+
+	zones := []*route53.HostedZone{}
+	for {
+		var resp *route53.ListHostedZonesByNameOutput
+		err := r.client.retrier().Do("ListHostedZonesByName", func() error {
+			var err error
+			resp, err = r.client.Route53.ListHostedZonesByName(params)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error listing hosted zones: %v", err)
+		}
+
+		zones = append(zones, resp.HostedZones...)
+		if !aws.BoolValue(resp.IsTruncated) || len(resp.HostedZones) < 1 || !more(resp.HostedZones[len(resp.HostedZones)-1]) {
+			return zones, nil
+		}
+		params.DNSName = resp.NextDNSName
+		params.HostedZoneId = resp.NextHostedZoneId
+	}
+}
+
+// zonesNamed returns the hosted zones with the supplied name.
+func (r *hostedZoneResolver) zonesNamed(name string) ([]*route53.HostedZone, error) {
+	name = normalizeZoneName(name)
+	if zones, ok := r.byName[name]; ok {
+		return zones, nil
+	}
+
+	r.client.logger().Infof("Looking up hosted zones named %s", name)
+	listed, err := r.listHostedZones(name, func(zone *route53.HostedZone) bool {
+		return normalizeZoneName(aws.StringValue(zone.Name)) == name
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	zones := []*route53.HostedZone{}
+	for _, zone := range listed {
+		if normalizeZoneName(aws.StringValue(zone.Name)) == name {
+			zones = append(zones, zone)
+		}
+	}
+	r.byName[name] = zones
+	return zones, nil
+}
+
+// allZones returns all of the hosted zones in the account.
+func (r *hostedZoneResolver) allZones() ([]*route53.HostedZone, error) {
+	if r.all != nil {
+		return r.all, nil
+	}
+
+	r.client.logger().Infof("Listing all hosted zones")
+	zones, err := r.listHostedZones("", func(*route53.HostedZone) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+	r.all = zones
+	return zones, nil
+}
+
+// zoneVPCs returns the VPCs associated with the supplied hosted zone.
+func (r *hostedZoneResolver) zoneVPCs(zoneID string) ([]*route53.VPC, error) {
+	if vpcs, ok := r.vpcs[zoneID]; ok {
+		return vpcs, nil
+	}
+
+	r.client.logger().With("zone_id", zoneID).Infof("Fetching VPC associations for zone ID: %s", zoneID)
+	var resp *route53.GetHostedZoneOutput
+	err := r.client.retrier().Do("GetHostedZone", func() error {
+		var err error
+		resp, err = r.client.Route53.GetHostedZone(&route53.GetHostedZoneInput{Id: aws.String(zoneID)})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching hosted zone %s: %v", zoneID, err)
+	}
+	r.vpcs[zoneID] = resp.VPCs
+	return resp.VPCs, nil
+}
+
+// filter returns the zones in zones that match the PrivateZone, VPCID, and
+// VPCRegion hints in args. Supplying a VPC ID implies a private zone.
+func (r *hostedZoneResolver) filter(zones []*route53.HostedZone, args zoneArgs) ([]*route53.HostedZone, error) {
+	matched := []*route53.HostedZone{}
+	for _, zone := range zones {
+		private := zone.Config != nil && aws.BoolValue(zone.Config.PrivateZone)
+		if args.PrivateZone != nil && *args.PrivateZone != private {
+			continue
+		}
+		if args.VPCID != "" {
+			if !private {
+				continue
+			}
+			vpcs, err := r.zoneVPCs(trimHostedZoneID(aws.StringValue(zone.Id)))
+			if err != nil {
+				return nil, err
+			}
+			if !vpcsContain(vpcs, args.VPCID, args.VPCRegion) {
+				continue
+			}
+		}
+		matched = append(matched, zone)
+	}
+	return matched, nil
+}
+
+// vpcsContain returns true if vpcs contains the supplied VPC ID. If region is
+// not empty, the VPC also needs to be in that region.
+func vpcsContain(vpcs []*route53.VPC, vpcID, region string) bool {
+	for _, vpc := range vpcs {
+		if aws.StringValue(vpc.VPCId) == vpcID && (region == "" || aws.StringValue(vpc.VPCRegion) == region) {
+			return true
+		}
+	}
+	return false
+}
+
+// trimHostedZoneID removes the /hostedzone/ prefix from a hosted zone ID.
+func trimHostedZoneID(id string) string {
+	return strings.TrimPrefix(id, hostedZoneIDPrefix)
+}
+
+// pickZone returns the ID of the only zone in zones. An error that mentions
+// what is being resolved is returned if there are no zones, or more than
+// one.
+func pickZone(zones []*route53.HostedZone, what string) (string, error) {
+	switch len(zones) {
+	case 0:
+		return "", fmt.Errorf("No hosted zone found for %s", what)
+	case 1:
+		return trimHostedZoneID(aws.StringValue(zones[0].Id)), nil
+	}
+	ids := []string{}
+	for _, zone := range zones {
+		ids = append(ids, trimHostedZoneID(aws.StringValue(zone.Id)))
+	}
+	return "", fmt.Errorf("Multiple hosted zones found for %s (%s), use PrivateZone or VPCID to pick one", what, strings.Join(ids, ", "))
+}
+
+// resolve returns the hosted zone ID for args. HostedZoneID is returned as-is
+// if it is set, otherwise the zone is looked up by HostedZoneName, narrowed
+// down by the PrivateZone and VPC hints.
+func (r *hostedZoneResolver) resolve(args zoneArgs) (string, error) {
+	if args.HostedZoneID != "" {
+		return args.HostedZoneID, nil
+	}
+	if args.HostedZoneName == "" {
+		return "", fmt.Errorf("One of HostedZoneID, HostedZoneName, or InferHostedZone is required")
+	}
+
+	zones, err := r.zonesNamed(args.HostedZoneName)
+	if err != nil {
+		return "", err
+	}
+	zones, err = r.filter(zones, args)
+	if err != nil {
+		return "", err
+	}
+	zoneID, err := pickZone(zones, args.HostedZoneName)
+	if err != nil {
+		return "", err
+	}
+	r.client.logger().With("zone_id", zoneID).Infof("Resolved hosted zone %s to zone ID: %s", args.HostedZoneName, zoneID)
+	return zoneID, nil
+}
+
+// infer returns the ID of the hosted zone that a record name belongs to -
+// the zone with the longest name that the record name is a part of, narrowed
+// down by the PrivateZone and VPC hints in args.
+//
+// Only the domain part of the name needs to be rendered, so this can also be
+// used with unrendered template names, such as
+// "{{.InstanceID}}.example.com.".
+func (r *hostedZoneResolver) infer(recordName string, args zoneArgs) (string, error) {
+	all, err := r.allZones()
+	if err != nil {
+		return "", err
+	}
+
+	recordName = normalizeZoneName(recordName)
+	candidates := []*route53.HostedZone{}
+	for _, zone := range all {
+		if zoneNameMatches(recordName, normalizeZoneName(aws.StringValue(zone.Name))) {
+			candidates = append(candidates, zone)
+		}
+	}
+	candidates, err = r.filter(candidates, args)
+	if err != nil {
+		return "", err
+	}
+
+	longest := []*route53.HostedZone{}
+	for _, zone := range candidates {
+		switch {
+		case len(longest) < 1 || len(*zone.Name) > len(*longest[0].Name):
+			longest = []*route53.HostedZone{zone}
+		case len(*zone.Name) == len(*longest[0].Name):
+			longest = append(longest, zone)
+		}
+	}
+	return pickZone(longest, recordName)
+}
+
+// renderInferredBatches renders the change batch for the supplied lifecycle
+// transition from args, and groups the rendered changes into batches by the
+// hosted zone inferred from each record name. If the batch needs to be
+// inverted, each group is inverted after grouping. Alias targets are
+// completed for each group with completeAliasTargets.
+//
+// ExistingRDataValue looks up records in the zone inferred from the record
+// name. {{.HostedZoneID}} renders as an empty string, as there may be more
+// than one zone.
+func renderInferredBatches(client *awsClient, resolver *hostedZoneResolver, instanceID string, args zoneArgs, transition, healthCheckID string) ([]zoneBatch, error) {
+	changes, invert := args.changesFor(transition)
+
+	data, err := populate(client, instanceID, "", changes)
+	if err != nil {
+		client.logger().Errorf("Error fetching instance information: %v", err)
+		return nil, err
+	}
+	data.HealthCheckID = healthCheckID
+	data.zoneFor = func(name string) (string, error) {
+		return resolver.infer(name, args)
+	}
+
+	if err := data.WriteTemplateFields(); err != nil {
+		client.logger().Errorf("Error writing template values: %v", err)
+		return nil, err
+	}
+
+	batches := []zoneBatch{}
+	index := make(map[string]int)
+	for _, change := range changes {
+		zoneID, err := resolver.infer(aws.StringValue(change.ResourceRecordSet.Name), args)
+		if err != nil {
+			return nil, err
+		}
+		n, ok := index[zoneID]
+		if !ok {
+			n = len(batches)
+			index[zoneID] = n
+			batches = append(batches, zoneBatch{ZoneID: zoneID, client: client})
+		}
+		batches[n].Changes = append(batches[n].Changes, change)
+	}
+
+	for n, batch := range batches {
+		if invert {
+			batches[n].Changes, err = client.inverseChanges(batch.ZoneID, batch.Changes, args.Inverse)
+			if err != nil {
+				client.logger().Errorf("Error inverting launch changes: %v", err)
+				return nil, err
+			}
+		}
+		if err := client.completeAliasTargets(batch.ZoneID, batches[n].Changes); err != nil {
+			client.logger().Errorf("Error completing alias targets: %v", err)
+			return nil, err
+		}
+	}
+
+	return batches, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// testInferredMetadataJSON is a test SNS message in JSON form, with the
+// hosted zone inferred from each record name.
+const testInferredMetadataJSON = `
+{
+  "InferHostedZone": true,
+  "PrivateZone": true,
+  "Changes": [
+    {
+      "Action": "UPSERT",
+      "ResourceRecordSet": {
+        "Name": "{{.InstanceID}}.internal.example.com.",
+        "TTL": 3600,
+        "Type": "A",
+        "ResourceRecords": [
+          {
+            "Value": "{{.InstancePrivateIPAddress}}"
+          }
+        ]
+      }
+    },
+    {
+      "Action": "UPSERT",
+      "ResourceRecordSet": {
+        "Name": "{{.InstanceID}}.example.com.",
+        "TTL": 3600,
+        "Type": "A",
+        "ResourceRecords": [
+          {
+            "Value": "{{.InstancePrivateIPAddress}}"
+          }
+        ]
+      }
+    }
+  ]
+}
+`
+
+func TestHostedZoneResolverResolve(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Args     zoneArgs
+		Expected string
+		Err      bool
+	}{
+		{"ID", zoneArgs{HostedZoneID: "ZONEID"}, "ZONEID", false},
+		{"public", zoneArgs{HostedZoneName: "example.com", PrivateZone: aws.Bool(false)}, "ABCDEF0123456789", false},
+		{"private", zoneArgs{HostedZoneName: "example.com.", PrivateZone: aws.Bool(true)}, "9876543210FEDCBA", false},
+		{"VPC", zoneArgs{HostedZoneName: "Example.com.", VPCID: "vpc-123456", VPCRegion: "us-west-2"}, "9876543210FEDCBA", false},
+		{"unique", zoneArgs{HostedZoneName: "internal.example.com."}, "0123456789ABCDEF", false},
+		{"ambiguous", zoneArgs{HostedZoneName: "example.com."}, "", true},
+		{"wrong region", zoneArgs{HostedZoneName: "example.com.", VPCID: "vpc-123456", VPCRegion: "us-east-1"}, "", true},
+		{"missing", zoneArgs{HostedZoneName: "example.org."}, "", true},
+		{"none", zoneArgs{}, "", true},
+	}
+
+	resolver := newHostedZoneResolver(testAwsClient())
+	for _, c := range cases {
+		actual, err := resolver.resolve(c.Args)
+		if c.Err != (err != nil) {
+			t.Fatalf("%s: expected error to be %t, got %v", c.Name, c.Err, err)
+		}
+		if actual != c.Expected {
+			t.Fatalf("%s: expected %q, got %q", c.Name, c.Expected, actual)
+		}
+	}
+}
+
+func TestHostedZoneResolverInfer(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Record   string
+		Args     zoneArgs
+		Expected string
+		Err      bool
+	}{
+		{"longest", "a.internal.example.com.", zoneArgs{}, "0123456789ABCDEF", false},
+		{"template", "{{.InstanceID}}.internal.example.com.", zoneArgs{}, "0123456789ABCDEF", false},
+		{"public", "www.example.com.", zoneArgs{PrivateZone: aws.Bool(false)}, "ABCDEF0123456789", false},
+		{"public fallback", "a.internal.example.com.", zoneArgs{PrivateZone: aws.Bool(false)}, "ABCDEF0123456789", false},
+		{"apex", "example.com.", zoneArgs{PrivateZone: aws.Bool(true)}, "9876543210FEDCBA", false},
+		{"ambiguous", "www.example.com.", zoneArgs{}, "", true},
+		{"label boundary", "www.notexample.com.", zoneArgs{}, "", true},
+	}
+
+	resolver := newHostedZoneResolver(testAwsClient())
+	for _, c := range cases {
+		actual, err := resolver.infer(c.Record, c.Args)
+		if c.Err != (err != nil) {
+			t.Fatalf("%s: expected error to be %t, got %v", c.Name, c.Err, err)
+		}
+		if actual != c.Expected {
+			t.Fatalf("%s: expected %q, got %q", c.Name, c.Expected, actual)
+		}
+	}
+}
+
+func TestRenderZoneBatches_inferred(t *testing.T) {
+	metadata, err := parseSNSMetadata([]byte(testInferredMetadataJSON))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+
+	batches, err := renderZoneBatches(testAwsClient(), "i-123456789", metadata, transitionLaunch, "")
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	expected := map[string]string{
+		"0123456789ABCDEF": "i-123456789.internal.example.com.",
+		"9876543210FEDCBA": "i-123456789.example.com.",
+	}
+	if len(batches) != len(expected) {
+		t.Fatalf("Expected %d batches, got %d", len(expected), len(batches))
+	}
+	for _, batch := range batches {
+		if len(batch.Changes) != 1 || *batch.Changes[0].ResourceRecordSet.Name != expected[batch.ZoneID] {
+			t.Fatalf("Unexpected batch for zone ID %s: %v", batch.ZoneID, batch.Changes)
+		}
+	}
+}
+
+func TestRenderZoneBatches_merged(t *testing.T) {
+	metadata, err := parseSNSMetadata([]byte(testZonesMetadataJSON))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+	metadata.Zones[1].HostedZoneID = ""
+	metadata.Zones[1].HostedZoneName = "example.com."
+	metadata.Zones[1].PrivateZone = aws.Bool(false)
+
+	batches, err := renderZoneBatches(testAwsClient(), "i-123456789", metadata, transitionLaunch, "")
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if len(batches) != 1 || batches[0].ZoneID != "ABCDEF0123456789" || len(batches[0].Changes) != 2 {
+		t.Fatalf("Expected one merged batch, got %#v", batches)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// Modes for deriving a termination batch from a launch batch, as supplied in
+// the Inverse field of messageArgs.
+const (
+	// Delete the resource record sets as they currently exist in Route 53.
+	inverseExisting = "Existing"
+
+	// Delete the resource record sets as rendered from the launch batch.
+	inverseStored = "Stored"
+)
+
+// inverseChanges derives a termination batch from a rendered launch batch.
+// Every CREATE or UPSERT change in the batch is turned into a DELETE, in
+// reverse order, so that records that depend on earlier records in the batch
+// are removed first. DELETE changes in the launch batch are skipped.
+//
+// Route 53 requires that the TTL and values in a DELETE match the existing
+// resource record set exactly. The mode controls where these come from:
+//
+//   * "Existing" looks up the resource record set currently in Route 53 by
+//     the rendered Name and Type, and deletes it as found. This is the
+//     safest option, as IP address values are empty on termination events.
+//     Record sets whose values no longer match the rendered values, such as
+//     a shared record that another instance has since taken over, are
+//     skipped. See renderedValuesMatch.
+//   * "Stored" deletes the resource record set exactly as rendered from the
+//     launch batch. This should only be used when the values do not depend
+//     on instance data that is unavailable on termination, such as IP
+//     addresses.
+func (c *awsClient) inverseChanges(zoneID string, changes []*route53.Change, mode string) ([]*route53.Change, error) {
+	if mode != inverseExisting && mode != inverseStored {
+		return nil, fmt.Errorf("Unsupported Inverse mode %q - must be one of %q or %q", mode, inverseExisting, inverseStored)
+	}
+
+	c.logger().With("zone_id", zoneID).Infof("Deriving termination changes from launch changes using mode %s", mode)
+	inverse := []*route53.Change{}
+	for i := len(changes) - 1; i >= 0; i-- {
+		change := changes[i]
+		if *change.Action == route53.ChangeActionDelete {
+			c.logger().With("zone_id", zoneID).Infof("Skipping DELETE change for %s in launch changes", *change.ResourceRecordSet.Name)
+			continue
+		}
+
+		rrSet := change.ResourceRecordSet
+		if mode == inverseExisting {
+			var err error
+			rrSet, err = c.FindRoute53ResourceRecordSet(zoneID, *rrSet.Name, *rrSet.Type, aws.StringValue(rrSet.SetIdentifier))
+			if err != nil {
+				return nil, err
+			}
+			if !renderedValuesMatch(change.ResourceRecordSet, rrSet) {
+				c.logger().With("zone_id", zoneID).Warnf(
+					"Skipping DELETE change for %s %s: current values %s do not match rendered values %s",
+					*rrSet.Name, *rrSet.Type, strings.Join(rrSetValues(rrSet), ","), strings.Join(rrSetValues(change.ResourceRecordSet), ","),
+				)
+				continue
+			}
+		}
+
+		inverse = append(inverse, &route53.Change{
+			Action:            aws.String(route53.ChangeActionDelete),
+			ResourceRecordSet: rrSet,
+		})
+	}
+
+	return inverse, nil
+}
+
+// renderedValuesMatch returns true if the values rendered for a launch change
+// match the values of the resource record set currently in Route 53, in any
+// order. Rendered values that are empty, such as IP addresses that are not
+// available on termination, are not compared, so a record set matches if
+// none of its values could be rendered.
+func renderedValuesMatch(rendered, existing *route53.ResourceRecordSet) bool {
+	values := []string{}
+	for _, rr := range rendered.ResourceRecords {
+		if v := aws.StringValue(rr.Value); v != "" {
+			values = append(values, v)
+		}
+	}
+	if len(values) < 1 {
+		return true
+	}
+	if len(values) != len(existing.ResourceRecords) {
+		return false
+	}
+
+	remaining := append([]*route53.ResourceRecord{}, existing.ResourceRecords...)
+	for _, v := range values {
+		found := false
+		for n, rr := range remaining {
+			if strings.EqualFold(v, aws.StringValue(rr.Value)) {
+				remaining = append(remaining[:n], remaining[n+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
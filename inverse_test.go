@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// testInverseMetadataJSON is a test SNS message in JSON form, with separate
+// launch changes and an Inverse mode.
+const testInverseMetadataJSON = `
+{
+  "HostedZoneID": "ABCDEF0123456789",
+  "Inverse": "Existing",
+  "OnLaunch": [
+    {
+      "Action": "UPSERT",
+      "ResourceRecordSet": {
+        "Name": "{{.InstanceID}}.example.com.",
+        "TTL": 3600,
+        "Type": "A",
+        "ResourceRecords": [
+          {
+            "Value": "{{.InstancePublicIPAddress}}"
+          }
+        ]
+      }
+    },
+    {
+      "Action": "UPSERT",
+      "ResourceRecordSet": {
+        "Name": "www.example.com.",
+        "TTL": 3600,
+        "Type": "CNAME",
+        "ResourceRecords": [
+          {
+            "Value": "{{.InstanceID}}.example.com."
+          }
+        ]
+      }
+    }
+  ]
+}
+`
+
+func TestInverseChanges(t *testing.T) {
+	for _, mode := range []string{inverseExisting, inverseStored} {
+		metadata, err := parseSNSMetadata([]byte(testInverseMetadataJSON))
+		if err != nil {
+			panic(fmt.Errorf("Bad JSON in test: %v", err))
+		}
+
+		client := testAwsClient()
+		batch, err := renderChanges(client, "i-123456789", metadata.zoneArgs, transitionLaunch, "")
+		if err != nil {
+			t.Fatalf("Bad: %v", err)
+		}
+
+		inverse, err := client.inverseChanges(metadata.HostedZoneID, batch, mode)
+		if err != nil {
+			t.Fatalf("Bad (%s): %v", mode, err)
+		}
+
+		if len(inverse) != 2 {
+			t.Fatalf("Expected 2 changes (%s), got %d", mode, len(inverse))
+		}
+		for _, change := range inverse {
+			if *change.Action != route53.ChangeActionDelete {
+				t.Fatalf("Expected DELETE action (%s), got %s", mode, *change.Action)
+			}
+		}
+		if *inverse[0].ResourceRecordSet.Name != "www.example.com." {
+			t.Fatalf("Expected inverse[0] to be www.example.com. (%s), got %s", mode, *inverse[0].ResourceRecordSet.Name)
+		}
+		if *inverse[1].ResourceRecordSet.ResourceRecords[0].Value != "54.0.0.1" {
+			t.Fatalf("Expected inverse[1] value to be 54.0.0.1 (%s), got %s", mode, *inverse[1].ResourceRecordSet.ResourceRecords[0].Value)
+		}
+	}
+}
+
+func TestInverseChanges_shouldError(t *testing.T) {
+	metadata, err := parseSNSMetadata([]byte(testInverseMetadataJSON))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+
+	client := testAwsClient()
+
+	if _, err := client.inverseChanges(metadata.HostedZoneID, metadata.OnLaunch, "bad"); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+	if _, err := client.inverseChanges("bad", metadata.OnLaunch, inverseExisting); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+}
+
+func TestInverseChanges_existingWeighted(t *testing.T) {
+	launch := []*route53.Change{
+		{
+			Action: aws.String(route53.ChangeActionUpsert),
+			ResourceRecordSet: &route53.ResourceRecordSet{
+				Name:          aws.String("weighted.example.com."),
+				Type:          aws.String("A"),
+				SetIdentifier: aws.String("green"),
+			},
+		},
+	}
+
+	client := testAwsClient()
+	inverse, err := client.inverseChanges("ABCDEF0123456789", launch, inverseExisting)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if rrSet := inverse[0].ResourceRecordSet; *rrSet.SetIdentifier != "green" || *rrSet.ResourceRecords[0].Value != "54.0.0.3" {
+		t.Fatalf("Expected DELETE of the green record set, got %v", rrSet)
+	}
+
+	launch[0].ResourceRecordSet.Name = aws.String("missing.example.com.")
+	if _, err := client.inverseChanges("ABCDEF0123456789", launch, inverseExisting); !isRRSetNotFound(err) {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+}
+
+func TestInverseChanges_existingOtherInstance(t *testing.T) {
+	// The launch changes as rendered on termination. The IP address is not
+	// available, so the A record set is deleted as found. www.example.com.
+	// was rendered for i-987654321, but points to i-123456789 in Route 53,
+	// as that instance has taken it over since.
+	launch := []*route53.Change{
+		{
+			Action: aws.String(route53.ChangeActionUpsert),
+			ResourceRecordSet: &route53.ResourceRecordSet{
+				Name:            aws.String("i-123456789.example.com."),
+				Type:            aws.String("A"),
+				ResourceRecords: []*route53.ResourceRecord{{Value: aws.String("")}},
+			},
+		},
+		{
+			Action: aws.String(route53.ChangeActionUpsert),
+			ResourceRecordSet: &route53.ResourceRecordSet{
+				Name:            aws.String("www.example.com."),
+				Type:            aws.String("CNAME"),
+				ResourceRecords: []*route53.ResourceRecord{{Value: aws.String("i-987654321.example.com.")}},
+			},
+		},
+	}
+
+	client := testAwsClient()
+	inverse, err := client.inverseChanges("ABCDEF0123456789", launch, inverseExisting)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if len(inverse) != 1 || *inverse[0].ResourceRecordSet.Name != "i-123456789.example.com." {
+		t.Fatalf("Expected the record set owned by another instance to be skipped, got %v", inverse)
+	}
+}
+
+func TestRenderedValuesMatch(t *testing.T) {
+	existing := &route53.ResourceRecordSet{
+		ResourceRecords: []*route53.ResourceRecord{
+			{Value: aws.String("10.0.0.1")},
+			{Value: aws.String("10.0.0.2")},
+		},
+	}
+	cases := []struct {
+		values   []string
+		expected bool
+	}{
+		{[]string{"10.0.0.2", "10.0.0.1"}, true},
+		{[]string{""}, true},
+		{[]string{}, true},
+		{[]string{"10.0.0.1"}, false},
+		{[]string{"10.0.0.1", "10.0.0.3"}, false},
+	}
+	for _, tc := range cases {
+		rendered := &route53.ResourceRecordSet{}
+		for _, v := range tc.values {
+			rendered.ResourceRecords = append(rendered.ResourceRecords, &route53.ResourceRecord{Value: aws.String(v)})
+		}
+		if actual := renderedValuesMatch(rendered, existing); actual != tc.expected {
+			t.Fatalf("Expected match for %v to be %t, got %t", tc.values, tc.expected, actual)
+		}
+	}
+}
+
+func TestRenderChanges_terminateInverse(t *testing.T) {
+	metadata, err := parseSNSMetadata([]byte(testInverseMetadataJSON))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+
+	client := testAwsClient()
+	batch, err := renderChanges(client, "i-123456789", metadata.zoneArgs, transitionTerminate, "")
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	if len(batch) != 2 || *batch[0].Action != route53.ChangeActionDelete {
+		t.Fatalf("Expected 2 DELETE changes, got %#v", batch)
+	}
+}
@@ -0,0 +1,24 @@
+// +build !standalone
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/eawsy/aws-lambda-go/service/lambda/runtime"
+)
+
+// handle is our handler function for Lambda. See handleEvent and
+// processMessage for details on how events are processed.
+//
+// This file is excluded when building with the standalone tag, which drops
+// the dependency on the Lambda runtime shim for the server command.
+func handle(evt json.RawMessage, ctx *runtime.Context) (interface{}, error) {
+	deadline := time.Now().Add(time.Duration(ctx.RemainingTimeInMillis()) * time.Millisecond)
+	return nil, handleEvent(evt, deadline, ctx.AWSRequestID)
+}
+
+func init() {
+	runtime.HandleFunc(handle)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevelEnvVar is the environment variable that sets the minimum level of
+// log lines that are written. Can be one of debug, info, warn, or error.
+const logLevelEnvVar = "ASG53_LOG_LEVEL"
+
+// logLevel is the severity of a log line.
+type logLevel int
+
+// The log levels, in increasing order of severity.
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// logLevelNames are the names of the log levels, as written in log lines and
+// accepted in ASG53_LOG_LEVEL.
+var logLevelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+// parseLogLevel returns the log level with the supplied name.
+func parseLogLevel(name string) (logLevel, error) {
+	for level, n := range logLevelNames {
+		if strings.EqualFold(name, n) {
+			return level, nil
+		}
+	}
+	return levelInfo, fmt.Errorf("Unknown log level %q", name)
+}
+
+// logField is a correlation field that is written on every line of a
+// logger.
+type logField struct {
+	key   string
+	value string
+}
+
+// logOutput is the destination of log lines, shared by a logger and all of
+// the loggers derived from it with With.
+type logOutput struct {
+	// The writer lines are written to, and the lock that serializes writes.
+	mu sync.Mutex
+	w  io.Writer
+
+	// The minimum level of lines that are written.
+	level logLevel
+
+	// The function that returns the time for each line.
+	now func() time.Time
+}
+
+// logger writes structured log lines, as one JSON object per line. Each line
+// carries the time, level, and message, along with the correlation fields
+// attached to the logger with With, such as the request ID, auto scaling
+// group name, instance ID, lifecycle hook name, and hosted zone ID. This
+// allows lines for a specific instance or zone to be searched for across
+// many invocations in CloudWatch Logs.
+type logger struct {
+	out    *logOutput
+	fields []logField
+}
+
+// newLogger returns a logger that writes lines at level and above to w.
+func newLogger(w io.Writer, level logLevel) *logger {
+	return &logger{out: &logOutput{w: w, level: level, now: time.Now}}
+}
+
+// loadLogger returns a logger that writes to stderr, at the level set in
+// ASG53_LOG_LEVEL, or info if it is not set or invalid.
+func loadLogger() *logger {
+	l := newLogger(os.Stderr, levelInfo)
+	if raw := os.Getenv(logLevelEnvVar); raw != "" {
+		level, err := parseLogLevel(raw)
+		if err != nil {
+			l.Warnf("Ignoring %s: %v", logLevelEnvVar, err)
+			return l
+		}
+		l.out.level = level
+	}
+	return l
+}
+
+// defaultLogger is the logger used where no more specific logger is
+// available.
+var defaultLogger = loadLogger()
+
+// With returns a logger that adds the supplied field to every line, on top
+// of the fields of l. Empty values are left out. An existing field with the
+// same key is replaced.
+func (l *logger) With(key, value string) *logger {
+	if value == "" {
+		return l
+	}
+	fields := []logField{}
+	for _, f := range l.fields {
+		if f.key != key {
+			fields = append(fields, f)
+		}
+	}
+	return &logger{out: l.out, fields: append(fields, logField{key: key, value: value})}
+}
+
+// enabled returns true if lines at level are written.
+func (l *logger) enabled(level logLevel) bool {
+	return level >= l.out.level
+}
+
+// write writes a line at level, if it is enabled.
+func (l *logger) write(level logLevel, format string, args ...interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+
+	// Lines are written by hand rather than from a map, to keep the fields in
+	// a stable order.
+	buf := &strings.Builder{}
+	writeField := func(key, value string) {
+		k, _ := json.Marshal(key)
+		v, _ := json.Marshal(value)
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('{')
+	writeField("time", l.out.now().UTC().Format(time.RFC3339Nano))
+	writeField("level", logLevelNames[level])
+	writeField("msg", fmt.Sprintf(format, args...))
+	for _, f := range l.fields {
+		writeField(f.key, f.value)
+	}
+	buf.WriteString("}\n")
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	io.WriteString(l.out.w, buf.String())
+}
+
+// Debugf writes a line at the debug level. These are not written by
+// default, and are used for verbose output, such as raw event dumps.
+func (l *logger) Debugf(format string, args ...interface{}) {
+	l.write(levelDebug, format, args...)
+}
+
+// Infof writes a line at the info level.
+func (l *logger) Infof(format string, args ...interface{}) {
+	l.write(levelInfo, format, args...)
+}
+
+// Warnf writes a line at the warn level.
+func (l *logger) Warnf(format string, args ...interface{}) {
+	l.write(levelWarn, format, args...)
+}
+
+// Errorf writes a line at the error level.
+func (l *logger) Errorf(format string, args ...interface{}) {
+	l.write(levelError, format, args...)
+}
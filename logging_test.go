@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLogger returns a logger at the supplied level that writes to buf, with
+// a fixed time.
+func testLogger(buf *bytes.Buffer, level logLevel) *logger {
+	l := newLogger(buf, level)
+	l.out.now = func() time.Time { return time.Date(2016, 11, 1, 12, 0, 0, 0, time.UTC) }
+	return l
+}
+
+func TestLoggerWrite(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := testLogger(buf, levelInfo).With("request_id", "abc-123").With("instance_id", "i-123456789")
+	l.Infof("Sending %d changes", 2)
+
+	expected := `{"time":"2016-11-01T12:00:00Z","level":"info","msg":"Sending 2 changes","request_id":"abc-123","instance_id":"i-123456789"}` + "\n"
+	if buf.String() != expected {
+		t.Fatalf("Expected %s, got %s", expected, buf.String())
+	}
+
+	parsed := map[string]string{}
+	if err := json.Unmarshal(buf.Bytes(), &parsed); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+}
+
+func TestLoggerWrite_levels(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := testLogger(buf, levelInfo)
+	l.Debugf("Raw event JSON data: %s", "{}")
+	l.Infof("info")
+	l.Warnf("warn")
+	l.Errorf("error")
+
+	levels := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		parsed := map[string]string{}
+		if err := json.Unmarshal([]byte(line), &parsed); err != nil {
+			t.Fatalf("Bad: %v", err)
+		}
+		levels = append(levels, parsed["level"])
+	}
+	expected := []string{"info", "warn", "error"}
+	if !reflect.DeepEqual(expected, levels) {
+		t.Fatalf("Expected levels %v, got %v", expected, levels)
+	}
+}
+
+func TestLoggerWith(t *testing.T) {
+	base := testLogger(&bytes.Buffer{}, levelInfo).With("zone_id", "ABCDEF0123456789")
+	l := base.With("instance_id", "").With("zone_id", "0123456789ABCDEF")
+
+	expected := []logField{{key: "zone_id", value: "0123456789ABCDEF"}}
+	if !reflect.DeepEqual(expected, l.fields) {
+		t.Fatalf("Expected fields %v, got %v", expected, l.fields)
+	}
+	if base.fields[0].value != "ABCDEF0123456789" {
+		t.Fatalf("Expected base logger to be unchanged, got %v", base.fields)
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	level, err := parseLogLevel("DEBUG")
+	if err != nil || level != levelDebug {
+		t.Fatalf("Expected debug, got %v, %v", level, err)
+	}
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+}
+
+func TestAWSClientWithLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	client := testAwsClient()
+	client.log = testLogger(buf, levelInfo).With("request_id", "abc-123")
+
+	scoped := client.withLog("instance_id", "i-123456789")
+	scoped.retrier().logger().Infof("retrying")
+	if !strings.Contains(buf.String(), `"request_id":"abc-123","instance_id":"i-123456789"`) {
+		t.Fatalf("Expected correlation fields, got %s", buf.String())
+	}
+	if client.logger() == scoped.logger() {
+		t.Fatal("Expected original client's logger to be unchanged")
+	}
+}
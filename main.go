@@ -2,21 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"text/template"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/private/waiter"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/route53"
-	"github.com/eawsy/aws-lambda-go/service/lambda/runtime"
 )
 
 // eventNotification represents an abridged version of a SNS notification
@@ -41,22 +42,55 @@ type snsEvent struct {
 	Message string
 }
 
+// Auto scaling event types, as found in the Event field of a snsMessage.
+const (
+	// A test notification, sent when a hook or notification is first set up.
+	eventTestNotification = "autoscaling:TEST_NOTIFICATION"
+
+	// A plain auto scaling notification for a successful instance launch.
+	eventInstanceLaunch = "autoscaling:EC2_INSTANCE_LAUNCH"
+
+	// A plain auto scaling notification for a successful instance
+	// termination.
+	eventInstanceTerminate = "autoscaling:EC2_INSTANCE_TERMINATE"
+)
+
+// Lifecycle transitions that the function knows how to process.
+const (
+	// The transition for instances that are launching.
+	transitionLaunch = "autoscaling:EC2_INSTANCE_LAUNCHING"
+
+	// The transition for instances that are terminating.
+	transitionTerminate = "autoscaling:EC2_INSTANCE_TERMINATING"
+)
+
 // snsMessage represents an abridged version of an SNS notification
 // event through Lambda.
 type snsMessage struct {
 	// The SNS event type. If a test notification is received, this will read
 	// "autoscaling:TEST_NOTIFICATION" and most other fields will be empty.
+	// Plain auto scaling notifications will read
+	// "autoscaling:EC2_INSTANCE_LAUNCH" or "autoscaling:EC2_INSTANCE_TERMINATE".
+	// Lifecycle hook events do not set this field.
 	Event string
 
 	// The EC2 instance ID from the lifecycle event.
 	EC2InstanceID string `json:"EC2InstanceId"`
 
+	// Additional details for plain auto scaling notifications, such as
+	// "Subnet ID" and "Availability Zone".
+	Details map[string]string
+
 	// The auto scaling group name the event was called for.
 	AutoScalingGroupName string
 
 	// The name of the lifecycle hook that the event was called for.
 	LifecycleHookName string
 
+	// The lifecycle transition of the hook that the event was called for,
+	// such as "autoscaling:EC2_INSTANCE_LAUNCHING".
+	LifecycleTransition string
+
 	// The action token for this lifecycle hook event.
 	LifecycleActionToken string
 
@@ -66,6 +100,26 @@ type snsMessage struct {
 	NotificationMetadata string
 }
 
+// isNotification returns true if the message is a plain auto scaling
+// launch or termination notification. These messages carry no metadata or
+// lifecycle action token.
+func (m snsMessage) isNotification() bool {
+	return m.Event == eventInstanceLaunch || m.Event == eventInstanceTerminate
+}
+
+// transition returns the lifecycle transition for the message. For plain
+// auto scaling notifications, this is the transition that corresponds to the
+// notification's event type.
+func (m snsMessage) transition() string {
+	switch m.Event {
+	case eventInstanceLaunch:
+		return transitionLaunch
+	case eventInstanceTerminate:
+		return transitionTerminate
+	}
+	return m.LifecycleTransition
+}
+
 // messageArgs supplies the arguments and Route 53 changes to the function in
 // the form of SNS metadata.
 //
@@ -116,6 +170,8 @@ type snsMessage struct {
 //   * {{.InstancePrivateIPAddress}}, for the instance's private IP address
 //   * {{.InstancePublicIPAddress}}, for the instance's public IP address
 //   * {{.HostedZoneID}}, for the Route 53 hosted zone ID
+//   * {{.HealthCheckID}}, for the ID of the instance's health check, if
+//     HealthCheck is set
 //   * {{.ExistingRDataValue [set] [record]}}, to get the existing RDATA
 //     on a resource record set. This function operates on the existing
 //     change set, operating on the specific fields of the resource record set
@@ -153,13 +209,220 @@ type snsMessage struct {
 //   		}
 //   	]
 //   }
+//
+// A single document can also be attached to both the launch and termination
+// hooks for an auto scaling group, by supplying OnLaunch and OnTerminate
+// change batches instead of Changes. The batch used is chosen by the
+// lifecycle transition of the event. Alternatively, Inverse can be set to
+// derive the termination batch from the launch batch automatically:
+//
+//   {
+//   	"HostedZoneID": "ABCDEF0123456789",
+//   	"Inverse": "Existing",
+//   	"OnLaunch": [
+//   		{
+//   			"Action": "UPSERT",
+//   			"ResourceRecordSet": {...}
+//   		}
+//   	]
+//   }
+//
+// See inverseChanges for more information on the available modes.
+//
+// To make changes in more than one hosted zone for the same event, such as a
+// public and a private record for the same instance, supply a list of Zones
+// instead, each with its own HostedZoneID and change batches:
+//
+//   {
+//   	"Zones": [
+//   		{
+//   			"HostedZoneID": "ABCDEF0123456789",
+//   			"Changes": [...]
+//   		},
+//   		{
+//   			"HostedZoneID": "9876543210FEDCBA",
+//   			"Changes": [...]
+//   		}
+//   	]
+//   }
+//
+// See applyZoneBatches for how changes to multiple zones are applied.
+//
+// Instead of a HostedZoneID, a zone can be looked up by HostedZoneName. If
+// there is more than one zone with the same name, such as a public zone and
+// a private one, PrivateZone, VPCID, and VPCRegion can be used to pick one:
+//
+//   {
+//   	"HostedZoneName": "example.com.",
+//   	"PrivateZone": true,
+//   	"VPCID": "vpc-0123abcd",
+//   	"Changes": [...]
+//   }
+//
+// Alternatively, set InferHostedZone to pick the zone for each change from
+// its record name, by the longest matching zone name. See
+// hostedZoneResolver for more details.
+//
+// A Route 53 health check can be managed for each instance by supplying a
+// HealthCheck, with the same fields as the HealthCheckConfig of the Route 53
+// API. The health check is created on launch, can be referenced in change
+// batches through {{.HealthCheckID}}, and is deleted on termination after
+// the change batches have been sent:
+//
+//   {
+//   	"HostedZoneID": "ABCDEF0123456789",
+//   	"HealthCheck": {
+//   		"Type": "HTTP",
+//   		"IPAddress": "{{.InstancePublicIPAddress}}",
+//   		"Port": 80,
+//   		"ResourcePath": "/health"
+//   	},
+//   	"Changes": [
+//   		{
+//   			"Action": "UPSERT",
+//   			"ResourceRecordSet": {
+//   				"Name": "www.example.com.",
+//   				"SetIdentifier": "{{.InstanceID}}",
+//   				"Weight": 10,
+//   				"HealthCheckId": "{{.HealthCheckID}}",
+//   				...
+//   			}
+//   		}
+//   	]
+//   }
+//
+// See prepareHealthCheck for more details.
+//
+// By default, each change batch is waited on until it has synced, checking
+// every 5 seconds for up to 2 minutes. This can be tuned with Sync, or
+// turned off altogether by setting Wait to false:
+//
+//   {
+//   	"HostedZoneID": "ABCDEF0123456789",
+//   	"Wait": true,
+//   	"Sync": {
+//   		"InitialDelay": "2s",
+//   		"Backoff": 1.5,
+//   		"MaxDelay": "10s",
+//   		"MaxWait": "5m"
+//   	},
+//   	"Changes": [...]
+//   }
 type messageArgs struct {
+	// The arguments for a single hosted zone. If Zones is set, these are only
+	// used if a zone is supplied, as the first zone in the list.
+	zoneArgs
+
+	// A list of hosted zones to operate on, each with their own change
+	// batches.
+	Zones []zoneArgs
+
+	// A health check to create for the instance on launch, and delete on
+	// termination. The health check is managed with the top-level RoleARN,
+	// if set.
+	HealthCheck *route53.HealthCheckConfig
+
+	// If set to false, change batches are sent without waiting for them to
+	// sync.
+	Wait *bool
+
+	// The settings for waiting for change batches to sync. See changePoller
+	// for more details.
+	Sync *syncConfig
+
+	// If true, the changes are rendered and diffed against the current state
+	// of the hosted zones, and the plan is logged, but nothing is sent. On
+	// launch, the health check is not created.
+	DryRun bool
+
+	// If set, a failureReport is sent here when the event fails. Can be an
+	// SNS topic ARN, or an HTTPS webhook URL that the report is POSTed to.
+	NotifyOnFailure string
+}
+
+// zones returns the list of hosted zones to operate on.
+func (a messageArgs) zones() []zoneArgs {
+	if len(a.Zones) < 1 {
+		return []zoneArgs{a.zoneArgs}
+	}
+	if a.HostedZoneID != "" || a.HostedZoneName != "" || a.InferHostedZone {
+		return append([]zoneArgs{a.zoneArgs}, a.Zones...)
+	}
+	return a.Zones
+}
+
+// zoneArgs holds the hosted zone ID and change batches for a single hosted
+// zone.
+type zoneArgs struct {
 	// The hosted zone ID to operate on.
 	HostedZoneID string
 
+	// The name of the hosted zone to operate on, used if HostedZoneID is not
+	// set.
+	HostedZoneName string
+
+	// If set, only public (false) or private (true) zones are considered when
+	// looking up a zone by name.
+	PrivateZone *bool
+
+	// If set, only private zones associated with this VPC are considered
+	// when looking up a zone by name. VPCRegion can further narrow this down
+	// to a VPC in a specific region.
+	VPCID     string
+	VPCRegion string
+
+	// If set, and neither HostedZoneID nor HostedZoneName are set, the zone
+	// for each change is inferred from its record name.
+	InferHostedZone bool
+
+	// If set, Route 53 calls for this zone, including zone lookups, are made
+	// with credentials for this role, assumed through STS. ExternalID is
+	// passed along with the AssumeRole call if set.
+	RoleARN    string
+	ExternalID string
+
+	// Entries to add to shared SRV resource record sets on launch, and remove
+	// on termination. See srvMember for more details.
+	SRVMembers []srvMember
+
 	// A Route 53 change batch. See the struct's
 	// documentation for more information on setting this value.
 	Changes []*route53.Change
+
+	// A Route 53 change batch to use for launch transitions only. If this is
+	// not set, Changes is used.
+	OnLaunch []*route53.Change
+
+	// A Route 53 change batch to use for termination transitions only. If
+	// this is not set, Changes is used, unless Inverse is set.
+	OnTerminate []*route53.Change
+
+	// If set, and OnTerminate is not set, the termination batch is derived
+	// from the launch batch. Can be one of "Existing" or "Stored".
+	Inverse string
+}
+
+// changesFor returns the change batch for the supplied lifecycle
+// transition. The second return value is true if the batch is a launch batch
+// that needs to be inverted with inverseChanges after rendering.
+func (a zoneArgs) changesFor(transition string) ([]*route53.Change, bool) {
+	launch := a.Changes
+	if a.OnLaunch != nil {
+		launch = a.OnLaunch
+	}
+
+	switch transition {
+	case transitionLaunch:
+		return launch, false
+	case transitionTerminate:
+		if a.OnTerminate != nil {
+			return a.OnTerminate, false
+		}
+		if a.Inverse != "" {
+			return launch, true
+		}
+	}
+	return a.Changes, false
 }
 
 // awsClient is an AWS service matrix for resources that we will need through
@@ -173,13 +436,131 @@ type awsClient struct {
 
 	// The Route 53 connection.
 	Route53 *route53.Route53
+
+	// The session the connections were created from, for services that are
+	// set up on demand.
+	session *session.Session
+
+	// The retry policy for Route 53 API calls. If nil, a default policy with
+	// no deadline is used.
+	retry *retryPolicy
+
+	// If set, change batches sent through submitChanges are coalesced with
+	// those from other messages being processed at the same time.
+	aggregator *changeAggregator
+
+	// The clients for Route 53 calls made with assumed roles. If nil, roles
+	// cannot be assumed.
+	roles *roleClients
+
+	// The settings for waiting for change batches to sync. If nil, the
+	// defaults are used.
+	poller *changePoller
+
+	// The context for this invocation, which bounds waits for change batches
+	// to sync. If nil, context.Background() is used.
+	ctx context.Context
+
+	// The logger for this invocation, carrying its correlation fields. If
+	// nil, defaultLogger is used.
+	log *logger
+
+	// The metrics recorder for this invocation, carrying its dimensions. If
+	// nil, defaultMetrics is used.
+	metrics *metricsRecorder
+
+	// The sink that applied change batches are recorded in. If nil, no audit
+	// trail is kept.
+	audit auditSink
+
+	// The HTTP client that failure reports are POSTed to webhooks with. If
+	// nil, a client with webhookTimeout is used.
+	webhookClient *http.Client
+
+	// true if change batches are sent without diffing them against the
+	// current record sets first. Diffing costs a ListResourceRecordSets call
+	// for each record set, which counts against the Route 53 request rate
+	// limit.
+	noDiff bool
+
+	// The event being processed, for audit entries.
+	event invocation
+
+	// The events whose changes were coalesced into the batches sent by this
+	// client, for audit entries. If empty, only event is recorded.
+	contributors []invocation
+
+	// The policy that rendered changes are checked against before they are
+	// sent. If nil, any change can be sent.
+	policy *changePolicy
+
+	// The resource record sets looked up by templates while processing the
+	// event. If nil, lookups are not cached.
+	lookups *rrSetCache
+}
+
+// logger returns the client's logger. c can be nil.
+func (c *awsClient) logger() *logger {
+	if c == nil || c.log == nil {
+		return defaultLogger
+	}
+	return c.log
+}
+
+// forEvent returns a copy of c for processing the event for the supplied
+// auto scaling group, instance ID, and lifecycle hook. These are added to the
+// client's log fields, metric dimensions, and audit entries. Any of them can
+// be empty. The copy has its own cache for template record lookups.
+func (c *awsClient) forEvent(asgName, instanceID, hookName string) *awsClient {
+	client := c.withLog("asg", asgName).withLog("instance_id", instanceID).withLog("hook", hookName).withMetrics(dimensionASG, asgName)
+	client.event.AutoScalingGroupName = asgName
+	client.event.InstanceID = instanceID
+	client.event.LifecycleHookName = hookName
+	client.lookups = newRRSetCache()
+	return client
+}
+
+// forContributors returns a copy of c that records events in the audit
+// entries for the batches it sends. A single event is recorded as the
+// client's event.
+func (c *awsClient) forContributors(events []invocation) *awsClient {
+	client := *c
+	client.contributors = nil
+	if len(events) == 1 {
+		client.event = events[0]
+	} else {
+		client.event = invocation{}
+		client.contributors = events
+	}
+	return &client
+}
+
+// withLog returns a copy of c that logs with the correlation field key set
+// to value, on top of the fields c already logs with.
+func (c *awsClient) withLog(key, value string) *awsClient {
+	client := *c
+	client.log = c.logger().With(key, value)
+	return &client
+}
+
+// retrier returns the client's retry policy for Route 53 API calls, which
+// logs and counts retries with the client's logger and metrics recorder.
+func (c *awsClient) retrier() *retryPolicy {
+	policy := newRetryPolicy(time.Time{})
+	if c.retry != nil {
+		p := *c.retry
+		policy = &p
+	}
+	policy.log = c.logger()
+	policy.metrics = c.metricsRecorder()
+	return policy
 }
 
 // newAWSConn returns an initialized AWS connection matrix. An error is
 // returned if there is some sort of issue.
 func newAWSClient() (*awsClient, error) {
 	conn := awsClient{}
-	log.Println("Setting up AWS connections.")
+	defaultLogger.Infof("Setting up AWS connections.")
 
 	sess, err := session.NewSession()
 	if err != nil {
@@ -189,13 +570,35 @@ func newAWSClient() (*awsClient, error) {
 	conn.EC2 = ec2.New(sess)
 	conn.AutoScaling = autoscaling.New(sess)
 	conn.Route53 = route53.New(sess)
+	conn.session = sess
+	conn.roles = newRoleClients(stsRoute53Factory(sess))
+
+	conn.poller, err = loadChangePoller()
+	if err != nil {
+		return nil, err
+	}
+
+	conn.audit, err = loadAuditSink(sess)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.noDiff, err = loadDiffDisabled()
+	if err != nil {
+		return nil, err
+	}
+
+	conn.policy, err = loadChangePolicy(sess)
+	if err != nil {
+		return nil, err
+	}
 
 	return &conn, nil
 }
 
 // FetchEC2InstanceData returns an *ec2.Instance with the loaded instance ID.
 func (c *awsClient) FetchEC2InstanceData(instanceID string) (*ec2.Instance, error) {
-	log.Printf("Fetching EC2 instance data for ID: %s", instanceID)
+	c.logger().Infof("Fetching EC2 instance data for ID: %s", instanceID)
 	params := &ec2.DescribeInstancesInput{
 		InstanceIds: aws.StringSlice([]string{instanceID}),
 	}
@@ -212,36 +615,225 @@ func (c *awsClient) FetchEC2InstanceData(instanceID string) (*ec2.Instance, erro
 	return resp.Reservations[0].Instances[0], nil
 }
 
+// TagEC2Instance sets the tag with the supplied key on an EC2 instance,
+// replacing its value if the tag already exists.
+func (c *awsClient) TagEC2Instance(instanceID, key, value string) error {
+	c.logger().Infof("Tagging EC2 instance %s with %s=%s", instanceID, key, value)
+	params := &ec2.CreateTagsInput{
+		Resources: aws.StringSlice([]string{instanceID}),
+		Tags: []*ec2.Tag{
+			&ec2.Tag{Key: aws.String(key), Value: aws.String(value)},
+		},
+	}
+
+	if _, err := c.EC2.CreateTags(params); err != nil {
+		return fmt.Errorf("Error tagging instance: %v", err)
+	}
+	return nil
+}
+
 // FindRoute53ResourceRecord looks for a specific resource record Name and
-// Type within route 53 for a specific hosted zone. Its resource record
-// values are returned. If the record is not found, this function returns an
-// error.
-func (c *awsClient) FindRoute53ResourceRecord(zoneID, name, rrType string) ([]*route53.ResourceRecord, error) {
-	log.Printf("Looking for resource record set %s %s in zone ID: %s", name, rrType, zoneID)
+// Type (and SetIdentifier, for weighted and other routing policies) within
+// route 53 for a specific hosted zone. Its resource record values are
+// returned. If the record is not found, this function returns an
+// *rrSetNotFoundError.
+func (c *awsClient) FindRoute53ResourceRecord(zoneID, name, rrType, setIdentifier string) ([]*route53.ResourceRecord, error) {
+	rrSet, err := c.FindRoute53ResourceRecordSet(zoneID, name, rrType, setIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	return rrSet.ResourceRecords, nil
+}
+
+// FindRoute53ResourceRecordSet looks for a specific resource record Name and
+// Type (and SetIdentifier, if not empty) within route 53 for a specific
+// hosted zone, and returns the full resource record set. Names are matched
+// with rrSetNameMatches. If the record is not found, this function returns
+// an *rrSetNotFoundError.
+func (c *awsClient) FindRoute53ResourceRecordSet(zoneID, name, rrType, setIdentifier string) (*route53.ResourceRecordSet, error) {
+	rrSet, err := c.firstRoute53ResourceRecordSet(zoneID, name, rrType, setIdentifier)
+	if err != nil {
+		return nil, err
+	}
+
+	if rrSet == nil || !rrSetNameMatches(aws.StringValue(rrSet.Name), name) ||
+		!strings.EqualFold(aws.StringValue(rrSet.Type), rrType) ||
+		aws.StringValue(rrSet.SetIdentifier) != setIdentifier {
+		// Either there are no more record sets in the zone, or the lookup
+		// returned the next record set, not the one we asked for.
+		return nil, &rrSetNotFoundError{ZoneID: zoneID, Name: name, Type: rrType, SetIdentifier: setIdentifier}
+	}
+
+	return rrSet, nil
+}
+
+// rrSetNotFoundError is returned by FindRoute53ResourceRecordSet when the
+// resource record set does not exist.
+type rrSetNotFoundError struct {
+	ZoneID        string
+	Name          string
+	Type          string
+	SetIdentifier string
+}
+
+// Error implements error for rrSetNotFoundError.
+func (e *rrSetNotFoundError) Error() string {
+	name := e.Name
+	if e.SetIdentifier != "" {
+		name += " [" + e.SetIdentifier + "]"
+	}
+	return fmt.Sprintf("Resource record set %s %s not found in zone ID %s", name, e.Type, e.ZoneID)
+}
+
+// isRRSetNotFound returns true if err is an *rrSetNotFoundError.
+func isRRSetNotFound(err error) bool {
+	_, ok := err.(*rrSetNotFoundError)
+	return ok
+}
+
+// canonicalRRName returns name in the form that names are compared in:
+// lower case, with a trailing dot, and with the escape codes that Route 53
+// uses for characters such as "*" (\052) decoded.
+func canonicalRRName(name string) string {
+	decoded := make([]byte, 0, len(name))
+	for i := 0; i < len(name); i++ {
+		if name[i] != '\\' || i+1 >= len(name) {
+			decoded = append(decoded, name[i])
+			continue
+		}
+		if i+3 < len(name) {
+			if v, err := strconv.ParseUint(name[i+1:i+4], 8, 8); err == nil {
+				decoded = append(decoded, byte(v))
+				i += 3
+				continue
+			}
+		}
+		// Any other character can be escaped with a backslash.
+		decoded = append(decoded, name[i+1])
+		i++
+	}
+	return normalizeZoneName(string(decoded))
+}
+
+// rrSetNameMatches returns true if the resource record set names a and b
+// are the same, ignoring case, trailing dots, and escape codes. Wildcard
+// names only match wildcard names.
+func rrSetNameMatches(a, b string) bool {
+	return canonicalRRName(a) == canonicalRRName(b)
+}
+
+// firstRoute53ResourceRecordSet returns the first resource record set in the
+// zone that sorts at or after the supplied Name, Type, and SetIdentifier
+// (if not empty), which is not necessarily an exact match. nil is returned
+// if there are no more record sets in the zone.
+func (c *awsClient) firstRoute53ResourceRecordSet(zoneID, name, rrType, setIdentifier string) (*route53.ResourceRecordSet, error) {
+	c.logger().With("zone_id", zoneID).Infof("Looking for resource record set %s %s in zone ID: %s", name, rrType, zoneID)
 
 	params := &route53.ListResourceRecordSetsInput{
 		HostedZoneId:    aws.String(zoneID),
 		MaxItems:        aws.String("1"),
-		StartRecordName: aws.String(name),
-		StartRecordType: aws.String(rrType),
+		StartRecordName: aws.String(normalizeZoneName(name)),
+		StartRecordType: aws.String(strings.ToUpper(rrType)),
+	}
+	if setIdentifier != "" {
+		params.StartRecordIdentifier = aws.String(setIdentifier)
 	}
 
-	resp, err := c.Route53.ListResourceRecordSets(params)
+	var resp *route53.ListResourceRecordSetsOutput
+	err := c.retrier().Do("ListResourceRecordSets", func() error {
+		var err error
+		resp, err = c.Route53.ListResourceRecordSets(params)
+		return err
+	})
 	if err != nil {
 		return nil, fmt.Errorf("Error locating resource record: %v", err)
 	}
 
 	if len(resp.ResourceRecordSets) < 1 {
-		return nil, fmt.Errorf("Resource record set %s %s not found", name, rrType)
+		return nil, nil
 	}
 
-	return resp.ResourceRecordSets[0].ResourceRecords, nil
+	return resp.ResourceRecordSets[0], nil
 }
 
 // SendRoute53ChangeBatch sends the configured change batch to Route 53.
 // The function also waits for the batch to be fully synced before returning.
+//
+// Batches that exceed the Route 53 request limits are split into smaller
+// batches with splitChangeBatch. These are sent in order, each one being
+// synced before the next is sent. Each part is diffed against the current
+// record sets first, and the diff is logged, unless diffing is turned off.
 func (c *awsClient) SendRoute53ChangeBatch(zoneID string, batch []*route53.Change) error {
-	log.Printf("Sending Route53 change sets to zone ID: %s", zoneID)
+	chunks, err := splitChangeBatch(batch)
+	if err != nil {
+		return err
+	}
+
+	applied, accepted := 0, 0
+	for n, chunk := range chunks {
+		if len(chunks) > 1 {
+			c.logger().With("zone_id", zoneID).Infof("Sending change batch part %d of %d (%d changes)", n+1, len(chunks), len(chunk))
+		}
+		var diffs []rrSetDiff
+		var previous []*route53.ResourceRecordSet
+		if !c.noDiff {
+			diffs, previous, err = c.diffChanges(zoneID, chunk)
+			if err != nil {
+				c.logger().With("zone_id", zoneID).Warnf("Error reading current record sets, sending without a diff: %v", err)
+			}
+			for _, d := range diffs {
+				c.logger().With("zone_id", zoneID).Infof("Record diff: %s", d)
+			}
+		}
+
+		changeID, err := c.sendRoute53Changes(zoneID, chunk)
+		if err == nil {
+			applied += len(chunk)
+			accepted++
+			c.recordAudit(zoneID, changeID, chunk, previous, diffs)
+			metrics := c.metricsRecorder().With(dimensionZone, zoneID)
+			metrics.Count(metricChangeCount, len(chunk))
+
+			// Wait for the change to sync.
+			start := time.Now()
+			err = c.WaitForRoute53Sync(changeID)
+			if err == nil && c.changePoller().Wait {
+				metrics.Duration(metricSyncDuration, time.Since(start))
+			}
+		}
+		if err != nil {
+			if applied > 0 {
+				return &partialBatchError{err: err, applied: applied, parts: accepted, total: len(chunks)}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// partialBatchError is returned by SendRoute53ChangeBatch when a change batch
+// fails after some of it was accepted by Route 53. This includes a part
+// that was accepted but did not sync in time, as Route 53 applies it anyway.
+type partialBatchError struct {
+	err error
+
+	// The number of changes at the start of the batch that were accepted.
+	applied int
+
+	// The number of parts that were accepted, out of the total.
+	parts int
+	total int
+}
+
+// Error implements error for partialBatchError.
+func (e *partialBatchError) Error() string {
+	return fmt.Sprintf("%v (%d of %d parts of the change batch were already accepted)", e.err, e.parts, e.total)
+}
+
+// sendRoute53Changes sends a single change batch to Route 53, and returns
+// its change ID.
+func (c *awsClient) sendRoute53Changes(zoneID string, batch []*route53.Change) (string, error) {
+	c.logger().With("zone_id", zoneID).Infof("Sending Route53 change sets to zone ID: %s", zoneID)
 	params := &route53.ChangeResourceRecordSetsInput{
 		HostedZoneId: aws.String(zoneID),
 		ChangeBatch: &route53.ChangeBatch{
@@ -249,72 +841,44 @@ func (c *awsClient) SendRoute53ChangeBatch(zoneID string, batch []*route53.Chang
 		},
 	}
 
-	resp, err := c.Route53.ChangeResourceRecordSets(params)
+	var resp *route53.ChangeResourceRecordSetsOutput
+	err := c.retrier().Do("ChangeResourceRecordSets", func() error {
+		var err error
+		resp, err = c.Route53.ChangeResourceRecordSets(params)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("Error sending change batch: %v", err)
+		return "", &changeBatchError{err: err}
 	}
 
-	// Wait for the change to sync.
-	return c.WaitForRoute53Sync(*resp.ChangeInfo.Id)
+	return *resp.ChangeInfo.Id, nil
 }
 
-// WaitForRoute53Sync waits until a Route 53 change batch is INSYNC, taking
-// the change batch ID.
-//
-// This is a re-implmentation of route53.WaitUntilResourceRecordSetsChanged, with a
-// much shorter sleep interval (the AWS SDK version is 30 seconds).
-func (c *awsClient) WaitForRoute53Sync(changeID string) error {
-	log.Printf("Waiting for change ID %s to sync", changeID)
-
-	start := time.Now()
-
-	params := &route53.GetChangeInput{
-		Id: aws.String(changeID),
-	}
-
-	waiterCfg := waiter.Config{
-		Operation:   "GetChange",
-		Delay:       5,
-		MaxAttempts: 24,
-		Acceptors: []waiter.WaitAcceptor{
-			{
-				State:    "success",
-				Matcher:  "path",
-				Argument: "ChangeInfo.Status",
-				Expected: "INSYNC",
-			},
-		},
-	}
-
-	w := waiter.Waiter{
-		Client: c.Route53,
-		Input:  params,
-		Config: waiterCfg,
-	}
+// changeBatchError is returned by sendRoute53Changes when Route 53 rejects a
+// change batch. The original error is kept, so that callers can check its
+// code.
+type changeBatchError struct {
+	err error
+}
 
-	stop := make(chan bool)
-	go func() {
-		for {
-			select {
-			case <-stop:
-				return
-			default:
-				time.Sleep(time.Second * 5)
-				elapsed := time.Since(start)
-				log.Printf("Still waiting for change ID %s, elapsed time %fs", changeID, elapsed.Seconds())
-			}
-		}
-	}()
+// Error implements error for changeBatchError.
+func (e *changeBatchError) Error() string {
+	return fmt.Sprintf("Error sending change batch: %v", e.err)
+}
 
-	err := w.Wait()
-	stop <- true
-	return err
+// submitChanges sends a change batch to Route 53 and waits for it to sync,
+// going through the client's aggregator if one is set.
+func (c *awsClient) submitChanges(zoneID string, batch []*route53.Change) error {
+	if c.aggregator != nil {
+		return c.aggregator.Submit(zoneID, batch, c.event)
+	}
+	return c.SendRoute53ChangeBatch(zoneID, batch)
 }
 
 // CompleteAutoscalingAction sends the ABANDON or CONTINUE result to the
 // auto scaling lifecycle ID.
 func (c *awsClient) CompleteAutoscalingAction(messageData snsMessage, result string) error {
-	log.Printf("Sending result %s for action token %s", result, messageData.LifecycleActionToken)
+	c.logger().Infof("Sending result %s for action token %s", result, messageData.LifecycleActionToken)
 
 	params := &autoscaling.CompleteLifecycleActionInput{
 		AutoScalingGroupName:  aws.String(messageData.AutoScalingGroupName),
@@ -326,9 +890,16 @@ func (c *awsClient) CompleteAutoscalingAction(messageData snsMessage, result str
 
 	_, err := c.AutoScaling.CompleteLifecycleAction(params)
 	if err != nil {
-		log.Printf("Error performing autoscaling action: %v", err)
+		c.logger().Errorf("Error performing autoscaling action: %v", err)
+		return err
 	}
-	return err
+	switch result {
+	case "CONTINUE":
+		c.metricsRecorder().Count(metricContinueCount, 1)
+	case "ABANDON":
+		c.metricsRecorder().Count(metricAbandonCount, 1)
+	}
+	return nil
 }
 
 // instanceData represents the instance data available to be templated.
@@ -339,6 +910,13 @@ type instanceData struct {
 	// The route 53 hosted zone to operate on.
 	HostedZoneID string
 
+	// If set, returns the hosted zone ID for a record name. This is used in
+	// place of HostedZoneID when the zone is inferred from record names.
+	zoneFor func(name string) (string, error)
+
+	// The ID of the health check managed for the instance, if any.
+	HealthCheckID string
+
 	// The route 53 change batch we are operating on.
 	batch []*route53.Change
 
@@ -365,7 +943,7 @@ func populate(client *awsClient, instanceID, hostedZoneID string, batch []*route
 		return &data, err
 	}
 
-	log.Printf("Instance data returned: %#v", instance)
+	client.logger().Debugf("Instance data returned: %#v", instance)
 
 	data.InstanceID = instanceID
 
@@ -390,67 +968,116 @@ func populate(client *awsClient, instanceID, hostedZoneID string, batch []*route
 // This function returns an error if the resource record set does not exist,
 // or if the requested resource record index is out of range.
 func (d *instanceData) ExistingRDataValue(rrSetIndex, rDataIndex int) (string, error) {
-	if len(d.batch)-1 < rrSetIndex {
+	if rrSetIndex < 0 || len(d.batch)-1 < rrSetIndex || d.batch[rrSetIndex].ResourceRecordSet == nil {
 		return "", fmt.Errorf("Requested rrSet index of %d out of range", rrSetIndex)
 	}
 	rrSet := d.batch[rrSetIndex]
-	rData, err := d.client.FindRoute53ResourceRecord(d.HostedZoneID, *rrSet.ResourceRecordSet.Name, *rrSet.ResourceRecordSet.Type)
+	zoneID := d.HostedZoneID
+	if d.zoneFor != nil {
+		var err error
+		if zoneID, err = d.zoneFor(aws.StringValue(rrSet.ResourceRecordSet.Name)); err != nil {
+			return "", err
+		}
+	}
+	rData, err := d.client.FindRoute53ResourceRecord(zoneID, aws.StringValue(rrSet.ResourceRecordSet.Name), aws.StringValue(rrSet.ResourceRecordSet.Type), aws.StringValue(rrSet.ResourceRecordSet.SetIdentifier))
 	if err != nil {
 		return "", err
 	}
-	if len(rData)-1 < rDataIndex {
+	if rDataIndex < 0 || len(rData)-1 < rDataIndex {
 		return "", fmt.Errorf("Requested rDataIndex index of %d out of range", rDataIndex)
 	}
 	rDataItem := rData[rDataIndex]
-	return *rDataItem.Value, nil
+	return aws.StringValue(rDataItem.Value), nil
 }
 
 // WriteTemplateFields iterates through all the
 // items in the batch, and writes out template fields in
-// ResourceRecordSet.Name and all fields in ResourceRecordSet.Records.
+// ResourceRecordSet.Name, ResourceRecordSet.HealthCheckId,
+// ResourceRecordSet.AliasTarget.DNSName, and all fields in
+// ResourceRecordSet.Records.
 func (d *instanceData) WriteTemplateFields() error {
-	log.Println("Writing template values for change batch")
+	d.client.logger().Infof("Writing template values for change batch")
 	for n, rrSet := range d.batch {
-		nameRendered := &bytes.Buffer{}
 		valuesRendered := []string{}
+		if rrSet == nil || rrSet.ResourceRecordSet == nil {
+			return fmt.Errorf("RR Set #%d has no ResourceRecordSet", n)
+		}
 
-		nameTemplate, err := template.New(fmt.Sprintf("RR Set #%d .Name", n)).Parse(*rrSet.ResourceRecordSet.Name)
+		nameRendered, err := d.render(fmt.Sprintf("RR Set #%d .Name", n), aws.StringValue(rrSet.ResourceRecordSet.Name))
 		if err != nil {
 			return err
 		}
-		if err := nameTemplate.Execute(nameRendered, d); err != nil {
-			return err
-		}
 
-		rrSet.ResourceRecordSet.Name = aws.String(nameRendered.String())
+		rrSet.ResourceRecordSet.Name = aws.String(nameRendered)
 
 		for x, resourceRecord := range rrSet.ResourceRecordSet.ResourceRecords {
-			valueRendered := &bytes.Buffer{}
-			valueTemplate, err := template.New(fmt.Sprintf("RR Set #%d .Records.Value #%d", n, x)).Parse(*resourceRecord.Value)
+			if resourceRecord == nil {
+				return fmt.Errorf("RR Set #%d .Records.Value #%d is missing", n, x)
+			}
+			valueRendered, err := d.render(fmt.Sprintf("RR Set #%d .Records.Value #%d", n, x), aws.StringValue(resourceRecord.Value))
+			if err != nil {
+				return err
+			}
+			resourceRecord.Value = aws.String(valueRendered)
+			valuesRendered = append(valuesRendered, valueRendered)
+		}
 
+		if rrSet.ResourceRecordSet.HealthCheckId != nil {
+			healthCheckRendered, err := d.render(fmt.Sprintf("RR Set #%d .HealthCheckId", n), *rrSet.ResourceRecordSet.HealthCheckId)
 			if err != nil {
 				return err
 			}
-			if err := valueTemplate.Execute(valueRendered, d); err != nil {
+			rrSet.ResourceRecordSet.HealthCheckId = aws.String(healthCheckRendered)
+		}
+
+		if alias := rrSet.ResourceRecordSet.AliasTarget; alias != nil && alias.DNSName != nil {
+			aliasRendered, err := d.render(fmt.Sprintf("RR Set #%d .AliasTarget.DNSName", n), *alias.DNSName)
+			if err != nil {
 				return err
 			}
-			resourceRecord.Value = aws.String(valueRendered.String())
-			valuesRendered = append(valuesRendered, valueRendered.String())
+			alias.DNSName = aws.String(aliasRendered)
+			valuesRendered = append(valuesRendered, "ALIAS "+aliasRendered)
 		}
 
-		log.Printf("Record written: %s %d %s %s", nameRendered.String(), *rrSet.ResourceRecordSet.TTL, *rrSet.ResourceRecordSet.Type, strings.Join(valuesRendered, ","))
+		d.client.logger().Infof("Record written: %s %d %s %s", nameRendered, aws.Int64Value(rrSet.ResourceRecordSet.TTL), aws.StringValue(rrSet.ResourceRecordSet.Type), strings.Join(valuesRendered, ","))
 	}
 	return nil
 }
 
+// funcs returns the functions available to templates rendered with d, on
+// top of the text/template builtins. d can be nil when the functions are
+// only needed for parsing.
+func (d *instanceData) funcs() template.FuncMap {
+	return template.FuncMap{
+		"existing":      d.existing,
+		"existingValue": d.existingValue,
+		"existingTTL":   d.existingTTL,
+	}
+}
+
+// render parses text as a template with the supplied name, and executes it
+// with d as its data.
+func (d *instanceData) render(name, text string) (string, error) {
+	rendered := &bytes.Buffer{}
+	tmpl, err := template.New(name).Funcs(d.funcs()).Parse(text)
+	if err == nil {
+		err = tmpl.Execute(rendered, d)
+	}
+	if err != nil {
+		d.client.metricsRecorder().With(dimensionZone, d.HostedZoneID).Count(metricTemplateErrors, 1)
+		return "", err
+	}
+	return rendered.String(), nil
+}
+
 // parseOuterEvent parses the outer event that comes in from AWS Lambda and
 // converts it into an eventNotification. This then needs to be further
 // parsed to get the inner SNS message, and from there, the metadata.
 func parseOuterEvent(raw []byte) (eventNotification, error) {
-	log.Printf("Raw event JSON data: %s", string(raw))
+	defaultLogger.Debugf("Raw event JSON data: %s", string(raw))
 	parsed := eventNotification{}
 	if err := json.Unmarshal(raw, &parsed); err != nil {
-		log.Printf("Error parsing event JSON: %v", err)
+		defaultLogger.Errorf("Error parsing event JSON: %v", err)
 		return parsed, err
 	}
 	return parsed, nil
@@ -460,10 +1087,10 @@ func parseOuterEvent(raw []byte) (eventNotification, error) {
 // AWS Lambda event. A snsMessage is returned. The metadata is a string value
 // and needs to be further parsed from this return data.
 func parseInnerSNSMessage(raw []byte) (snsMessage, error) {
-	log.Printf("Raw SNS message JSON data: %s", string(raw))
+	defaultLogger.Debugf("Raw SNS message JSON data: %s", string(raw))
 	parsed := snsMessage{}
 	if err := json.Unmarshal(raw, &parsed); err != nil {
-		log.Printf("Error parsing SNS message JSON: %v", err)
+		defaultLogger.Errorf("Error parsing SNS message JSON: %v", err)
 		return parsed, err
 	}
 	return parsed, nil
@@ -472,10 +1099,14 @@ func parseInnerSNSMessage(raw []byte) (snsMessage, error) {
 // parseSNSMetadata parses the inner SNS message's metadata into the
 // function's Route 53 ID, changes, and other parameters.
 func parseSNSMetadata(raw []byte) (messageArgs, error) {
-	log.Printf("Raw metadata JSON data: %s", string(raw))
+	defaultLogger.Debugf("Raw metadata JSON data: %s", string(raw))
 	parsed := messageArgs{}
-	if err := json.Unmarshal(raw, &parsed); err != nil {
-		log.Printf("Error parsing metadata JSON: %v", err)
+	if err := decodeStrict(raw, &parsed); err != nil {
+		defaultLogger.Errorf("Error parsing metadata JSON: %v", err)
+		return parsed, err
+	}
+	if err := validateMessageArgs(parsed); err != nil {
+		defaultLogger.Errorf("Error in metadata: %v", err)
 		return parsed, err
 	}
 	return parsed, nil
@@ -484,30 +1115,42 @@ func parseSNSMetadata(raw []byte) (messageArgs, error) {
 // parseFullEvent parses the event, inner SNS message, and the metadata to
 // return the relevant structs.
 func parseFullEvent(raw []byte) (snsMessage, messageArgs, error) {
-	parsedEvent := eventNotification{}
-	parsedMessage := snsMessage{}
-	parsedMetadata := messageArgs{}
-	var err error
-
-	parsedEvent, err = parseOuterEvent(raw)
+	parsedEvent, err := parseOuterEvent(raw)
 	if err != nil {
-		return parsedMessage, parsedMetadata, err
+		return snsMessage{}, messageArgs{}, err
 	}
 
 	if len(parsedEvent.Records) < 1 {
-		return parsedMessage, parsedMetadata, errors.New("Parsed event contains no records")
+		return snsMessage{}, messageArgs{}, errors.New("Parsed event contains no records")
 	}
 
-	parsedMessage, err = parseInnerSNSMessage([]byte(parsedEvent.Records[0].Sns.Message))
+	return parseMessage([]byte(parsedEvent.Records[0].Sns.Message))
+}
+
+// parseMessage parses the inner SNS message and its metadata to return the
+// relevant structs. This is shared by all of the ways that a message can be
+// delivered to the function.
+func parseMessage(raw []byte) (snsMessage, messageArgs, error) {
+	parsedMessage := snsMessage{}
+	parsedMetadata := messageArgs{}
+	var err error
+
+	parsedMessage, err = parseInnerSNSMessage(raw)
 	if err != nil {
 		return parsedMessage, parsedMetadata, err
 	}
 
-	if parsedMessage.Event == "autoscaling:TEST_NOTIFICATION" {
+	if parsedMessage.Event == eventTestNotification {
 		// This is a test notification and will not have any metadata - return now.
 		return parsedMessage, parsedMetadata, nil
 	}
 
+	if parsedMessage.isNotification() {
+		// Plain notifications do not carry metadata either - this needs to be
+		// loaded from the config source.
+		return parsedMessage, parsedMetadata, nil
+	}
+
 	parsedMetadata, err = parseSNSMetadata([]byte(parsedMessage.NotificationMetadata))
 	if err != nil {
 		return parsedMessage, parsedMetadata, err
@@ -516,58 +1159,366 @@ func parseFullEvent(raw []byte) (snsMessage, messageArgs, error) {
 	return parsedMessage, parsedMetadata, nil
 }
 
-// handle is our handler function for Lambda.
+// notificationArgs loads the messageArgs for a plain auto scaling
+// notification from the config source, keyed by the auto scaling group name.
+func notificationArgs(message snsMessage) (messageArgs, error) {
+	src, err := loadConfigSource()
+	if err != nil {
+		return messageArgs{}, err
+	}
+	cfg, err := src.Lookup(message.AutoScalingGroupName)
+	if err != nil {
+		return messageArgs{}, err
+	}
+	return cfg.argsFor(message.transition())
+}
+
+// renderChanges selects the change batch for the supplied lifecycle
+// transition from args, and renders its templates with the data for the
+// supplied instance ID. If the batch needs to be inverted, this is done after
+// rendering. Alias targets are completed with completeAliasTargets. The
+// rendered batch is returned.
+func renderChanges(client *awsClient, instanceID string, args zoneArgs, transition, healthCheckID string) ([]*route53.Change, error) {
+	changes, invert := args.changesFor(transition)
+
+	data, err := populate(client, instanceID, args.HostedZoneID, changes)
+	if err != nil {
+		client.logger().With("zone_id", args.HostedZoneID).Errorf("Error fetching instance information: %v", err)
+		return nil, err
+	}
+	data.HealthCheckID = healthCheckID
+
+	if err := data.WriteTemplateFields(); err != nil {
+		client.logger().With("zone_id", args.HostedZoneID).Errorf("Error writing template values: %v", err)
+		return nil, err
+	}
+
+	if invert {
+		changes, err = client.inverseChanges(args.HostedZoneID, changes, args.Inverse)
+		if err != nil {
+			client.logger().With("zone_id", args.HostedZoneID).Errorf("Error inverting launch changes: %v", err)
+			return nil, err
+		}
+	}
+
+	if err := client.completeAliasTargets(args.HostedZoneID, changes); err != nil {
+		client.logger().With("zone_id", args.HostedZoneID).Errorf("Error completing alias targets: %v", err)
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// renderZoneBatches renders the change batches for every hosted zone in
+// args with renderChanges, resolving zones supplied by name first. Zones that
+// are inferred from record names are rendered with renderInferredBatches.
+// SRV pool members are rendered with renderSRVMembers, and sent along with
+// the batch for their zone. Batches for the same zone are merged, and zones
+// with no changes for the transition are left out.
+//
+// Zones with a RoleARN are resolved, rendered, and sent with a client that
+// makes its Route 53 calls as that role.
+func renderZoneBatches(client *awsClient, instanceID string, args messageArgs, transition, healthCheckID string) ([]zoneBatch, error) {
+	resolvers := make(map[*awsClient]*hostedZoneResolver)
+	rendered := []zoneBatch{}
+	for _, zone := range args.zones() {
+		zoneClient, err := client.forRole(zone.RoleARN, zone.ExternalID)
+		if err != nil {
+			return nil, err
+		}
+		resolver, ok := resolvers[zoneClient]
+		if !ok {
+			resolver = newHostedZoneResolver(zoneClient)
+			resolvers[zoneClient] = resolver
+		}
+
+		inferred := zone.InferHostedZone && zone.HostedZoneID == "" && zone.HostedZoneName == ""
+		if inferred {
+			inferredBatches, err := renderInferredBatches(zoneClient, resolver, instanceID, zone, transition, healthCheckID)
+			if err != nil {
+				return nil, err
+			}
+			rendered = append(rendered, inferredBatches...)
+		} else {
+			zoneID, err := resolver.resolve(zone)
+			if err != nil {
+				return nil, err
+			}
+			zone.HostedZoneID = zoneID
+			changes, err := renderChanges(zoneClient, instanceID, zone, transition, healthCheckID)
+			if err != nil {
+				return nil, err
+			}
+			rendered = append(rendered, zoneBatch{ZoneID: zoneID, Changes: changes, client: zoneClient})
+		}
+
+		updates, err := renderSRVMembers(zoneClient, instanceID, zone, transition)
+		if err != nil {
+			return nil, err
+		}
+		for _, update := range updates {
+			zoneID := zone.HostedZoneID
+			if inferred {
+				if zoneID, err = resolver.infer(update.Name, zone); err != nil {
+					return nil, err
+				}
+			}
+			rendered = append(rendered, zoneBatch{ZoneID: zoneID, client: zoneClient, pools: []*srvPoolUpdate{update}})
+		}
+	}
+
+	batches := []zoneBatch{}
+	index := make(map[string]int)
+	for _, batch := range rendered {
+		if len(batch.Changes) < 1 && len(batch.pools) < 1 {
+			continue
+		}
+		if n, ok := index[batch.ZoneID]; ok {
+			batches[n].Changes = append(batches[n].Changes, batch.Changes...)
+			batches[n].pools = append(batches[n].pools, batch.pools...)
+			continue
+		}
+		index[batch.ZoneID] = len(batches)
+		batches = append(batches, batch)
+	}
+	return batches, nil
+}
+
+// handleEvent is the entry point for events delivered through Lambda.
+// Retries of Route 53 API calls are bounded by the supplied deadline, which
+// should be the Lambda function's deadline. Every log line for the event
+// carries the supplied request ID.
+//
+// EC2 instance state-change events are handled separately by
+// handleStateChange. Everything else is treated as an SNS event, and its
+// message is handed off to processMessage.
+func handleEvent(evt []byte, deadline time.Time, requestID string) error {
+	logger := defaultLogger.With("request_id", requestID)
+	logger.Infof("asg53 starting.")
+
+	if stateEvt, ok := parseStateChangeEvent(evt); ok {
+		client, err := newAWSClient()
+		if err != nil {
+			logger.Errorf("Error loading AWS client: %v", err)
+			return err
+		}
+		client.retry = newRetryPolicy(deadline)
+		client.log = logger
+		client.event.RequestID = requestID
+		cancel := client.bindDeadline(deadline)
+		defer cancel()
+		return handleStateChange(client, stateEvt)
+	}
+
+	message, args, err := parseFullEvent(evt)
+	if err != nil {
+		return err
+	}
+
+	client, err := newAWSClient()
+	if err != nil {
+		logger.Errorf("Error loading AWS client: %v", err)
+		return err
+	}
+	client.retry = newRetryPolicy(deadline)
+	client.log = logger
+	client.event.RequestID = requestID
+	cancel := client.bindDeadline(deadline)
+	defer cancel()
+
+	err = processMessage(client, message, args)
+	if _, ok := err.(*lifecycleActionError); ok {
+		// The change batch has already been sent at this point, so don't
+		// let Lambda retry the event.
+		return nil
+	}
+	return err
+}
+
+// lifecycleActionError is returned by processMessage when the change batch
+// was processed, but the lifecycle action could not be completed.
+type lifecycleActionError struct {
+	// The lifecycle action result that was being sent.
+	result string
+
+	// The underlying error.
+	err error
+}
+
+// Error implements error for lifecycleActionError.
+func (e *lifecycleActionError) Error() string {
+	return fmt.Sprintf("Error completing lifecycle action with result %s: %v", e.result, e.err)
+}
+
+// completeAction sends the lifecycle action result for message, wrapping
+// any error in a lifecycleActionError.
+func completeAction(client *awsClient, message snsMessage, result string) error {
+	if err := client.CompleteAutoscalingAction(message, result); err != nil {
+		return &lifecycleActionError{result: result, err: err}
+	}
+	return nil
+}
+
+// processMessage runs a parsed SNS message through the pipeline: loading
+// configuration, rendering the change batch, sending it to Route 53, and
+// completing the lifecycle action.
 //
 // Depending on the reasons for erroring out, we need to not return an error
 // from the function so that Lambda doesn't try running it again. This is
 // generally after records may have been written (so after sending the change
 // batch, and sending the final CONTINUE action). Test notifications are also
 // dropped on the floor.
-func handle(evt json.RawMessage, ctx *runtime.Context) (interface{}, error) {
-	log.Println("asg53 starting.")
+//
+// Plain auto scaling notifications are processed the same way as lifecycle
+// hooks, with the exception that their arguments are loaded from the config
+// source, and no lifecycle action is completed.
+//
+// If the lifecycle action cannot be completed, a *lifecycleActionError is
+// returned. Callers that can retry the whole message safely, such as the
+// queue worker, can use this to decide whether or not to keep the message.
+func processMessage(client *awsClient, message snsMessage, args messageArgs) error {
+	client = client.forEvent(message.AutoScalingGroupName, message.EC2InstanceID, message.LifecycleHookName)
+	if message.Event == eventTestNotification {
+		client.logger().Infof("This is a test notification - ignoring and exiting.")
+		return nil
+	}
 
-	message, args, err := parseFullEvent(evt)
-	if err != nil {
-		return nil, err
+	if message.isNotification() {
+		var err error
+		args, err = notificationArgs(message)
+		if err != nil {
+			client.logger().Errorf("Error loading configuration for notification: %v", err)
+			return err
+		}
 	}
 
-	client, err := newAWSClient()
+	client.logger().Infof("Event triggered for %s:%s:%s", message.AutoScalingGroupName, message.EC2InstanceID, message.LifecycleHookName)
+
+	err := runInstanceChanges(client, message.EC2InstanceID, args, message.transition())
+	if _, notSent := err.(*changesNotSentError); notSent {
+		if !message.isNotification() {
+			return completeActionOrNotify(client, message, "ABANDON", args.NotifyOnFailure)
+		}
+		return nil
+	}
 	if err != nil {
-		log.Printf("Error loading AWS client: %v", err)
-		return nil, err
+		return err
 	}
 
-	if message.Event == "autoscaling:TEST_NOTIFICATION" {
-		log.Println("This is a test notification - ignoring and exiting.")
-		return nil, nil
+	if message.isNotification() {
+		client.logger().Infof("Completed Route 53 action for notification")
+		return nil
 	}
 
-	log.Printf("Event triggered for %s:%s:%s", message.AutoScalingGroupName, message.EC2InstanceID, message.LifecycleHookName)
+	client.logger().Infof("Completed Route 53 action, sending continue event")
+	return completeActionOrNotify(client, message, "CONTINUE", args.NotifyOnFailure)
+}
+
+// changesNotSentError is returned by runInstanceChanges when the changes for
+// an instance were rendered, but could not be sent. The error has already
+// been logged and reported.
+type changesNotSentError struct {
+	err error
+}
+
+// Error implements error for changesNotSentError.
+func (e *changesNotSentError) Error() string {
+	return e.err.Error()
+}
+
+// runInstanceChanges renders the changes for the instance with the sync
+// settings in args, and sends them with applyInstanceChanges, or plans them
+// with planDryRun in a dry run. This is the part of the pipeline that is
+// shared by lifecycle hooks, notifications, and state-change events.
+//
+// Failures are reported to args.NotifyOnFailure. If the changes could not be
+// sent, a *changesNotSentError is returned.
+func runInstanceChanges(client *awsClient, instanceID string, args messageArgs, transition string) error {
+	syncClient, err := client.withSync(args.Wait, args.Sync)
+	if err != nil {
+		client.logger().Errorf("Error in sync settings: %v", err)
+		client.notifyFailure(args.NotifyOnFailure, failureStageConfig, transition, err, nil)
+		return err
+	}
+	client = syncClient
 
-	data, err := populate(client, message.EC2InstanceID, args.HostedZoneID, args.Changes)
+	batches, hc, err := renderInstanceChanges(client, instanceID, args, transition)
 	if err != nil {
-		log.Printf("Error fetching instance information: %v", err)
-		return nil, err
+		client.notifyFailure(args.NotifyOnFailure, failureStageRender, transition, err, nil)
+		return err
 	}
 
-	if err := data.WriteTemplateFields(); err != nil {
-		log.Printf("Error writing template values: %v", err)
-		return nil, err
+	if args.DryRun {
+		return client.planDryRun(batches)
+	}
+	if len(batches) < 1 && hc == nil {
+		client.logger().Infof("No changes to send for transition %q", transition)
+		return nil
+	}
+	if err := client.applyInstanceChanges(batches, hc); err != nil {
+		client.logger().Errorf("Error sending change batch to Route 53: %v", err)
+		client.notifyFailure(args.NotifyOnFailure, failureStageApply, transition, err, batches)
+		return &changesNotSentError{err: err}
 	}
+	return nil
+}
 
-	if err := client.SendRoute53ChangeBatch(args.HostedZoneID, args.Changes); err != nil {
-		log.Printf("Error sending change batch to Route 53: %v", err)
-		client.CompleteAutoscalingAction(message, "ABANDON")
-		return nil, nil
+// completeActionOrNotify completes the lifecycle action with completeAction,
+// and sends a failure report to target if that fails.
+func completeActionOrNotify(client *awsClient, message snsMessage, result, target string) error {
+	err := completeAction(client, message, result)
+	if err != nil {
+		client.notifyFailure(target, failureStageComplete, message.transition(), err, nil)
 	}
+	return err
+}
+
+// usageError is returned by a command when its options are invalid. asg53
+// exits with status 2 for these, as it does for an unknown command.
+type usageError struct {
+	err error
+}
 
-	log.Printf("Completed Route 53 action, sending continue event")
-	client.CompleteAutoscalingAction(message, "CONTINUE")
-	return nil, nil
+// Error implements error for usageError.
+func (e *usageError) Error() string {
+	return e.err.Error()
 }
 
-func init() {
-	runtime.HandleFunc(handle)
+// commands is the list of commands available when asg53 is run as a
+// standalone binary.
+var commands = map[string]func(args []string) error{
+	"server":  runServer,
+	"worker":  runWorker,
+	"history": runHistory,
+	"plan":    runPlan,
 }
 
-func main() {}
+// usage is printed when asg53 is run as a standalone binary without a valid
+// command.
+const usage = `Usage: asg53 <command> [options]
+
+Commands:
+    server    Run an HTTP(S) server that receives SNS notifications
+    worker    Run a worker that long-polls an SQS queue for lifecycle messages
+    history   Show the audit trail of changes to a resource record set
+    plan      Show the changes that hook metadata would make for an instance
+`
+
+// main is only called when asg53 is run as a standalone binary. When loaded
+// as a Lambda function, the handler is registered in init instead, and this
+// is never reached.
+func main() {
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err := commands[os.Args[1]](os.Args[2:]); err != nil {
+		if _, ok := err.(*usageError); ok {
+			fmt.Fprintf(os.Stderr, "asg53 %s: %v\n", os.Args[1], err)
+			os.Exit(2)
+		}
+		defaultLogger.Errorf("Error running %s: %v", os.Args[1], err)
+		os.Exit(1)
+	}
+}
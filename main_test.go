@@ -7,6 +7,7 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/service/route53"
 	"github.com/paybyphone/asg53/teststubs"
 )
 
@@ -22,6 +23,20 @@ const testMessageJSON = `
 }
 `
 
+// testNotificationEventJSON is a test Lambda event containing a plain auto
+// scaling launch notification.
+const testNotificationEventJSON = `
+{
+  "Records": [
+    {
+      "Sns": {
+        "Message": "{\"Event\":\"autoscaling:EC2_INSTANCE_LAUNCH\",\"EC2InstanceId\":\"i-123456789\",\"AutoScalingGroupName\":\"ASGName\",\"Details\":{\"Subnet ID\":\"subnet-12345678\",\"Availability Zone\":\"us-west-2a\"}}"
+      }
+    }
+  ]
+}
+`
+
 // testMetadataJSON is a test SNS message in JSON form. The outer event is not
 // currently mocked.
 const testMetadataJSON = `
@@ -65,6 +80,7 @@ func testAwsClient() *awsClient {
 	client.EC2 = teststubs.CreateTestEC2InstanceMock()
 	client.AutoScaling = teststubs.CreateTestAutoScalingMock()
 	client.Route53 = teststubs.CreateTestRoute53Mock()
+	client.metrics = newMetricsRecorder(&captureMetricsSink{})
 
 	return &client
 }
@@ -201,6 +217,139 @@ func TestPopulate(t *testing.T) {
 	}
 }
 
+func TestFindRoute53ResourceRecordSet(t *testing.T) {
+	client := testAwsClient()
+
+	rrSet, err := client.FindRoute53ResourceRecordSet("ABCDEF0123456789", "www.example.com.", "CNAME", "")
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	if *rrSet.TTL != 3600 {
+		t.Fatalf("Expected TTL to be 3600, got %d", *rrSet.TTL)
+	}
+	if *rrSet.ResourceRecords[0].Value != "i-123456789.example.com." {
+		t.Fatalf("Expected value to be i-123456789.example.com., got %s", *rrSet.ResourceRecords[0].Value)
+	}
+}
+
+func TestFindRoute53ResourceRecordSet_shouldError(t *testing.T) {
+	client := testAwsClient()
+
+	if _, err := client.FindRoute53ResourceRecordSet("bad", "www.example.com.", "CNAME", ""); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+}
+
+func TestFindRoute53ResourceRecordSet_exactMatch(t *testing.T) {
+	client := testAwsClient()
+
+	cases := []struct {
+		name, rrType, setIdentifier string
+		expected                    string
+	}{
+		{"i-123456789.example.com.", "A", "", "54.0.0.1"},
+		{"I-123456789.Example.COM", "a", "", "54.0.0.1"},
+		{"*.example.com.", "A", "", "54.0.0.100"},
+		{"\\052.example.com.", "A", "", "54.0.0.100"},
+		{"weighted.example.com.", "A", "green", "54.0.0.3"},
+		{"weighted.example.com.", "A", "blue", "54.0.0.2"},
+		{"missing.example.com.", "A", "", ""},
+		{"www.example.com.", "A", "", ""},
+		{"weighted.example.com.", "A", "", ""},
+		{"weighted.example.com.", "A", "red", ""},
+		{"zzz.example.com.", "A", "", ""},
+	}
+	for _, tc := range cases {
+		rrSet, err := client.FindRoute53ResourceRecordSet("ABCDEF0123456789", tc.name, tc.rrType, tc.setIdentifier)
+		if tc.expected == "" {
+			if !isRRSetNotFound(err) {
+				t.Fatalf("%s %s [%s]: expected not found error, got %v", tc.name, tc.rrType, tc.setIdentifier, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s %s [%s]: bad: %v", tc.name, tc.rrType, tc.setIdentifier, err)
+		}
+		if *rrSet.ResourceRecords[0].Value != tc.expected {
+			t.Fatalf("%s %s [%s]: expected value %s, got %s", tc.name, tc.rrType, tc.setIdentifier, tc.expected, *rrSet.ResourceRecords[0].Value)
+		}
+	}
+}
+
+func TestCanonicalRRName(t *testing.T) {
+	cases := map[string]string{
+		"WWW.Example.com":    "www.example.com.",
+		"\\052.example.com.": "*.example.com.",
+		"a\\.b.example.com.": "a.b.example.com.",
+		"trailing\\":         "trailing\\.",
+		"\\999.example.com.": "999.example.com.",
+		"*.example.com.":     "*.example.com.",
+	}
+	for name, expected := range cases {
+		if actual := canonicalRRName(name); actual != expected {
+			t.Errorf("Expected canonicalRRName(%q) to be %q, got %q", name, expected, actual)
+		}
+	}
+}
+
+func TestChangesFor(t *testing.T) {
+	launch := []*route53.Change{&route53.Change{}}
+	terminate := []*route53.Change{&route53.Change{}, &route53.Change{}}
+	changes := []*route53.Change{&route53.Change{}, &route53.Change{}, &route53.Change{}}
+
+	cases := []struct {
+		Args       zoneArgs
+		Transition string
+		Expected   []*route53.Change
+		Invert     bool
+	}{
+		{zoneArgs{Changes: changes}, transitionLaunch, changes, false},
+		{zoneArgs{Changes: changes}, transitionTerminate, changes, false},
+		{zoneArgs{Changes: changes}, "", changes, false},
+		{zoneArgs{OnLaunch: launch, OnTerminate: terminate}, transitionLaunch, launch, false},
+		{zoneArgs{OnLaunch: launch, OnTerminate: terminate}, transitionTerminate, terminate, false},
+		{zoneArgs{OnLaunch: launch, Inverse: inverseExisting}, transitionTerminate, launch, true},
+		{zoneArgs{Changes: changes, Inverse: inverseExisting}, transitionTerminate, changes, true},
+		{zoneArgs{OnLaunch: launch, OnTerminate: terminate, Inverse: inverseExisting}, transitionTerminate, terminate, false},
+	}
+
+	for i, tc := range cases {
+		actual, invert := tc.Args.changesFor(tc.Transition)
+		if len(actual) != len(tc.Expected) || invert != tc.Invert {
+			t.Fatalf("Case %d: expected %d changes (invert %t), got %d (invert %t)", i, len(tc.Expected), tc.Invert, len(actual), invert)
+		}
+	}
+}
+
+func TestExistingRDataValue(t *testing.T) {
+	metadata, err := parseSNSMetadata([]byte(testMetadataJSON))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+
+	client := testAwsClient()
+	data, err := populate(client, "i-123456789", metadata.HostedZoneID, metadata.Changes)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	value, err := data.ExistingRDataValue(1, 0)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if value != "i-123456789.example.com." {
+		t.Fatalf("Expected value to be i-123456789.example.com., got %s", value)
+	}
+
+	if _, err := data.ExistingRDataValue(2, 0); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+	if _, err := data.ExistingRDataValue(1, 1); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+}
+
 func TestWriteTemplateFields(t *testing.T) {
 	message, err := parseInnerSNSMessage([]byte(testMessageJSON))
 	if err != nil {
@@ -236,6 +385,81 @@ func TestWriteTemplateFields(t *testing.T) {
 	}
 }
 
+func TestParseFullEvent_notification(t *testing.T) {
+	message, args, err := parseFullEvent([]byte(testNotificationEventJSON))
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	if !message.isNotification() {
+		t.Fatal("Expected message to be a notification")
+	}
+	if message.transition() != transitionLaunch {
+		t.Fatalf("Expected transition to be %s, got %s", transitionLaunch, message.transition())
+	}
+	if message.EC2InstanceID != "i-123456789" {
+		t.Fatalf("Expected EC2InstanceID to be i-123456789, got %s", message.EC2InstanceID)
+	}
+	if message.Details["Availability Zone"] != "us-west-2a" {
+		t.Fatalf("Expected Details[\"Availability Zone\"] to be us-west-2a, got %s", message.Details["Availability Zone"])
+	}
+	if len(args.Changes) != 0 {
+		t.Fatalf("Expected no changes from notification, got %d", len(args.Changes))
+	}
+}
+
+func TestProcessMessage_lifecycleActionError(t *testing.T) {
+	message, err := parseInnerSNSMessage([]byte(testMessageJSON))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+	message.LifecycleTransition = transitionLaunch
+	args, err := parseSNSMetadata([]byte(testMetadataJSON))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+
+	client := testAwsClient()
+	if err := processMessage(client, message, args); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	// Sending a bad token (which fails in the stub) should be reported as a
+	// lifecycleActionError.
+	message.LifecycleActionToken = "bad"
+	args, _ = parseSNSMetadata([]byte(testMetadataJSON))
+	err = processMessage(client, message, args)
+	if _, ok := err.(*lifecycleActionError); !ok {
+		t.Fatalf("Expected *lifecycleActionError, got %#v", err)
+	}
+}
+
+func TestRunInstanceChanges(t *testing.T) {
+	args, err := parseSNSMetadata([]byte(testMetadataJSON))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+	client := testAwsClient()
+	if err := runInstanceChanges(client, "i-123456789", args, transitionLaunch); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	// A batch that Route 53 rejects is reported as not sent, so that callers
+	// can decide what to do with the event.
+	args.HostedZoneID = "bad"
+	err = runInstanceChanges(client, "i-123456789", args, transitionLaunch)
+	if _, ok := err.(*changesNotSentError); !ok {
+		t.Fatalf("Expected *changesNotSentError, got %#v", err)
+	}
+
+	// Errors before anything is sent are returned as they are.
+	args.Sync = &syncConfig{MaxWait: "-1s"}
+	err = runInstanceChanges(client, "i-123456789", args, transitionLaunch)
+	if _, ok := err.(*changesNotSentError); ok || err == nil {
+		t.Fatalf("Expected sync settings error, got %#v", err)
+	}
+}
+
 func TestMain(m *testing.M) {
 	log.SetOutput(os.Stderr)
 	os.Exit(m.Run())
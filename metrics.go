@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// metricsNamespaceEnvVar is the environment variable that sets the
+// CloudWatch namespace metrics are published to.
+const metricsNamespaceEnvVar = "ASG53_METRICS_NAMESPACE"
+
+// defaultMetricsNamespace is the CloudWatch namespace metrics are published
+// to when ASG53_METRICS_NAMESPACE is not set.
+const defaultMetricsNamespace = "asg53"
+
+// Metric names.
+const (
+	// The time taken for a change batch to sync, after it was sent.
+	metricSyncDuration = "SyncDuration"
+
+	// The number of changes sent to Route 53.
+	metricChangeCount = "ChangeCount"
+
+	// The number of lifecycle actions completed with CONTINUE and ABANDON.
+	metricContinueCount = "ContinueCount"
+	metricAbandonCount  = "AbandonCount"
+
+	// The number of templates that failed to parse or render.
+	metricTemplateErrors = "TemplateErrors"
+
+	// The number of Route 53 API calls retried after a retryable error.
+	metricRetryCount = "RetryCount"
+)
+
+// Metric dimension names.
+const (
+	dimensionASG  = "AutoScalingGroupName"
+	dimensionZone = "HostedZoneId"
+)
+
+// Metric units, as understood by CloudWatch.
+const (
+	unitCount        = "Count"
+	unitMilliseconds = "Milliseconds"
+)
+
+// metricDimension is a dimension that a metric is published with.
+type metricDimension struct {
+	Name  string
+	Value string
+}
+
+// metricDatum is a single metric value.
+type metricDatum struct {
+	// The name of the metric.
+	Name string
+
+	// The CloudWatch unit of the value.
+	Unit string
+
+	// The value.
+	Value float64
+
+	// The dimensions of the value, in order.
+	Dimensions []metricDimension
+}
+
+// metricsSink receives metric values. Tests can supply their own sink to
+// capture the values that are published.
+type metricsSink interface {
+	Put(d metricDatum)
+}
+
+// emfSink writes metric values as CloudWatch Embedded Metric Format (EMF)
+// log lines. Under Lambda, lines written to stdout end up in CloudWatch
+// Logs, which extracts the metrics from them, so publishing does not need
+// any API calls.
+type emfSink struct {
+	// The writer lines are written to, and the lock that serializes writes.
+	mu sync.Mutex
+	w  io.Writer
+
+	// The CloudWatch namespace of the metrics.
+	namespace string
+
+	// The function that returns the timestamp for each line.
+	now func() time.Time
+}
+
+// newEMFSink returns an emfSink that writes to w, with metrics in the
+// supplied namespace.
+func newEMFSink(w io.Writer, namespace string) *emfSink {
+	return &emfSink{w: w, namespace: namespace, now: time.Now}
+}
+
+// emfMetric is the definition of a metric in an EMF line.
+type emfMetric struct {
+	Name string
+	Unit string
+}
+
+// emfDirective tells CloudWatch which members of an EMF line are metrics,
+// and which are their dimensions.
+type emfDirective struct {
+	Namespace  string
+	Dimensions [][]string
+	Metrics    []emfMetric
+}
+
+// emfMetadata is the _aws member of an EMF line.
+type emfMetadata struct {
+	Timestamp         int64
+	CloudWatchMetrics []emfDirective
+}
+
+// Put implements metricsSink for emfSink. Each value is written as its own
+// line.
+func (s *emfSink) Put(d metricDatum) {
+	names := []string{}
+	line := map[string]interface{}{}
+	for _, dim := range d.Dimensions {
+		names = append(names, dim.Name)
+		line[dim.Name] = dim.Value
+	}
+	line[d.Name] = d.Value
+	line["_aws"] = emfMetadata{
+		Timestamp: s.now().UnixNano() / int64(time.Millisecond),
+		CloudWatchMetrics: []emfDirective{
+			{
+				Namespace:  s.namespace,
+				Dimensions: [][]string{names},
+				Metrics:    []emfMetric{{Name: d.Name, Unit: d.Unit}},
+			},
+		},
+	}
+
+	raw, err := json.Marshal(line)
+	if err != nil {
+		defaultLogger.Errorf("Error encoding metric %s: %v", d.Name, err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.Write(append(raw, '\n'))
+}
+
+// metricsRecorder publishes metric values to a sink, with the dimensions
+// attached to it with With, such as the auto scaling group name and hosted
+// zone ID.
+type metricsRecorder struct {
+	sink       metricsSink
+	dimensions []metricDimension
+}
+
+// newMetricsRecorder returns a metricsRecorder that publishes to sink.
+func newMetricsRecorder(sink metricsSink) *metricsRecorder {
+	return &metricsRecorder{sink: sink}
+}
+
+// loadMetricsRecorder returns a metricsRecorder that writes EMF lines to
+// stdout, in the namespace set in ASG53_METRICS_NAMESPACE, or asg53 if it is
+// not set.
+func loadMetricsRecorder() *metricsRecorder {
+	namespace := os.Getenv(metricsNamespaceEnvVar)
+	if namespace == "" {
+		namespace = defaultMetricsNamespace
+	}
+	return newMetricsRecorder(newEMFSink(os.Stdout, namespace))
+}
+
+// defaultMetrics is the metrics recorder used where no more specific
+// recorder is available.
+var defaultMetrics = loadMetricsRecorder()
+
+// With returns a metricsRecorder that adds the supplied dimension to every
+// value, on top of the dimensions of m. Empty values are left out. An
+// existing dimension with the same name is replaced.
+func (m *metricsRecorder) With(name, value string) *metricsRecorder {
+	if value == "" {
+		return m
+	}
+	dimensions := []metricDimension{}
+	for _, d := range m.dimensions {
+		if d.Name != name {
+			dimensions = append(dimensions, d)
+		}
+	}
+	return &metricsRecorder{sink: m.sink, dimensions: append(dimensions, metricDimension{Name: name, Value: value})}
+}
+
+// Count publishes a count.
+func (m *metricsRecorder) Count(name string, n int) {
+	m.sink.Put(metricDatum{Name: name, Unit: unitCount, Value: float64(n), Dimensions: m.dimensions})
+}
+
+// Duration publishes a duration, in milliseconds.
+func (m *metricsRecorder) Duration(name string, d time.Duration) {
+	m.sink.Put(metricDatum{Name: name, Unit: unitMilliseconds, Value: float64(d) / float64(time.Millisecond), Dimensions: m.dimensions})
+}
+
+// metricsRecorder returns the client's metrics recorder. c can be nil.
+func (c *awsClient) metricsRecorder() *metricsRecorder {
+	if c == nil || c.metrics == nil {
+		return defaultMetrics
+	}
+	return c.metrics
+}
+
+// withMetrics returns a copy of c that publishes metrics with the dimension
+// name set to value, on top of the dimensions c already publishes with.
+func (c *awsClient) withMetrics(name, value string) *awsClient {
+	client := *c
+	client.metrics = c.metricsRecorder().With(name, value)
+	return &client
+}
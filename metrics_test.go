@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureMetricsSink is a metricsSink that keeps the values published to it.
+type captureMetricsSink struct {
+	mu     sync.Mutex
+	values []metricDatum
+}
+
+// Put implements metricsSink for captureMetricsSink.
+func (s *captureMetricsSink) Put(d metricDatum) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values = append(s.values, d)
+}
+
+// named returns the captured values with the supplied metric name.
+func (s *captureMetricsSink) named(name string) []metricDatum {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := []metricDatum{}
+	for _, d := range s.values {
+		if d.Name == name {
+			values = append(values, d)
+		}
+	}
+	return values
+}
+
+func TestEMFSinkPut(t *testing.T) {
+	buf := &bytes.Buffer{}
+	sink := newEMFSink(buf, "asg53")
+	sink.now = func() time.Time { return time.Unix(1478001600, 0) }
+	newMetricsRecorder(sink).With(dimensionASG, "my-asg").With(dimensionZone, "ABCDEF0123456789").Count(metricChangeCount, 3)
+
+	expected := `{"AutoScalingGroupName":"my-asg","ChangeCount":3,"HostedZoneId":"ABCDEF0123456789",` +
+		`"_aws":{"Timestamp":1478001600000,"CloudWatchMetrics":[{"Namespace":"asg53","Dimensions":[["AutoScalingGroupName","HostedZoneId"]],"Metrics":[{"Name":"ChangeCount","Unit":"Count"}]}]}}` + "\n"
+	if buf.String() != expected {
+		t.Fatalf("Expected %s, got %s", expected, buf.String())
+	}
+	if err := json.Unmarshal(buf.Bytes(), &map[string]interface{}{}); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+}
+
+func TestMetricsRecorderWith(t *testing.T) {
+	base := newMetricsRecorder(&captureMetricsSink{}).With(dimensionZone, "ABCDEF0123456789")
+	m := base.With(dimensionASG, "").With(dimensionZone, "0123456789ABCDEF")
+
+	expected := []metricDimension{{Name: dimensionZone, Value: "0123456789ABCDEF"}}
+	if !reflect.DeepEqual(expected, m.dimensions) {
+		t.Fatalf("Expected dimensions %v, got %v", expected, m.dimensions)
+	}
+	if base.dimensions[0].Value != "ABCDEF0123456789" {
+		t.Fatalf("Expected base recorder to be unchanged, got %v", base.dimensions)
+	}
+}
+
+func TestProcessMessage_metrics(t *testing.T) {
+	message, err := parseInnerSNSMessage([]byte(testMessageJSON))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+	message.LifecycleTransition = transitionLaunch
+	args, err := parseSNSMetadata([]byte(testMetadataJSON))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+
+	sink := &captureMetricsSink{}
+	client := testAwsClient()
+	client.metrics = newMetricsRecorder(sink)
+	if err := processMessage(client, message, args); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	changes := sink.named(metricChangeCount)
+	if len(changes) != 1 || changes[0].Value != float64(len(args.Changes)) {
+		t.Fatalf("Expected one ChangeCount of %d, got %v", len(args.Changes), changes)
+	}
+	expected := []metricDimension{
+		{Name: dimensionASG, Value: message.AutoScalingGroupName},
+		{Name: dimensionZone, Value: args.HostedZoneID},
+	}
+	if !reflect.DeepEqual(expected, changes[0].Dimensions) {
+		t.Fatalf("Expected dimensions %v, got %v", expected, changes[0].Dimensions)
+	}
+	if len(sink.named(metricSyncDuration)) != 1 {
+		t.Fatalf("Expected one SyncDuration, got %v", sink.values)
+	}
+	if len(sink.named(metricContinueCount)) != 1 || len(sink.named(metricAbandonCount)) != 0 {
+		t.Fatalf("Expected one ContinueCount and no AbandonCount, got %v", sink.values)
+	}
+}
+
+func TestInstanceDataRender_templateErrorMetric(t *testing.T) {
+	sink := &captureMetricsSink{}
+	client := testAwsClient()
+	client.metrics = newMetricsRecorder(sink)
+	data := &instanceData{client: client, HostedZoneID: "ABCDEF0123456789"}
+
+	if _, err := data.render("bad", "{{.NoSuchField}}"); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+	if errs := sink.named(metricTemplateErrors); len(errs) != 1 || errs[0].Dimensions[0].Value != "ABCDEF0123456789" {
+		t.Fatalf("Expected one TemplateErrors value for the zone, got %v", sink.values)
+	}
+}
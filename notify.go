@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// The pipeline stages that a failure report can be sent for.
+const (
+	// Loading or validating the settings for the event.
+	failureStageConfig = "config"
+
+	// Rendering the change batches.
+	failureStageRender = "render"
+
+	// Sending the change batches to Route 53. Lifecycle hooks are abandoned
+	// after a failure in this stage.
+	failureStageApply = "apply"
+
+	// Completing the lifecycle action.
+	failureStageComplete = "complete"
+)
+
+// webhookTimeout is the timeout for failure report webhook requests.
+const webhookTimeout = time.Second * 10
+
+// failureInstance holds the details of the instance in a failure report.
+type failureInstance struct {
+	InstanceID       string
+	InstanceType     string `json:",omitempty"`
+	AvailabilityZone string `json:",omitempty"`
+	PrivateIPAddress string `json:",omitempty"`
+	PublicIPAddress  string `json:",omitempty"`
+}
+
+// failureBatch is a rendered change batch in a failure report.
+type failureBatch struct {
+	HostedZoneID string
+	Changes      []*route53.Change
+}
+
+// failureReport is the structured report sent to the NotifyOnFailure target
+// when an event fails.
+type failureReport struct {
+	// The time of the failure.
+	Time time.Time
+
+	// The pipeline stage that failed, and the error.
+	Stage string
+	Error string
+
+	// The event that failed.
+	RequestID            string `json:",omitempty"`
+	AutoScalingGroupName string `json:",omitempty"`
+	LifecycleHookName    string `json:",omitempty"`
+	Transition           string
+
+	// The instance the event was for. Only the instance ID is set if the
+	// instance could not be described.
+	Instance failureInstance
+
+	// The rendered change batches, if rendering got that far.
+	Batches []failureBatch `json:",omitempty"`
+}
+
+// subject returns a short summary of the report, such as for the subject of
+// an SNS message.
+func (r *failureReport) subject() string {
+	subject := fmt.Sprintf("asg53 %s failure for %s", r.Stage, r.Instance.InstanceID)
+	if r.AutoScalingGroupName != "" {
+		subject += " in " + r.AutoScalingGroupName
+	}
+	// SNS subjects are limited to 100 characters.
+	if len(subject) > 100 {
+		subject = subject[:100]
+	}
+	return subject
+}
+
+// failureNotifier delivers failure reports.
+type failureNotifier interface {
+	Notify(report *failureReport) error
+}
+
+// webhookNotifier is a failureNotifier that POSTs reports as JSON to a URL.
+type webhookNotifier struct {
+	// The URL to POST to.
+	url string
+
+	// The HTTP client.
+	client *http.Client
+}
+
+// Notify implements failureNotifier for webhookNotifier. Any response status
+// other than 2xx is an error.
+func (n *webhookNotifier) Notify(report *failureReport) error {
+	raw, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webhook %s returned %s", n.url, resp.Status)
+	}
+	return nil
+}
+
+// snsNotifier is a failureNotifier that publishes reports as JSON to an SNS
+// topic.
+type snsNotifier struct {
+	// The SNS client.
+	sns *snsClient
+
+	// The topic ARN.
+	topicARN string
+}
+
+// Notify implements failureNotifier for snsNotifier.
+func (n *snsNotifier) Notify(report *failureReport) error {
+	raw, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = n.sns.Publish(n.topicARN, report.subject(), string(raw))
+	return err
+}
+
+// newFailureNotifier returns the failureNotifier for a NotifyOnFailure
+// target, which is either an SNS topic ARN, or an HTTPS webhook URL. SNS
+// topics are published to in the topic's region, using the supplied config
+// provider (usually a session). Webhooks are POSTed to with httpClient, or a
+// client with webhookTimeout if it is nil. Plain HTTP webhooks are rejected,
+// as failure reports carry instance details.
+func newFailureNotifier(p client.ConfigProvider, httpClient *http.Client, target string) (failureNotifier, error) {
+	if strings.HasPrefix(target, "arn:") {
+		parts := strings.Split(target, ":")
+		if len(parts) != 6 || parts[2] != "sns" {
+			return nil, fmt.Errorf("NotifyOnFailure %q is not an SNS topic ARN", target)
+		}
+		if p == nil {
+			return nil, fmt.Errorf("Cannot publish to %s: client does not support SNS", target)
+		}
+		return &snsNotifier{sns: newSNSClient(p, &aws.Config{Region: aws.String(parts[3])}), topicARN: target}, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return nil, fmt.Errorf("NotifyOnFailure %q is not an SNS topic ARN or webhook URL", target)
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("NotifyOnFailure %q must be an https URL", target)
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: webhookTimeout}
+	}
+	return &webhookNotifier{url: target, client: httpClient}, nil
+}
+
+// failureBatches returns the rendered change batches for a failure report.
+func failureBatches(batches []zoneBatch) []failureBatch {
+	reported := []failureBatch{}
+	for _, b := range batches {
+		reported = append(reported, failureBatch{HostedZoneID: b.ZoneID, Changes: b.Changes})
+	}
+	return reported
+}
+
+// notifyFailure sends a failure report for the event the client is
+// processing to target, if it is set. The instance is described for the
+// report, if possible. Errors sending the report are logged rather than
+// returned, so that they do not hide the original failure.
+func (c *awsClient) notifyFailure(target, stage, transition string, failure error, batches []zoneBatch) {
+	if target == "" {
+		return
+	}
+
+	report := &failureReport{
+		Time:                 time.Now().UTC(),
+		Stage:                stage,
+		Error:                failure.Error(),
+		RequestID:            c.event.RequestID,
+		AutoScalingGroupName: c.event.AutoScalingGroupName,
+		LifecycleHookName:    c.event.LifecycleHookName,
+		Transition:           transition,
+		Instance:             failureInstance{InstanceID: c.event.InstanceID},
+		Batches:              failureBatches(batches),
+	}
+	if instance, err := c.FetchEC2InstanceData(c.event.InstanceID); err == nil {
+		report.Instance.InstanceType = aws.StringValue(instance.InstanceType)
+		report.Instance.PrivateIPAddress = aws.StringValue(instance.PrivateIpAddress)
+		report.Instance.PublicIPAddress = aws.StringValue(instance.PublicIpAddress)
+		if instance.Placement != nil {
+			report.Instance.AvailabilityZone = aws.StringValue(instance.Placement.AvailabilityZone)
+		}
+	}
+
+	var p client.ConfigProvider
+	if c.session != nil {
+		p = c.session
+	}
+	notifier, err := newFailureNotifier(p, c.webhookClient, target)
+	if err == nil {
+		c.logger().Infof("Sending %s failure report to %s", stage, target)
+		err = notifier.Notify(report)
+	}
+	if err != nil {
+		c.logger().Errorf("Error sending failure report: %v", err)
+	}
+}
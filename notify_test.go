@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// testWebhook returns a TLS test server that records the failure reports POSTed
+// to it, responding with the supplied status.
+func testWebhook(reports *[]failureReport, status int) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := failureReport{}
+		if err := json.NewDecoder(r.Body).Decode(&report); err == nil {
+			*reports = append(*reports, report)
+		}
+		w.WriteHeader(status)
+	}))
+}
+
+func TestProcessMessage_notifyOnFailure(t *testing.T) {
+	reports := []failureReport{}
+	ts := testWebhook(&reports, http.StatusOK)
+	defer ts.Close()
+
+	message, err := parseInnerSNSMessage([]byte(testMessageJSON))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+	message.LifecycleTransition = transitionLaunch
+	args, err := parseSNSMetadata([]byte(testMetadataJSON))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+	args.HostedZoneID = "bad"
+	args.NotifyOnFailure = ts.URL
+
+	client := testAwsClient()
+	client.webhookClient = ts.Client()
+	if err := processMessage(client, message, args); err != nil {
+		t.Fatalf("Expected the hook to be abandoned without error, got %v", err)
+	}
+
+	if len(reports) != 1 {
+		t.Fatalf("Expected 1 failure report, got %d", len(reports))
+	}
+	report := reports[0]
+	if report.Stage != failureStageApply || report.Error == "" || report.Transition != transitionLaunch {
+		t.Fatalf("Unexpected failure report: %#v", report)
+	}
+	if report.AutoScalingGroupName != message.AutoScalingGroupName || report.LifecycleHookName != message.LifecycleHookName {
+		t.Fatalf("Expected event details in failure report, got %#v", report)
+	}
+	if report.Instance.InstanceID != message.EC2InstanceID || report.Instance.PublicIPAddress == "" {
+		t.Fatalf("Expected instance details in failure report, got %#v", report.Instance)
+	}
+	if len(report.Batches) != 1 || report.Batches[0].HostedZoneID != "bad" || len(report.Batches[0].Changes) != len(args.Changes) {
+		t.Fatalf("Expected rendered batch in failure report, got %#v", report.Batches)
+	}
+	if name := aws.StringValue(report.Batches[0].Changes[0].ResourceRecordSet.Name); name != "i-123456789.example.com." {
+		t.Fatalf("Expected rendered record name, got %s", name)
+	}
+}
+
+func TestWebhookNotifier_shouldError(t *testing.T) {
+	reports := []failureReport{}
+	ts := testWebhook(&reports, http.StatusInternalServerError)
+	defer ts.Close()
+
+	n, err := newFailureNotifier(nil, ts.Client(), ts.URL)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if err := n.Notify(&failureReport{Stage: failureStageRender}); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+}
+
+func TestSNSNotifier(t *testing.T) {
+	form := map[string]string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		for _, key := range []string{"Action", "TopicArn", "Subject", "Message"} {
+			form[key] = r.Form.Get(key)
+		}
+		fmt.Fprint(w, "<PublishResponse><PublishResult><MessageId>message-1</MessageId></PublishResult></PublishResponse>")
+	}))
+	defer ts.Close()
+
+	sess := session.New(&aws.Config{
+		Endpoint:    aws.String(ts.URL),
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+	})
+	topicARN := "arn:aws:sns:us-west-2:123456789012:asg53-failures"
+	n, err := newFailureNotifier(sess, nil, topicARN)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if region := aws.StringValue(n.(*snsNotifier).sns.Config.Region); region != "us-west-2" {
+		t.Fatalf("Expected topic region us-west-2, got %s", region)
+	}
+
+	report := &failureReport{Stage: failureStageApply, AutoScalingGroupName: "ASGName", Instance: failureInstance{InstanceID: "i-123456789"}}
+	if err := n.Notify(report); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if form["Action"] != "Publish" || form["TopicArn"] != topicARN || form["Subject"] != "asg53 apply failure for i-123456789 in ASGName" {
+		t.Fatalf("Unexpected Publish request: %v", form)
+	}
+	parsed := failureReport{}
+	if err := json.Unmarshal([]byte(form["Message"]), &parsed); err != nil || parsed.Stage != failureStageApply {
+		t.Fatalf("Expected failure report as message, got %s (%v)", form["Message"], err)
+	}
+}
+
+func TestNewFailureNotifier_invalid(t *testing.T) {
+	for _, target := range []string{"arn:aws:sqs:us-west-2:123456789012:queue", "ftp://example.com/hook", "http://example.com/hook", "not a target"} {
+		if _, err := newFailureNotifier(nil, nil, target); err == nil {
+			t.Fatalf("Expected error for %q, got none", target)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// Environment variables that configure the change policy. If neither is set,
+// hooks can make any change.
+const (
+	// The policy document, as JSON.
+	policyEnvVar = "ASG53_POLICY"
+
+	// The name of an SSM parameter holding the policy document. SecureString
+	// parameters are decrypted.
+	policySSMParameterEnvVar = "ASG53_POLICY_SSM_PARAMETER"
+)
+
+// policyDefaultGroup is the key in changePolicy.Groups for the name patterns
+// of auto scaling groups that do not have their own entry. It also applies
+// to events that do not come from an auto scaling group, such as instance
+// state-change events.
+const policyDefaultGroup = "*"
+
+// groupPolicy holds the policy for the hooks of an auto scaling group.
+type groupPolicy struct {
+	// The resource record set names the group can change. A pattern such as
+	// "web.example.com." matches that name and any name under it. A pattern
+	// such as "*.web.example.com." only matches names under it.
+	NamePatterns []string
+}
+
+// changePolicy is the policy document that restricts the changes hooks can
+// send to Route 53. It is set by the operator of the function, rather than in
+// the hook metadata, so that a hook cannot change records it does not own.
+//
+// Empty lists allow anything.
+type changePolicy struct {
+	// The hosted zone IDs that changes can be sent to.
+	AllowedZoneIDs []string
+
+	// The resource record set types that can be changed.
+	AllowedTypes []string
+
+	// The change actions that cannot be used, such as DELETE.
+	ForbiddenActions []string
+
+	// The policy for each auto scaling group, keyed on group name. If set,
+	// groups without an entry (and without a "*" entry) cannot change any
+	// records.
+	Groups map[string]groupPolicy
+}
+
+// policyError is returned when rendered changes violate the change policy.
+type policyError struct {
+	violations []string
+}
+
+// Error implements error for policyError.
+func (e *policyError) Error() string {
+	return fmt.Sprintf("Changes violate the change policy: %s", strings.Join(e.violations, "; "))
+}
+
+// parseChangePolicy parses a policy document. Unknown fields, and actions,
+// types, zone IDs, and name patterns that are empty or invalid, are errors,
+// so that a mistake in the policy does not silently allow changes.
+func parseChangePolicy(raw []byte) (*changePolicy, error) {
+	p := &changePolicy{}
+	if err := decodeStrict(raw, p); err != nil {
+		return nil, fmt.Errorf("Error parsing change policy: %v", err)
+	}
+	errs := schemaErrors{}
+	p.validate(&errs)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("Error in change policy: %v", errs)
+	}
+	return p, nil
+}
+
+// validate adds the problems with p to errs.
+func (p *changePolicy) validate(errs *schemaErrors) {
+	for i, id := range p.AllowedZoneIDs {
+		if trimHostedZoneID(id) == "" {
+			errs.add(fmt.Sprintf("$.AllowedZoneIDs[%d]", i), "cannot be empty")
+		}
+	}
+	for i, rrType := range p.AllowedTypes {
+		if !containsFold(validRRTypes, rrType) {
+			errs.add(fmt.Sprintf("$.AllowedTypes[%d]", i), "must be one of %s", strings.Join(validRRTypes, ", "))
+		}
+	}
+	for i, action := range p.ForbiddenActions {
+		if !containsFold(validChangeActions, action) {
+			errs.add(fmt.Sprintf("$.ForbiddenActions[%d]", i), "must be one of %s", strings.Join(validChangeActions, ", "))
+		}
+	}
+
+	groups := []string{}
+	for group := range p.Groups {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		for i, pattern := range p.Groups[group].NamePatterns {
+			path := fmt.Sprintf("$.Groups[%q].NamePatterns[%d]", group, i)
+			switch {
+			case normalizeZoneName(strings.TrimPrefix(pattern, "*.")) == ".":
+				errs.add(path, "cannot be empty")
+			case strings.Contains(strings.TrimPrefix(pattern, "*."), "*"):
+				errs.add(path, "invalid pattern %q: wildcards are only allowed as the first label", pattern)
+			}
+		}
+	}
+}
+
+// loadChangePolicy returns the change policy configured in the environment,
+// using the supplied config provider for SSM. nil is returned if no policy is
+// configured.
+func loadChangePolicy(p client.ConfigProvider) (*changePolicy, error) {
+	inline := os.Getenv(policyEnvVar)
+	param := os.Getenv(policySSMParameterEnvVar)
+	switch {
+	case inline != "" && param != "":
+		return nil, fmt.Errorf("Only one of %s and %s can be set", policyEnvVar, policySSMParameterEnvVar)
+	case inline != "":
+		return parseChangePolicy([]byte(inline))
+	case param != "":
+		value, err := newSSMClient(p).GetParameter(param)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading change policy from SSM parameter %s: %v", param, err)
+		}
+		return parseChangePolicy([]byte(value))
+	}
+	return nil, nil
+}
+
+// policyNameMatches returns true if name matches pattern. See groupPolicy
+// for the pattern syntax.
+func policyNameMatches(name, pattern string) bool {
+	name = normalizeZoneName(name)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(name, "."+normalizeZoneName(strings.TrimPrefix(pattern, "*.")))
+	}
+	return zoneNameMatches(name, normalizeZoneName(pattern))
+}
+
+// containsFold returns true if list contains s, ignoring case.
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRecord returns the violations for a change to the resource record set
+// with the supplied name and type in zoneID, by the hooks of asgName.
+func (p *changePolicy) checkRecord(asgName, zoneID, name, rrType string) []string {
+	violations := []string{}
+	if len(p.AllowedZoneIDs) > 0 {
+		allowed := false
+		for _, id := range p.AllowedZoneIDs {
+			if trimHostedZoneID(id) == trimHostedZoneID(zoneID) {
+				allowed = true
+			}
+		}
+		if !allowed {
+			violations = append(violations, fmt.Sprintf("%s %s: hosted zone ID %s is not allowed", name, rrType, zoneID))
+		}
+	}
+	if len(p.AllowedTypes) > 0 && !containsFold(p.AllowedTypes, rrType) {
+		violations = append(violations, fmt.Sprintf("%s %s: record type %s is not allowed", name, rrType, rrType))
+	}
+	if p.Groups != nil {
+		gp, ok := p.Groups[asgName]
+		if !ok {
+			gp, ok = p.Groups[policyDefaultGroup]
+		}
+		matched := false
+		for _, pattern := range gp.NamePatterns {
+			if policyNameMatches(name, pattern) {
+				matched = true
+			}
+		}
+		switch {
+		case !ok:
+			violations = append(violations, fmt.Sprintf("%s %s: auto scaling group %q has no allowed names", name, rrType, asgName))
+		case !matched:
+			violations = append(violations, fmt.Sprintf("%s %s: name is not allowed for auto scaling group %q", name, rrType, asgName))
+		}
+	}
+	return violations
+}
+
+// check returns a *policyError if any of the changes in batches, including
+// SRV pool updates, are not allowed for the hooks of asgName. nil is returned
+// if p is nil.
+func (p *changePolicy) check(asgName string, batches []zoneBatch) error {
+	if p == nil {
+		return nil
+	}
+	violations := []string{}
+	for _, b := range batches {
+		for _, change := range b.Changes {
+			rrSet := change.ResourceRecordSet
+			name := aws.StringValue(rrSet.Name)
+			rrType := aws.StringValue(rrSet.Type)
+			if action := aws.StringValue(change.Action); containsFold(p.ForbiddenActions, action) {
+				violations = append(violations, fmt.Sprintf("%s %s: action %s is forbidden", name, rrType, action))
+			}
+			violations = append(violations, p.checkRecord(asgName, b.ZoneID, name, rrType)...)
+		}
+		// The actions for pool updates are worked out when the batch is sent,
+		// and only ever maintain the pool, so only the record is checked.
+		for _, pool := range b.pools {
+			violations = append(violations, p.checkRecord(asgName, b.ZoneID, pool.Name, route53.RRTypeSrv)...)
+		}
+	}
+	if len(violations) > 0 {
+		return &policyError{violations: violations}
+	}
+	return nil
+}
+
+// checkPolicy checks batches against the client's change policy, for the
+// auto scaling group of the event being processed.
+func (c *awsClient) checkPolicy(batches []zoneBatch) error {
+	return c.policy.check(c.event.AutoScalingGroupName, batches)
+}
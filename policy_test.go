@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/paybyphone/asg53/teststubs"
+)
+
+// testPolicyJSON is a test change policy document.
+const testPolicyJSON = `
+{
+  "AllowedZoneIDs": ["/hostedzone/ABCDEF0123456789"],
+  "AllowedTypes": ["A", "SRV"],
+  "ForbiddenActions": ["DELETE"],
+  "Groups": {
+    "web": {"NamePatterns": ["*.example.com."]},
+    "*": {"NamePatterns": ["default.example.com."]}
+  }
+}
+`
+
+// testPolicy returns the test change policy.
+func testPolicy() *changePolicy {
+	p, err := parseChangePolicy([]byte(testPolicyJSON))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+	return p
+}
+
+// testPolicyChange returns a change for the supplied action, name, and type.
+func testPolicyChange(action, name, rrType string) *route53.Change {
+	return &route53.Change{
+		Action:            aws.String(action),
+		ResourceRecordSet: &route53.ResourceRecordSet{Name: aws.String(name), Type: aws.String(rrType)},
+	}
+}
+
+func TestParseChangePolicy_badPattern(t *testing.T) {
+	_, err := parseChangePolicy([]byte(`{"Groups": {"web": {"NamePatterns": ["www.*.example.com."]}}}`))
+	if err == nil || !strings.Contains(err.Error(), "www.*.example.com.") {
+		t.Fatalf("Expected error for bad pattern, got %v", err)
+	}
+}
+
+func TestParseChangePolicy_invalid(t *testing.T) {
+	cases := []struct {
+		raw      string
+		expected string
+	}{
+		{`{"AllowedZoneIds": ["ABCDEF0123456789"]}`, `$: unknown field "AllowedZoneIds" (did you mean "AllowedZoneIDs"?)`},
+		{`{"Groups": {"web": {"NamePattern": ["www.example.com."]}}}`, `$.Groups["web"]: unknown field "NamePattern"`},
+		{`{"AllowedZoneIDs": ["/hostedzone/"]}`, `$.AllowedZoneIDs[0]: cannot be empty`},
+		{`{"AllowedTypes": ["A", ""]}`, `$.AllowedTypes[1]: must be one of`},
+		{`{"AllowedTypes": ["ALIAS"]}`, `$.AllowedTypes[0]: must be one of`},
+		{`{"ForbiddenActions": ["REMOVE"]}`, `$.ForbiddenActions[0]: must be one of`},
+		{`{"ForbiddenActions": [""]}`, `$.ForbiddenActions[0]: must be one of`},
+		{`{"Groups": {"web": {"NamePatterns": ["*."]}}}`, `$.Groups["web"].NamePatterns[0]: cannot be empty`},
+	}
+	for _, tc := range cases {
+		if _, err := parseChangePolicy([]byte(tc.raw)); err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("parseChangePolicy(%s): expected error containing %q, got %v", tc.raw, tc.expected, err)
+		}
+	}
+
+	if _, err := parseChangePolicy([]byte(`{"AllowedTypes": ["a", "srv"], "ForbiddenActions": ["delete"]}`)); err != nil {
+		t.Fatalf("Expected types and actions to be matched regardless of case, got %v", err)
+	}
+}
+
+func TestPolicyNameMatches(t *testing.T) {
+	cases := []struct {
+		name, pattern string
+		expected      bool
+	}{
+		{"web.example.com.", "web.example.com.", true},
+		{"i-1.web.example.com", "web.example.com.", true},
+		{"I-1.Web.Example.Com.", "web.example.com", true},
+		{"badweb.example.com.", "web.example.com.", false},
+		{"web.example.com.", "*.web.example.com.", false},
+		{"i-1.web.example.com.", "*.web.example.com.", true},
+	}
+	for _, tc := range cases {
+		if actual := policyNameMatches(tc.name, tc.pattern); actual != tc.expected {
+			t.Errorf("Expected policyNameMatches(%q, %q) to be %t", tc.name, tc.pattern, tc.expected)
+		}
+	}
+}
+
+func TestChangePolicyCheck(t *testing.T) {
+	p := testPolicy()
+	allowed := []zoneBatch{{
+		ZoneID:  "ABCDEF0123456789",
+		Changes: []*route53.Change{testPolicyChange("UPSERT", "i-1.example.com.", "A")},
+		pools:   []*srvPoolUpdate{{Name: "_app._tcp.example.com."}},
+	}}
+	if err := p.check("web", allowed); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	denied := []zoneBatch{
+		{
+			ZoneID: "ABCDEF0123456789",
+			Changes: []*route53.Change{
+				testPolicyChange("DELETE", "i-1.example.com.", "A"),
+				testPolicyChange("UPSERT", "example.com.", "A"),
+				testPolicyChange("UPSERT", "i-1.example.com.", "TXT"),
+			},
+		},
+		{ZoneID: "OTHERZONE", Changes: []*route53.Change{testPolicyChange("UPSERT", "i-1.example.com.", "A")}},
+	}
+	err := p.check("web", denied)
+	perr, ok := err.(*policyError)
+	if !ok {
+		t.Fatalf("Expected *policyError, got %v", err)
+	}
+	expected := []string{
+		"i-1.example.com. A: action DELETE is forbidden",
+		"example.com. A: name is not allowed for auto scaling group \"web\"",
+		"i-1.example.com. TXT: record type TXT is not allowed",
+		"i-1.example.com. A: hosted zone ID OTHERZONE is not allowed",
+	}
+	if strings.Join(perr.violations, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected violations:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(perr.violations, "\n"))
+	}
+}
+
+func TestChangePolicyCheck_groups(t *testing.T) {
+	p := testPolicy()
+	batches := []zoneBatch{{ZoneID: "ABCDEF0123456789", Changes: []*route53.Change{testPolicyChange("UPSERT", "default.example.com.", "A")}}}
+	if err := p.check("other", batches); err != nil {
+		t.Fatalf("Expected default group to apply, got %v", err)
+	}
+
+	delete(p.Groups, policyDefaultGroup)
+	if err := p.check("other", batches); err == nil || !strings.Contains(err.Error(), "has no allowed names") {
+		t.Fatalf("Expected group without entry to be denied, got %v", err)
+	}
+
+	var nilPolicy *changePolicy
+	if err := nilPolicy.check("other", batches); err != nil {
+		t.Fatalf("Expected nil policy to allow changes, got %v", err)
+	}
+}
+
+func TestApplyInstanceChanges_policyViolation(t *testing.T) {
+	defer teststubs.ResetRoute53HealthChecks()
+	defer teststubs.ResetRoute53ChangeLog()
+	teststubs.ResetRoute53HealthChecks()
+	teststubs.ResetRoute53ChangeLog()
+	client := testAwsClient().forEvent("web", "i-123456789", "hook")
+	client.policy = testPolicy()
+	client.policy.AllowedTypes = []string{"CNAME"}
+
+	batches, hc, err := renderInstanceChanges(client, "i-123456789", testHealthCheckMetadata("ABCDEF0123456789"), transitionLaunch)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if err := client.applyInstanceChanges(batches, hc); err == nil || !strings.Contains(err.Error(), "record type A is not allowed") {
+		t.Fatalf("Expected policy violation, got %v", err)
+	}
+	if len(teststubs.Route53ChangeLog()) != 0 {
+		t.Fatal("Expected no changes to be sent")
+	}
+	if len(teststubs.Route53HealthChecks()) != 0 {
+		t.Fatal("Expected health check to be deleted after policy violation")
+	}
+}
+
+func TestLoadChangePolicy_ssm(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		input := ssmGetParameterInput{}
+		json.NewDecoder(r.Body).Decode(&input)
+		if r.Header.Get("X-Amz-Target") != "AmazonSSM.GetParameter" || !input.WithDecryption {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if input.Name != "/asg53/policy" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"__type": "ParameterNotFound", "message": "no such parameter"}`)
+			return
+		}
+		raw, _ := json.Marshal(ssmGetParameterOutput{Parameter: ssmParameter{Name: input.Name, Type: "SecureString", Value: testPolicyJSON}})
+		w.Write(raw)
+	}))
+	defer ts.Close()
+	sess := session.New(&aws.Config{
+		Endpoint:    aws.String(ts.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+	})
+
+	defer os.Unsetenv(policySSMParameterEnvVar)
+	os.Setenv(policySSMParameterEnvVar, "/asg53/policy")
+	p, err := loadChangePolicy(sess)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if len(p.Groups["web"].NamePatterns) != 1 || p.ForbiddenActions[0] != "DELETE" {
+		t.Fatalf("Unexpected policy: %#v", p)
+	}
+
+	os.Setenv(policySSMParameterEnvVar, "/asg53/missing")
+	if _, err := loadChangePolicy(sess); err == nil || !strings.Contains(err.Error(), "ParameterNotFound") {
+		t.Fatalf("Expected ParameterNotFound error, got %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// Change poller defaults. These match the policy of the waiter that the
+// poller replaces: a GetChange call every 5 seconds, for up to 2 minutes.
+const (
+	defaultSyncInitialDelay = time.Second * 5
+	defaultSyncBackoff      = 1.0
+	defaultSyncMaxDelay     = time.Second * 30
+	defaultSyncMaxWait      = time.Minute * 2
+)
+
+// Environment variables that override the change poller defaults for every
+// event. Durations are in Go duration format, such as "5s".
+const (
+	syncWaitEnvVar         = "ASG53_SYNC_WAIT"
+	syncInitialDelayEnvVar = "ASG53_SYNC_INITIAL_DELAY"
+	syncBackoffEnvVar      = "ASG53_SYNC_BACKOFF"
+	syncMaxDelayEnvVar     = "ASG53_SYNC_MAX_DELAY"
+	syncMaxWaitEnvVar      = "ASG53_SYNC_MAX_WAIT"
+)
+
+// syncConfig holds the settings for waiting for change batches to sync,
+// as supplied in notification metadata. Durations are in Go duration
+// format, such as "5s". Unset fields keep their current value.
+type syncConfig struct {
+	// The delay before the second GetChange call.
+	InitialDelay string
+
+	// The factor the delay is multiplied by after each GetChange call.
+	Backoff float64
+
+	// The maximum delay between GetChange calls.
+	MaxDelay string
+
+	// The maximum time to wait for a change batch to sync.
+	MaxWait string
+}
+
+// changePoller waits for Route 53 change batches to sync, by polling
+// GetChange until the change is INSYNC, with a delay that starts at
+// InitialDelay and is multiplied by Backoff after every call, up to
+// MaxDelay. Waiting stops with an error after MaxWait, or when the context
+// is done, whichever comes first.
+type changePoller struct {
+	// If false, change batches are not waited on at all.
+	Wait bool
+
+	// The delay before the second GetChange call.
+	InitialDelay time.Duration
+
+	// The factor the delay is multiplied by after each GetChange call.
+	Backoff float64
+
+	// The maximum delay between GetChange calls.
+	MaxDelay time.Duration
+
+	// The maximum time to wait for a change batch to sync. If zero, which
+	// withConfig does not allow, waiting is only bounded by the context, such
+	// as the Lambda deadline.
+	MaxWait time.Duration
+
+	// If set, called with the status of the change after every GetChange
+	// call that finds the change not yet in sync, in addition to the progress
+	// being logged.
+	Progress func(changeID, status string, elapsed time.Duration)
+}
+
+// newChangePoller returns a changePoller with the default settings.
+func newChangePoller() *changePoller {
+	return &changePoller{
+		Wait:         true,
+		InitialDelay: defaultSyncInitialDelay,
+		Backoff:      defaultSyncBackoff,
+		MaxDelay:     defaultSyncMaxDelay,
+		MaxWait:      defaultSyncMaxWait,
+	}
+}
+
+// parseSyncDuration parses a duration setting, naming the setting in the
+// error if it is invalid. Durations must be greater than zero: a zero delay
+// would poll GetChange in a tight loop, and a zero MaxWait would give up
+// straight away.
+func parseSyncDuration(name, value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s %q: %v", name, value, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("Invalid %s %q: must be greater than zero", name, value)
+	}
+	return d, nil
+}
+
+// withConfig returns a copy of p with the settings in wait and cfg applied.
+// Either can be nil.
+func (p *changePoller) withConfig(wait *bool, cfg *syncConfig) (*changePoller, error) {
+	updated := *p
+	if wait != nil {
+		updated.Wait = *wait
+	}
+	if cfg == nil {
+		return &updated, nil
+	}
+
+	var err error
+	if cfg.InitialDelay != "" {
+		if updated.InitialDelay, err = parseSyncDuration("InitialDelay", cfg.InitialDelay); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Backoff != 0 {
+		if cfg.Backoff < 1 {
+			return nil, fmt.Errorf("Invalid Backoff %v: must be at least 1", cfg.Backoff)
+		}
+		updated.Backoff = cfg.Backoff
+	}
+	if cfg.MaxDelay != "" {
+		if updated.MaxDelay, err = parseSyncDuration("MaxDelay", cfg.MaxDelay); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.MaxWait != "" {
+		if updated.MaxWait, err = parseSyncDuration("MaxWait", cfg.MaxWait); err != nil {
+			return nil, err
+		}
+	}
+	if updated.MaxDelay < updated.InitialDelay {
+		return nil, fmt.Errorf("Invalid MaxDelay %s: must be at least InitialDelay %s", updated.MaxDelay, updated.InitialDelay)
+	}
+	return &updated, nil
+}
+
+// loadChangePoller returns a changePoller with the defaults overridden by
+// the ASG53_SYNC_* environment variables.
+func loadChangePoller() (*changePoller, error) {
+	var wait *bool
+	if raw := os.Getenv(syncWaitEnvVar); raw != "" {
+		v, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s %q: %v", syncWaitEnvVar, raw, err)
+		}
+		wait = &v
+	}
+
+	cfg := &syncConfig{
+		InitialDelay: os.Getenv(syncInitialDelayEnvVar),
+		MaxDelay:     os.Getenv(syncMaxDelayEnvVar),
+		MaxWait:      os.Getenv(syncMaxWaitEnvVar),
+	}
+	if raw := os.Getenv(syncBackoffEnvVar); raw != "" {
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s %q: %v", syncBackoffEnvVar, raw, err)
+		}
+		cfg.Backoff = v
+	}
+
+	poller, err := newChangePoller().withConfig(wait, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Error in ASG53_SYNC_* settings: %v", err)
+	}
+	return poller, nil
+}
+
+// nextDelay returns the delay that follows d.
+func (p *changePoller) nextDelay(d time.Duration) time.Duration {
+	next := time.Duration(float64(d) * p.Backoff)
+	if next > p.MaxDelay {
+		next = p.MaxDelay
+	}
+	return next
+}
+
+// Poll calls getStatus until it returns INSYNC, an error, or until MaxWait
+// passes or ctx is done. Progress is reported after every call that does
+// not return INSYNC. Progress is logged to l.
+func (p *changePoller) Poll(ctx context.Context, l *logger, changeID string, getStatus func() (string, error)) error {
+	start := time.Now()
+	if p.MaxWait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.MaxWait)
+		defer cancel()
+	}
+
+	delay := p.InitialDelay
+	for {
+		status, err := getStatus()
+		if err != nil {
+			return err
+		}
+		if status == route53.ChangeStatusInsync {
+			l.Infof("Change ID %s is in sync after %fs", changeID, time.Since(start).Seconds())
+			return nil
+		}
+		l.Infof("Still waiting for change ID %s (%s), elapsed time %fs", changeID, status, time.Since(start).Seconds())
+		if p.Progress != nil {
+			p.Progress(changeID, status, time.Since(start))
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("Gave up waiting for change ID %s to sync after %fs: %v", changeID, time.Since(start).Seconds(), ctx.Err())
+		case <-timer.C:
+		}
+		delay = p.nextDelay(delay)
+	}
+}
+
+// WaitForRoute53Sync waits until a Route 53 change batch is INSYNC, taking
+// the change batch ID. The wait is bounded by the client's context, and
+// follows the client's change poller settings. Nothing is waited on if the
+// poller's Wait setting is false.
+func (c *awsClient) WaitForRoute53Sync(changeID string) error {
+	poller := c.changePoller()
+	if !poller.Wait {
+		c.logger().Infof("Not waiting for change ID %s to sync", changeID)
+		return nil
+	}
+
+	c.logger().Infof("Waiting for change ID %s to sync", changeID)
+	params := &route53.GetChangeInput{
+		Id: aws.String(changeID),
+	}
+	return poller.Poll(c.context(), c.logger(), changeID, func() (string, error) {
+		var resp *route53.GetChangeOutput
+		err := c.retrier().Do("GetChange", func() error {
+			var err error
+			resp, err = c.Route53.GetChange(params)
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("Error checking status of change ID %s: %v", changeID, err)
+		}
+		return aws.StringValue(resp.ChangeInfo.Status), nil
+	})
+}
+
+// changePoller returns the client's change poller.
+func (c *awsClient) changePoller() *changePoller {
+	if c.poller == nil {
+		return newChangePoller()
+	}
+	return c.poller
+}
+
+// context returns the client's context.
+func (c *awsClient) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// bindDeadline sets the client's context to one that is done a safety margin
+// before deadline, so that there is still time to complete the lifecycle
+// action after giving up on a change batch. The returned function releases
+// the context. Nothing is done if deadline is zero.
+func (c *awsClient) bindDeadline(deadline time.Time) context.CancelFunc {
+	if deadline.IsZero() {
+		return func() {}
+	}
+	ctx, cancel := context.WithDeadline(c.context(), deadline.Add(-defaultRetryDeadlineMargin))
+	c.ctx = ctx
+	return cancel
+}
+
+// withSync returns a copy of c that waits for change batches to sync with the
+// settings in wait and cfg applied on top of c's. c is returned if both are
+// nil.
+//
+// Batches coalesced by an aggregator are sent and waited on by the client
+// the aggregator was created with, so these settings do not apply to them.
+func (c *awsClient) withSync(wait *bool, cfg *syncConfig) (*awsClient, error) {
+	if wait == nil && cfg == nil {
+		return c, nil
+	}
+	poller, err := c.changePoller().withConfig(wait, cfg)
+	if err != nil {
+		return nil, err
+	}
+	client := *c
+	client.poller = poller
+	return &client, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// testPoller returns a changePoller with short delays, that records its
+// progress reports.
+func testPoller(reports *[]string) *changePoller {
+	return &changePoller{
+		Wait:         true,
+		InitialDelay: time.Millisecond,
+		Backoff:      2,
+		MaxDelay:     time.Millisecond * 4,
+		MaxWait:      time.Second,
+		Progress: func(changeID, status string, elapsed time.Duration) {
+			*reports = append(*reports, status)
+		},
+	}
+}
+
+func TestChangePollerPoll(t *testing.T) {
+	reports := []string{}
+	statuses := []string{"PENDING", "PENDING", "INSYNC"}
+	calls := 0
+
+	err := testPoller(&reports).Poll(context.Background(), defaultLogger, "CHANGE123435", func() (string, error) {
+		calls++
+		return statuses[calls-1], nil
+	})
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if calls != 3 || len(reports) != 2 {
+		t.Fatalf("Expected 3 calls and 2 progress reports, got %d and %d", calls, len(reports))
+	}
+}
+
+func TestChangePollerPoll_timeout(t *testing.T) {
+	reports := []string{}
+	p := testPoller(&reports)
+	p.MaxWait = time.Millisecond * 20
+
+	err := p.Poll(context.Background(), defaultLogger, "CHANGE123435", func() (string, error) { return "PENDING", nil })
+	if err == nil {
+		t.Fatal("Expected error, got none")
+	}
+}
+
+func TestChangePollerPoll_cancelled(t *testing.T) {
+	reports := []string{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := testPoller(&reports).Poll(ctx, defaultLogger, "CHANGE123435", func() (string, error) { return "PENDING", nil })
+	if err == nil || len(reports) != 1 {
+		t.Fatalf("Expected error after one call, got %v after %d", err, len(reports))
+	}
+}
+
+func TestChangePollerNextDelay(t *testing.T) {
+	reports := []string{}
+	p := testPoller(&reports)
+	expected := []time.Duration{time.Millisecond * 2, time.Millisecond * 4, time.Millisecond * 4}
+	d := p.InitialDelay
+	for n, e := range expected {
+		d = p.nextDelay(d)
+		if d != e {
+			t.Fatalf("Expected delay %d to be %s, got %s", n, e, d)
+		}
+	}
+}
+
+func TestChangePollerWithConfig(t *testing.T) {
+	p, err := newChangePoller().withConfig(aws.Bool(false), &syncConfig{InitialDelay: "1s", Backoff: 2, MaxWait: "5m"})
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if p.Wait || p.InitialDelay != time.Second || p.Backoff != 2 || p.MaxDelay != defaultSyncMaxDelay || p.MaxWait != time.Minute*5 {
+		t.Fatalf("Unexpected poller settings: %#v", p)
+	}
+
+	bad := []*syncConfig{
+		{InitialDelay: "soon"},
+		{MaxDelay: "-1s"},
+		{Backoff: 0.5},
+		{InitialDelay: "0s"},
+		{MaxDelay: "0"},
+		{MaxWait: "0s"},
+		{InitialDelay: "1m"},
+		{InitialDelay: "10s", MaxDelay: "5s"},
+	}
+	for _, cfg := range bad {
+		if _, err := newChangePoller().withConfig(nil, cfg); err == nil {
+			t.Fatalf("Expected error for %#v, got none", cfg)
+		}
+	}
+}
+
+func TestLoadChangePoller(t *testing.T) {
+	defer os.Unsetenv(syncWaitEnvVar)
+	defer os.Unsetenv(syncBackoffEnvVar)
+	os.Setenv(syncWaitEnvVar, "false")
+	os.Setenv(syncBackoffEnvVar, "1.5")
+
+	p, err := loadChangePoller()
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if p.Wait || p.Backoff != 1.5 || p.InitialDelay != defaultSyncInitialDelay {
+		t.Fatalf("Unexpected poller settings: %#v", p)
+	}
+
+	os.Setenv(syncBackoffEnvVar, "fast")
+	if _, err := loadChangePoller(); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+}
+
+func TestWaitForRoute53Sync_noWait(t *testing.T) {
+	client, err := testAwsClient().withSync(aws.Bool(false), nil)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	// The bad change ID would fail if it were checked.
+	if err := client.WaitForRoute53Sync("bad"); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	base := testAwsClient()
+	if same, _ := base.withSync(nil, nil); same != base {
+		t.Fatal("Expected the same client with no sync settings")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// queueMessage represents a message received from a messageQueue.
+type queueMessage struct {
+	// The message ID.
+	ID string
+
+	// The message body.
+	Body string
+
+	// The receipt handle, used to delete the message or change its
+	// visibility.
+	ReceiptHandle string
+}
+
+// messageQueue is a queue of lifecycle messages, with SQS semantics:
+// received messages are hidden from other receivers for a visibility
+// timeout, after which they are delivered again unless they have been
+// deleted.
+type messageQueue interface {
+	// Receive waits up to wait for up to max messages to become available,
+	// and returns them.
+	Receive(max int, wait time.Duration) ([]queueMessage, error)
+
+	// Delete removes a received message from the queue.
+	Delete(msg queueMessage) error
+
+	// ExtendVisibility hides a received message from other receivers for
+	// timeout, starting now.
+	ExtendVisibility(msg queueMessage, timeout time.Duration) error
+}
+
+// memoryQueueItem is a message held in a memoryQueue.
+type memoryQueueItem struct {
+	// The message.
+	msg queueMessage
+
+	// The time the message becomes visible again.
+	visibleAt time.Time
+}
+
+// memoryQueue is an in-memory messageQueue, for testing and local use.
+type memoryQueue struct {
+	// The visibility timeout applied to messages on receipt.
+	visibilityTimeout time.Duration
+
+	// The queued messages, and the lock that protects them.
+	mu      sync.Mutex
+	items   []*memoryQueueItem
+	counter int
+}
+
+// newMemoryQueue returns a new memoryQueue with the supplied visibility
+// timeout.
+func newMemoryQueue(visibilityTimeout time.Duration) *memoryQueue {
+	return &memoryQueue{visibilityTimeout: visibilityTimeout}
+}
+
+// Send adds a message with the supplied body to the queue.
+func (q *memoryQueue) Send(body string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.counter++
+	q.items = append(q.items, &memoryQueueItem{
+		msg: queueMessage{
+			ID:   fmt.Sprintf("message-%d", q.counter),
+			Body: body,
+		},
+	})
+}
+
+// Len returns the number of messages in the queue, visible or not.
+func (q *memoryQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// receiveNow returns up to max visible messages, without waiting.
+func (q *memoryQueue) receiveNow(max int) []queueMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	msgs := []queueMessage{}
+	for _, item := range q.items {
+		if len(msgs) >= max {
+			break
+		}
+		if item.visibleAt.After(now) {
+			continue
+		}
+		q.counter++
+		item.msg.ReceiptHandle = fmt.Sprintf("receipt-%d", q.counter)
+		item.visibleAt = now.Add(q.visibilityTimeout)
+		msgs = append(msgs, item.msg)
+	}
+	return msgs
+}
+
+// Receive implements messageQueue for memoryQueue.
+func (q *memoryQueue) Receive(max int, wait time.Duration) ([]queueMessage, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		msgs := q.receiveNow(max)
+		if len(msgs) > 0 || !time.Now().Before(deadline) {
+			return msgs, nil
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// find returns the index of the item with the supplied receipt handle, or
+// -1 if it cannot be found. The caller must hold the lock.
+func (q *memoryQueue) find(receiptHandle string) int {
+	for i, item := range q.items {
+		if item.msg.ReceiptHandle == receiptHandle {
+			return i
+		}
+	}
+	return -1
+}
+
+// Delete implements messageQueue for memoryQueue.
+func (q *memoryQueue) Delete(msg queueMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := q.find(msg.ReceiptHandle)
+	if i < 0 {
+		return fmt.Errorf("Receipt handle %s not found", msg.ReceiptHandle)
+	}
+	q.items = append(q.items[:i], q.items[i+1:]...)
+	return nil
+}
+
+// ExtendVisibility implements messageQueue for memoryQueue.
+func (q *memoryQueue) ExtendVisibility(msg queueMessage, timeout time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := q.find(msg.ReceiptHandle)
+	if i < 0 {
+		return fmt.Errorf("Receipt handle %s not found", msg.ReceiptHandle)
+	}
+	q.items[i].visibleAt = time.Now().Add(timeout)
+	return nil
+}
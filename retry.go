@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// Retry policy defaults.
+const (
+	// The delay ceiling for the first retry.
+	defaultRetryInitialDelay = time.Millisecond * 200
+
+	// The maximum delay ceiling for any single retry.
+	defaultRetryMaxDelay = time.Second * 10
+
+	// The maximum time to spend retrying a single operation, when there is
+	// no earlier deadline.
+	defaultRetryMaxElapsed = time.Minute * 2
+
+	// The time to leave before the deadline, so that there is still time to
+	// complete the lifecycle action after giving up.
+	defaultRetryDeadlineMargin = time.Second * 10
+)
+
+// retryableRoute53Codes are the Route 53 error codes that are safe to retry.
+// Route 53 allows 5 requests per second per account, and returns these
+// during bursts of activity, such as large scale-out events.
+var retryableRoute53Codes = map[string]bool{
+	"Throttling":              true,
+	"ThrottlingException":     true,
+	"PriorRequestNotComplete": true,
+	"ServiceUnavailable":      true,
+}
+
+// isRetryableRoute53Error returns true if err is an AWS error with a code
+// that is safe to retry.
+func isRetryableRoute53Error(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return retryableRoute53Codes[awsErr.Code()]
+	}
+	return false
+}
+
+// retryPolicy retries operations that fail with retryable errors, using
+// exponential backoff with full jitter - each delay is a random duration
+// between zero and a ceiling that doubles on every attempt, up to MaxDelay.
+type retryPolicy struct {
+	// The delay ceiling for the first retry.
+	InitialDelay time.Duration
+
+	// The maximum delay ceiling for any single retry.
+	MaxDelay time.Duration
+
+	// The maximum time to spend retrying a single operation.
+	MaxElapsed time.Duration
+
+	// An absolute deadline, such as the Lambda function's deadline. Retries
+	// stop if the next attempt would happen after this. Ignored if zero.
+	Deadline time.Time
+
+	// The function used to sleep between attempts.
+	sleep func(time.Duration)
+
+	// The logger retries are logged to. If nil, defaultLogger is used.
+	log *logger
+
+	// The metrics recorder retries are counted with. If nil, defaultMetrics
+	// is used.
+	metrics *metricsRecorder
+}
+
+// newRetryPolicy returns a retryPolicy with the default settings, bounded by
+// the supplied deadline (minus a safety margin). A zero deadline means that
+// the policy is only bounded by MaxElapsed.
+func newRetryPolicy(deadline time.Time) *retryPolicy {
+	p := &retryPolicy{
+		InitialDelay: defaultRetryInitialDelay,
+		MaxDelay:     defaultRetryMaxDelay,
+		MaxElapsed:   defaultRetryMaxElapsed,
+		sleep:        time.Sleep,
+	}
+	if !deadline.IsZero() {
+		p.Deadline = deadline.Add(-defaultRetryDeadlineMargin)
+	}
+	return p
+}
+
+// stopAt returns the time after which no more attempts should be made for an
+// operation started at start.
+func (p *retryPolicy) stopAt(start time.Time) time.Time {
+	stop := start.Add(p.MaxElapsed)
+	if !p.Deadline.IsZero() && p.Deadline.Before(stop) {
+		stop = p.Deadline
+	}
+	return stop
+}
+
+// delay returns the jittered delay before the supplied retry attempt,
+// starting at zero.
+func (p *retryPolicy) delay(attempt int) time.Duration {
+	ceiling := p.InitialDelay
+	for i := 0; i < attempt && ceiling < p.MaxDelay; i++ {
+		ceiling *= 2
+	}
+	if ceiling > p.MaxDelay {
+		ceiling = p.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// logger returns the policy's logger.
+func (p *retryPolicy) logger() *logger {
+	if p.log == nil {
+		return defaultLogger
+	}
+	return p.log
+}
+
+// metricsRecorder returns the policy's metrics recorder.
+func (p *retryPolicy) metricsRecorder() *metricsRecorder {
+	if p.metrics == nil {
+		return defaultMetrics
+	}
+	return p.metrics
+}
+
+// Do runs fn, retrying it for as long as it returns a retryable error and
+// the policy allows. The last error is returned if the policy gives up.
+func (p *retryPolicy) Do(op string, fn func() error) error {
+	start := time.Now()
+	stop := p.stopAt(start)
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !isRetryableRoute53Error(err) {
+			return err
+		}
+
+		d := p.delay(attempt)
+		if time.Now().Add(d).After(stop) {
+			return fmt.Errorf("%s: giving up after %d attempts: %v", op, attempt+1, err)
+		}
+
+		p.metricsRecorder().Count(metricRetryCount, 1)
+		p.logger().Warnf("%s: retryable error on attempt %d, retrying in %s: %v", op, attempt+1, d, err)
+		p.sleep(d)
+	}
+}
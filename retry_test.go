@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/paybyphone/asg53/teststubs"
+)
+
+// testRetryPolicy returns a retryPolicy that does not sleep.
+func testRetryPolicy() *retryPolicy {
+	p := newRetryPolicy(time.Time{})
+	p.sleep = func(time.Duration) {}
+	return p
+}
+
+func TestIsRetryableRoute53Error(t *testing.T) {
+	cases := map[error]bool{
+		awserr.New("Throttling", "", nil):              true,
+		awserr.New("PriorRequestNotComplete", "", nil): true,
+		awserr.New("InvalidChangeBatch", "", nil):      false,
+		errors.New("Throttling"):                       false,
+	}
+
+	for err, expected := range cases {
+		if actual := isRetryableRoute53Error(err); actual != expected {
+			t.Fatalf("Expected %v retryable to be %t, got %t", err, expected, actual)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := testRetryPolicy()
+	for attempt := 0; attempt < 20; attempt++ {
+		if d := p.delay(attempt); d < 0 || d > p.MaxDelay {
+			t.Fatalf("Expected delay for attempt %d to be within [0, %s], got %s", attempt, p.MaxDelay, d)
+		}
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	p := testRetryPolicy()
+	attempts := 0
+	err := p.Do("test", func() error {
+		attempts++
+		if attempts < 3 {
+			return awserr.New("Throttling", "", nil)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestRetryPolicyDo_nonRetryable(t *testing.T) {
+	p := testRetryPolicy()
+	attempts := 0
+	err := p.Do("test", func() error {
+		attempts++
+		return awserr.New("InvalidChangeBatch", "", nil)
+	})
+	if err == nil {
+		t.Fatal("Expected error, got none")
+	}
+	if attempts != 1 {
+		t.Fatalf("Expected 1 attempt, got %d", attempts)
+	}
+}
+
+func TestRetryPolicyDo_deadline(t *testing.T) {
+	p := testRetryPolicy()
+	p.Deadline = time.Now().Add(-time.Second)
+	attempts := 0
+	err := p.Do("test", func() error {
+		attempts++
+		return awserr.New("Throttling", "", nil)
+	})
+	if err == nil {
+		t.Fatal("Expected error, got none")
+	}
+	if attempts != 1 {
+		t.Fatalf("Expected 1 attempt past deadline, got %d", attempts)
+	}
+}
+
+func TestSendRoute53ChangeBatch_retry(t *testing.T) {
+	defer teststubs.ResetRoute53Errors()
+	teststubs.InjectRoute53Errors("ChangeResourceRecordSets", "Throttling", "PriorRequestNotComplete")
+
+	metadata, err := parseSNSMetadata([]byte(testMetadataJSON))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+
+	sink := &captureMetricsSink{}
+	client := testAwsClient()
+	client.retry = testRetryPolicy()
+	client.metrics = newMetricsRecorder(sink)
+
+	if err := client.SendRoute53ChangeBatch(metadata.HostedZoneID, metadata.Changes); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if retries := sink.named(metricRetryCount); len(retries) != 2 {
+		t.Fatalf("Expected 2 RetryCount values, got %v", retries)
+	}
+}
+
+func TestFindRoute53ResourceRecordSet_retryShouldError(t *testing.T) {
+	defer teststubs.ResetRoute53Errors()
+	teststubs.InjectRoute53Errors("ListResourceRecordSets", "Throttling", "InvalidInput")
+
+	client := testAwsClient()
+	client.retry = testRetryPolicy()
+
+	if _, err := client.FindRoute53ResourceRecordSet("ABCDEF0123456789", "www.example.com.", "CNAME", ""); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+}
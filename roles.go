@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// roleClients creates and caches the clients used to make Route 53 changes
+// in other accounts, through roles assumed with STS. This allows DNS to live
+// in a central account, while auto scaling groups live in workload accounts.
+//
+// Only Route 53 calls are made with the assumed role - EC2 and auto scaling
+// calls are always made with the function's own credentials.
+type roleClients struct {
+	// The function that returns a Route 53 connection using credentials for
+	// the supplied role ARN and external ID.
+	newRoute53 func(roleARN, externalID string) *route53.Route53
+
+	// The clients created so far, keyed by role ARN and external ID, and the
+	// lock that protects them.
+	mu      sync.Mutex
+	clients map[string]*awsClient
+}
+
+// newRoleClients returns a roleClients that creates Route 53 connections
+// with newRoute53.
+func newRoleClients(newRoute53 func(roleARN, externalID string) *route53.Route53) *roleClients {
+	return &roleClients{
+		newRoute53: newRoute53,
+		clients:    make(map[string]*awsClient),
+	}
+}
+
+// stsRoute53Factory returns a function that creates Route 53 connections
+// from sess, using credentials from an STS AssumeRole call. The credentials
+// are refreshed automatically as they expire.
+func stsRoute53Factory(sess *session.Session) func(roleARN, externalID string) *route53.Route53 {
+	return func(roleARN, externalID string) *route53.Route53 {
+		creds := stscreds.NewCredentials(sess, roleARN, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = "asg53"
+			if externalID != "" {
+				p.ExternalID = aws.String(externalID)
+			}
+		})
+		return route53.New(sess, &aws.Config{Credentials: creds})
+	}
+}
+
+// forRole returns a copy of c that makes Route 53 calls as the supplied
+// role, and all other calls with c's connections. Everything else, such as
+// the event, context, retry policy, and sync settings, carries over from c.
+// c is returned if roleARN is empty. The role's Route 53 connection is
+// created on first use, and is shared by everything else that uses the same
+// role and external ID.
+//
+// If c coalesces change batches, the returned client coalesces its own
+// batches separately with the same window. The role's aggregator is shared
+// in the same way as its connection.
+func (c *awsClient) forRole(roleARN, externalID string) (*awsClient, error) {
+	if roleARN == "" {
+		return c, nil
+	}
+	if c.roles == nil {
+		return nil, fmt.Errorf("Cannot assume role %s: client does not support assuming roles", roleARN)
+	}
+
+	c.roles.mu.Lock()
+	defer c.roles.mu.Unlock()
+	key := roleARN + "|" + externalID
+	shared, ok := c.roles.clients[key]
+	if !ok {
+		c.logger().Infof("Setting up Route 53 connection for role: %s", roleARN)
+		base := *c
+		base.Route53 = c.roles.newRoute53(roleARN, externalID)
+		if c.aggregator != nil {
+			base.aggregator = newChangeAggregator(&base, c.aggregator.window)
+		}
+		shared = &base
+		c.roles.clients[key] = shared
+	}
+
+	client := *c
+	client.Route53 = shared.Route53
+	client.aggregator = shared.aggregator
+	return &client, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/paybyphone/asg53/teststubs"
+)
+
+// testRoleClient returns a test client that can assume roles, and a map
+// that counts the Route 53 connections created for each role ARN and
+// external ID.
+func testRoleClient() (*awsClient, map[string]int) {
+	created := make(map[string]int)
+	client := testAwsClient()
+	client.roles = newRoleClients(func(roleARN, externalID string) *route53.Route53 {
+		created[roleARN+"|"+externalID]++
+		return teststubs.CreateTestRoute53Mock()
+	})
+	return client, created
+}
+
+func TestForRole(t *testing.T) {
+	client, created := testRoleClient()
+	client.aggregator = newChangeAggregator(client, time.Millisecond)
+
+	same, err := client.forRole("", "")
+	if err != nil || same != client {
+		t.Fatalf("Expected the same client with no role, got %p (%v)", same, err)
+	}
+
+	role, err := client.forRole("arn:aws:iam::123456789012:role/dns", "secret")
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if role == client || role.Route53 == client.Route53 {
+		t.Fatal("Expected a separate Route 53 connection for the role")
+	}
+	if role.EC2 != client.EC2 || role.AutoScaling != client.AutoScaling {
+		t.Fatal("Expected EC2 and auto scaling connections to be shared")
+	}
+	if role.aggregator == client.aggregator || role.aggregator == nil {
+		t.Fatal("Expected a separate aggregator for the role")
+	}
+
+	again, err := client.forRole("arn:aws:iam::123456789012:role/dns", "secret")
+	if err != nil || again.Route53 != role.Route53 || again.aggregator != role.aggregator {
+		t.Fatalf("Expected the cached connection and aggregator, got %p (%v)", again, err)
+	}
+	if created["arn:aws:iam::123456789012:role/dns|secret"] != 1 {
+		t.Fatalf("Expected 1 connection to be created, got %v", created)
+	}
+
+	if _, err := testAwsClient().forRole("arn:aws:iam::123456789012:role/dns", ""); err == nil {
+		t.Fatal("Expected error from client without role support, got none")
+	}
+}
+
+func TestForRole_carriesOver(t *testing.T) {
+	client, _ := testRoleClient()
+	if _, err := client.forRole("arn:aws:iam::123456789012:role/dns", ""); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	event := client.forEvent("ASGName", "i-123456789", "HookName")
+	event.ctx = ctx
+	event.retry = &retryPolicy{InitialDelay: time.Millisecond, MaxDelay: time.Millisecond, MaxElapsed: time.Second}
+	event.contributors = []invocation{{InstanceID: "i-123456789"}, {InstanceID: "i-987654321"}}
+
+	role, err := event.forRole("arn:aws:iam::123456789012:role/dns", "")
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if role.ctx != ctx || role.retry != event.retry || len(role.contributors) != 2 {
+		t.Fatal("Expected context, retry policy, and contributors to carry over to the role's client")
+	}
+	if role.event != event.event || role.lookups != event.lookups || role.log != event.log {
+		t.Fatal("Expected the event to carry over to the role's client")
+	}
+}
+
+func TestRenderZoneBatches_role(t *testing.T) {
+	metadata, err := parseSNSMetadata([]byte(testZonesMetadataJSON))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+	metadata.Zones[1].RoleARN = "arn:aws:iam::123456789012:role/dns"
+	metadata.Zones[1].ExternalID = "secret"
+
+	client, created := testRoleClient()
+	batches, err := renderZoneBatches(client, "i-123456789", metadata, transitionLaunch, "")
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	if batches[0].clientFor(client) != client {
+		t.Fatal("Expected first zone to use the default client")
+	}
+	role := batches[1].clientFor(client)
+	if role == client || created["arn:aws:iam::123456789012:role/dns|secret"] != 1 {
+		t.Fatal("Expected second zone to use the role's client")
+	}
+
+	if err := client.applyZoneBatches(batches); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+}
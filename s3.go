@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/private/protocol/restxml"
+)
+
+// The S3 service is not vendored with the SDK, so this file implements the
+// small subset of the S3 API that the audit trail needs, using the same
+// client plumbing and REST XML protocol handlers as the generated service
+// clients. Requests use path-style addressing, which S3-compatible services
+// also support.
+
+// s3ServiceName is the service name used for endpoint and signing lookups.
+const s3ServiceName = "s3"
+
+// s3PutObjectInput is the input for the S3 PutObject API.
+type s3PutObjectInput struct {
+	_ struct{} `type:"structure" payload:"Body"`
+
+	Body io.ReadSeeker `type:"blob"`
+
+	Bucket *string `location:"uri" locationName:"Bucket" type:"string" required:"true"`
+
+	ContentType *string `location:"header" locationName:"Content-Type" type:"string"`
+
+	Key *string `location:"uri" locationName:"Key" min:"1" type:"string" required:"true"`
+}
+
+// s3GetObjectInput is the input for the S3 GetObject API.
+type s3GetObjectInput struct {
+	_ struct{} `type:"structure"`
+
+	Bucket *string `location:"uri" locationName:"Bucket" type:"string" required:"true"`
+
+	Key *string `location:"uri" locationName:"Key" min:"1" type:"string" required:"true"`
+}
+
+// s3GetObjectOutput is the output for the S3 GetObject API.
+type s3GetObjectOutput struct {
+	_ struct{} `type:"structure" payload:"Body"`
+
+	Body io.ReadCloser `type:"blob"`
+}
+
+// s3ListObjectsInput is the input for the S3 ListObjects API.
+type s3ListObjectsInput struct {
+	_ struct{} `type:"structure"`
+
+	Bucket *string `location:"uri" locationName:"Bucket" type:"string" required:"true"`
+
+	Marker *string `location:"querystring" locationName:"marker" type:"string"`
+
+	Prefix *string `location:"querystring" locationName:"prefix" type:"string"`
+}
+
+// s3Object is an object returned by the S3 ListObjects API.
+type s3Object struct {
+	_ struct{} `type:"structure"`
+
+	Key *string `type:"string"`
+}
+
+// s3ListObjectsOutput is the output for the S3 ListObjects API.
+type s3ListObjectsOutput struct {
+	_ struct{} `type:"structure"`
+
+	Contents []*s3Object `type:"list" flattened:"true"`
+
+	IsTruncated *bool `type:"boolean"`
+
+	NextMarker *string `type:"string"`
+}
+
+// s3EmptyOutput is the output for S3 APIs whose output is not used.
+type s3EmptyOutput struct {
+	_ struct{} `type:"structure"`
+}
+
+// s3Client is a minimal S3 client.
+type s3Client struct {
+	*client.Client
+}
+
+// newS3Client returns an s3Client using the supplied config provider
+// (usually a session), with cfgs applied on top.
+func newS3Client(p client.ConfigProvider, cfgs ...*aws.Config) *s3Client {
+	c := p.ClientConfig(s3ServiceName, cfgs...)
+	s := &s3Client{
+		Client: client.New(
+			*c.Config,
+			metadata.ClientInfo{
+				ServiceName:   s3ServiceName,
+				SigningRegion: c.SigningRegion,
+				Endpoint:      c.Endpoint,
+				APIVersion:    "2006-03-01",
+			},
+			c.Handlers,
+		),
+	}
+
+	s.Handlers.Sign.PushBackNamed(v4.SignRequestHandler)
+	s.Handlers.Build.PushBackNamed(restxml.BuildHandler)
+	s.Handlers.Unmarshal.PushBackNamed(restxml.UnmarshalHandler)
+	s.Handlers.UnmarshalMeta.PushBackNamed(restxml.UnmarshalMetaHandler)
+	s.Handlers.UnmarshalError.PushBackNamed(s3UnmarshalErrorHandler)
+
+	return s
+}
+
+// s3ErrorResponse is the body of an S3 error response. Unlike the other
+// REST XML services, S3 errors are not wrapped in an ErrorResponse element.
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	RequestID string   `xml:"RequestId"`
+}
+
+// s3UnmarshalErrorHandler unmarshals S3 error responses.
+var s3UnmarshalErrorHandler = request.NamedHandler{Name: "asg53.s3.UnmarshalError", Fn: s3UnmarshalError}
+
+// s3UnmarshalError unmarshals an S3 error response. Responses without a body,
+// such as those to HEAD requests, are reported by their HTTP status.
+func s3UnmarshalError(r *request.Request) {
+	defer r.HTTPResponse.Body.Close()
+
+	resp := s3ErrorResponse{}
+	raw, err := ioutil.ReadAll(r.HTTPResponse.Body)
+	if err != nil || xml.Unmarshal(raw, &resp) != nil || resp.Code == "" {
+		resp.Code = r.HTTPResponse.Status
+		resp.Message = string(raw)
+	}
+	if resp.RequestID == "" {
+		resp.RequestID = r.RequestID
+	}
+	r.Error = awserr.NewRequestFailure(awserr.New(resp.Code, resp.Message, nil), r.HTTPResponse.StatusCode, resp.RequestID)
+}
+
+// send sends a request for the named S3 operation.
+func (s *s3Client) send(name, method, path string, params, data interface{}) error {
+	op := &request.Operation{
+		Name:       name,
+		HTTPMethod: method,
+		HTTPPath:   path,
+	}
+	return s.NewRequest(op, params, data).Send()
+}
+
+// PutObject writes an object with the supplied JSON content.
+func (s *s3Client) PutObject(bucket, key string, content []byte) error {
+	params := &s3PutObjectInput{
+		Body:        bytes.NewReader(content),
+		Bucket:      aws.String(bucket),
+		ContentType: aws.String("application/json"),
+		Key:         aws.String(key),
+	}
+	return s.send("PutObject", "PUT", "/{Bucket}/{Key+}", params, &s3EmptyOutput{})
+}
+
+// GetObject returns the content of an object.
+func (s *s3Client) GetObject(bucket, key string) ([]byte, error) {
+	params := &s3GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	out := &s3GetObjectOutput{}
+	if err := s.send("GetObject", "GET", "/{Bucket}/{Key+}", params, out); err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return ioutil.ReadAll(out.Body)
+}
+
+// ListObjectKeys returns the keys of all of the objects in the bucket with
+// the supplied prefix, in order.
+func (s *s3Client) ListObjectKeys(bucket, prefix string) ([]string, error) {
+	params := &s3ListObjectsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+	keys := []string{}
+	for {
+		out := &s3ListObjectsOutput{}
+		if err := s.send("ListObjects", "GET", "/{Bucket}", params, out); err != nil {
+			return nil, err
+		}
+		for _, obj := range out.Contents {
+			keys = append(keys, aws.StringValue(obj.Key))
+		}
+		if !aws.BoolValue(out.IsTruncated) || len(out.Contents) < 1 {
+			return keys, nil
+		}
+		// NextMarker is only returned when a delimiter is used, otherwise the
+		// last key is the marker.
+		params.Marker = out.NextMarker
+		if params.Marker == nil {
+			params.Marker = out.Contents[len(out.Contents)-1].Key
+		}
+	}
+}
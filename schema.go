@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// validChangeActions are the change actions that Route 53 accepts.
+var validChangeActions = []string{
+	route53.ChangeActionCreate,
+	route53.ChangeActionDelete,
+	route53.ChangeActionUpsert,
+}
+
+// validRRTypes are the resource record set types that Route 53 accepts.
+var validRRTypes = []string{
+	route53.RRTypeA,
+	route53.RRTypeAaaa,
+	route53.RRTypeCname,
+	route53.RRTypeMx,
+	route53.RRTypeNaptr,
+	route53.RRTypeNs,
+	route53.RRTypePtr,
+	route53.RRTypeSoa,
+	route53.RRTypeSpf,
+	route53.RRTypeSrv,
+	route53.RRTypeTxt,
+}
+
+// schemaError is a problem with a document, at a JSON path such as
+// "$.Changes[0].ResourceRecordSet.TTL".
+type schemaError struct {
+	Path    string
+	Message string
+}
+
+// schemaErrors is the list of problems found in a document.
+type schemaErrors []schemaError
+
+// Error implements error for schemaErrors.
+func (e schemaErrors) Error() string {
+	msgs := []string{}
+	for _, se := range e {
+		msgs = append(msgs, se.Path+": "+se.Message)
+	}
+	return "Invalid document: " + strings.Join(msgs, "; ")
+}
+
+// add appends a problem at path.
+func (e *schemaErrors) add(path, format string, args ...interface{}) {
+	*e = append(*e, schemaError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// decodeStrict decodes raw JSON into v, which must be a pointer to a struct.
+// Unlike json.Unmarshal, field names must match exactly, and every field in
+// the document must exist in v. All of the fields that do not match, and any
+// values of the wrong type, are returned as schemaErrors.
+func decodeStrict(raw []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return err
+	}
+	errs := schemaErrors{}
+	checkShape(&errs, "$", doc, reflect.TypeOf(v).Elem())
+	if len(errs) > 0 {
+		return errs
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// jsonFields returns the fields of struct type t by their JSON names,
+// including the fields of embedded structs.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			for name, ft := range jsonFields(f.Type) {
+				fields[name] = ft
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// checkShape adds the problems with value, found at path, being decoded
+// into type t to errs.
+func checkShape(errs *schemaErrors, path string, value interface{}, t reflect.Type) {
+	if value == nil {
+		// null leaves the field unset.
+		return
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			errs.add(path, "expected an object")
+			return
+		}
+		fields := jsonFields(t)
+		keys := []string{}
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			ft, ok := fields[key]
+			if !ok {
+				errs.add(path, "unknown field %q%s", key, suggestField(key, fields))
+				continue
+			}
+			checkShape(errs, path+"."+key, obj[key], ft)
+		}
+	case reflect.Map:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			errs.add(path, "expected an object")
+			return
+		}
+		for key, v := range obj {
+			checkShape(errs, fmt.Sprintf("%s[%q]", path, key), v, t.Elem())
+		}
+	case reflect.Slice:
+		arr, ok := value.([]interface{})
+		if !ok {
+			errs.add(path, "expected an array")
+			return
+		}
+		for i, v := range arr {
+			checkShape(errs, fmt.Sprintf("%s[%d]", path, i), v, t.Elem())
+		}
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			errs.add(path, "expected a string")
+		}
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			errs.add(path, "expected true or false")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := value.(json.Number)
+		if !ok {
+			errs.add(path, "expected a number")
+		} else if _, err := n.Int64(); err != nil {
+			errs.add(path, "expected an integer, got %s", n)
+		}
+	case reflect.Float32, reflect.Float64:
+		if _, ok := value.(json.Number); !ok {
+			errs.add(path, "expected a number")
+		}
+	}
+}
+
+// suggestField returns a hint for an unknown field name that only differs
+// from a known one by case, such as "HostedZoneId" for "HostedZoneID".
+func suggestField(key string, fields map[string]reflect.Type) string {
+	for name := range fields {
+		if strings.EqualFold(name, key) {
+			return fmt.Sprintf(" (did you mean %q?)", name)
+		}
+	}
+	return ""
+}
+
+// containsString returns true if list contains s.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// validate adds the problems with a, found at path, to errs. This checks the
+// rules that decodeStrict cannot, such as required fields, and checks the
+// templates in a with checkTemplate.
+func (a messageArgs) validate(errs *schemaErrors, path string) {
+	a.zoneArgs.validate(errs, path)
+	if hc := a.HealthCheck; hc != nil {
+		validateTemplate(errs, path+".HealthCheck.IPAddress", hc.IPAddress)
+		validateTemplate(errs, path+".HealthCheck.FullyQualifiedDomainName", hc.FullyQualifiedDomainName)
+		validateTemplate(errs, path+".HealthCheck.ResourcePath", hc.ResourcePath)
+		validateTemplate(errs, path+".HealthCheck.SearchString", hc.SearchString)
+	}
+	for i, z := range a.Zones {
+		z.validate(errs, fmt.Sprintf("%s.Zones[%d]", path, i))
+	}
+}
+
+// validate adds the problems with a, found at path, to errs.
+func (a zoneArgs) validate(errs *schemaErrors, path string) {
+	if a.HostedZoneID != "" && a.HostedZoneName != "" {
+		errs.add(path, "only one of HostedZoneID and HostedZoneName can be set")
+	}
+	if a.Inverse != "" && a.Inverse != inverseExisting && a.Inverse != inverseStored {
+		errs.add(path+".Inverse", "must be one of %q or %q", inverseExisting, inverseStored)
+	}
+	for i, m := range a.SRVMembers {
+		p := fmt.Sprintf("%s.SRVMembers[%d]", path, i)
+		if m.Name == "" {
+			errs.add(p+".Name", "is required")
+		}
+		if m.Target == "" {
+			errs.add(p+".Target", "is required")
+		}
+		validateTemplate(errs, p+".Name", &m.Name)
+		validateTemplate(errs, p+".Target", &m.Target)
+	}
+	validateChanges(errs, path+".Changes", a.Changes)
+	validateChanges(errs, path+".OnLaunch", a.OnLaunch)
+	validateChanges(errs, path+".OnTerminate", a.OnTerminate)
+}
+
+// validateChanges adds the problems with the changes in batch, found at
+// path, to errs.
+func validateChanges(errs *schemaErrors, path string, batch []*route53.Change) {
+	for i, change := range batch {
+		p := fmt.Sprintf("%s[%d]", path, i)
+		if change == nil {
+			errs.add(p, "is required")
+			continue
+		}
+		switch {
+		case change.Action == nil:
+			errs.add(p+".Action", "is required")
+		case !containsString(validChangeActions, *change.Action):
+			errs.add(p+".Action", "must be one of %s", strings.Join(validChangeActions, ", "))
+		}
+
+		rrSet := change.ResourceRecordSet
+		p += ".ResourceRecordSet"
+		if rrSet == nil {
+			errs.add(p, "is required")
+			continue
+		}
+		if rrSet.Name == nil || *rrSet.Name == "" {
+			errs.add(p+".Name", "is required")
+		}
+		validateTemplate(errs, p+".Name", rrSet.Name)
+		validateTemplate(errs, p+".HealthCheckId", rrSet.HealthCheckId)
+		switch {
+		case rrSet.Type == nil:
+			errs.add(p+".Type", "is required")
+		case !containsString(validRRTypes, *rrSet.Type):
+			errs.add(p+".Type", "must be one of %s", strings.Join(validRRTypes, ", "))
+		}
+
+		if rrSet.AliasTarget != nil {
+			if rrSet.TTL != nil {
+				errs.add(p+".TTL", "cannot be set with AliasTarget")
+			}
+			if len(rrSet.ResourceRecords) > 0 {
+				errs.add(p+".ResourceRecords", "cannot be set with AliasTarget")
+			}
+			if rrSet.AliasTarget.DNSName == nil || *rrSet.AliasTarget.DNSName == "" {
+				errs.add(p+".AliasTarget.DNSName", "is required")
+			}
+			validateTemplate(errs, p+".AliasTarget.DNSName", rrSet.AliasTarget.DNSName)
+		} else if rrSet.TTL == nil {
+			errs.add(p+".TTL", "is required unless AliasTarget is set")
+		}
+		for x, rr := range rrSet.ResourceRecords {
+			valuePath := fmt.Sprintf("%s.ResourceRecords[%d].Value", p, x)
+			if rr == nil || rr.Value == nil {
+				errs.add(valuePath, "is required")
+				continue
+			}
+			validateTemplate(errs, valuePath, rr.Value)
+		}
+	}
+}
+
+// validateMessageArgs validates a after it has been decoded with
+// decodeStrict. A schemaErrors is returned if there are any problems.
+func validateMessageArgs(a messageArgs) error {
+	errs := schemaErrors{}
+	a.validate(&errs, "$")
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// schemaPaths returns the paths of the problems in err, which must be a
+// schemaErrors.
+func schemaPaths(t *testing.T, err error) []string {
+	errs, ok := err.(schemaErrors)
+	if !ok {
+		t.Fatalf("Expected schemaErrors, got %v", err)
+	}
+	paths := []string{}
+	for _, se := range errs {
+		paths = append(paths, se.Path+": "+se.Message)
+	}
+	return paths
+}
+
+func TestParseSNSMetadata_unknownFields(t *testing.T) {
+	_, err := parseSNSMetadata([]byte(`{
+  "HostedZoneId": "ABCDEF0123456789",
+  "Changes": [
+    {
+      "Action": "UPSERT",
+      "ResourceRecordSet": {
+        "Name": "www.example.com.",
+        "Type": "A",
+        "TTL": "60",
+        "ResourceRecord": [{"Value": "{{.InstancePublicIPAddress}}"}]
+      }
+    }
+  ]
+}`))
+	expected := []string{
+		`$.Changes[0].ResourceRecordSet: unknown field "ResourceRecord"`,
+		`$.Changes[0].ResourceRecordSet.TTL: expected a number`,
+		`$: unknown field "HostedZoneId" (did you mean "HostedZoneID"?)`,
+	}
+	if actual := schemaPaths(t, err); strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected errors:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+}
+
+func TestParseSNSMetadata_semantic(t *testing.T) {
+	_, err := parseSNSMetadata([]byte(`{
+  "HostedZoneID": "ABCDEF0123456789",
+  "Changes": [
+    {
+      "Action": "REPLACE",
+      "ResourceRecordSet": {
+        "Type": "a",
+        "TTL": 60,
+        "AliasTarget": {"DNSName": "lb.example.com."}
+      }
+    },
+    {
+      "ResourceRecordSet": {
+        "Name": "www.example.com.",
+        "Type": "A",
+        "ResourceRecords": [{}]
+      }
+    },
+    null
+  ],
+  "Zones": [
+    {"HostedZoneID": "0123456789ABCDEF", "OnTerminate": [{"Action": "DELETE"}]}
+  ]
+}`))
+	expected := []string{
+		"$.Changes[0].Action: must be one of CREATE, DELETE, UPSERT",
+		"$.Changes[0].ResourceRecordSet.Name: is required",
+		"$.Changes[0].ResourceRecordSet.Type: must be one of A, AAAA, CNAME, MX, NAPTR, NS, PTR, SOA, SPF, SRV, TXT",
+		"$.Changes[0].ResourceRecordSet.TTL: cannot be set with AliasTarget",
+		"$.Changes[1].Action: is required",
+		"$.Changes[1].ResourceRecordSet.TTL: is required unless AliasTarget is set",
+		"$.Changes[1].ResourceRecordSet.ResourceRecords[0].Value: is required",
+		"$.Changes[2]: is required",
+		"$.Zones[0].OnTerminate[0].ResourceRecordSet: is required",
+	}
+	if actual := schemaPaths(t, err); strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected errors:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+}
+
+func TestJSONConfigSourceLookup_invalid(t *testing.T) {
+	src, err := newJSONConfigSource([]byte(`{"web": {"Launch": {"HostedZoneID": "ABCDEF0123456789", "Changes": [{"Action": "UPSERT"}]}, "Terminate": {"Change": []}}}`))
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	_, err = src.Lookup("web")
+	if err == nil || !strings.Contains(err.Error(), `$.Terminate: unknown field "Change"`) {
+		t.Fatalf("Expected unknown field error, got %v", err)
+	}
+}
+
+func TestWriteTemplateFields_missingFields(t *testing.T) {
+	data, err := populate(testAwsClient(), "i-123456789", "ABCDEF0123456789", []*route53.Change{
+		{Action: aws.String("UPSERT"), ResourceRecordSet: &route53.ResourceRecordSet{AliasTarget: &route53.AliasTarget{}}},
+		{Action: aws.String("UPSERT")},
+	})
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if err := data.WriteTemplateFields(); err == nil || !strings.Contains(err.Error(), "RR Set #1") {
+		t.Fatalf("Expected error for missing ResourceRecordSet, got %v", err)
+	}
+}
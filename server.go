@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// snsMessageTypeHeader is the HTTP header that SNS uses to indicate the type
+// of message being delivered.
+const snsMessageTypeHeader = "x-amz-sns-message-type"
+
+// SNS HTTP(S) message types, as found in the Type field of an snsEnvelope.
+const (
+	// A message published to the topic.
+	snsTypeNotification = "Notification"
+
+	// A request to confirm the subscription of the endpoint to the topic.
+	snsTypeSubscriptionConfirmation = "SubscriptionConfirmation"
+
+	// A notice that the endpoint has been unsubscribed from the topic.
+	snsTypeUnsubscribeConfirmation = "UnsubscribeConfirmation"
+)
+
+// maxSNSBodySize is the maximum size of a request body that the server will
+// read. SNS messages are limited to 256KB, plus the envelope.
+const maxSNSBodySize = 1024 * 1024
+
+// snsHostPattern matches the hostnames that SNS signing certificates and
+// subscription confirmation URLs are served from.
+var snsHostPattern = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// snsEnvelope represents a message delivered by SNS to an HTTP(S)
+// subscription endpoint. For notifications, the Message field contains the
+// same snsMessage that is delivered through Lambda.
+type snsEnvelope struct {
+	// The type of the message.
+	Type string
+
+	// The unique ID of the message.
+	MessageID string `json:"MessageId"`
+
+	// The token used to confirm a subscription.
+	Token string
+
+	// The ARN of the topic the message was published to.
+	TopicARN string `json:"TopicArn"`
+
+	// The subject of the message, if one was supplied.
+	Subject string
+
+	// The message body.
+	Message string
+
+	// The URL to visit to confirm a subscription.
+	SubscribeURL string
+
+	// The time the message was published.
+	Timestamp string
+
+	// The signature version - "1" for SHA1withRSA, "2" for SHA256withRSA.
+	SignatureVersion string
+
+	// The base64-encoded signature of the message.
+	Signature string
+
+	// The URL of the certificate used to sign the message.
+	SigningCertURL string `json:"SigningCertURL"`
+}
+
+// stringToSign returns the canonical string that SNS signs for this message.
+// For more information, see
+// http://docs.aws.amazon.com/sns/latest/dg/SendMessageToHttp.verify.signature.html.
+func (e snsEnvelope) stringToSign() string {
+	fields := []string{"Message", e.Message, "MessageId", e.MessageID}
+	if e.Type == snsTypeNotification {
+		if e.Subject != "" {
+			fields = append(fields, "Subject", e.Subject)
+		}
+		fields = append(fields, "Timestamp", e.Timestamp, "TopicArn", e.TopicARN, "Type", e.Type)
+	} else {
+		fields = append(fields, "SubscribeURL", e.SubscribeURL, "Timestamp", e.Timestamp, "Token", e.Token, "TopicArn", e.TopicARN, "Type", e.Type)
+	}
+	return strings.Join(fields, "\n") + "\n"
+}
+
+// verify checks the message signature against the signing certificate
+// supplied by certs. An error is returned if the signature is invalid.
+func (e snsEnvelope) verify(certs certSource) error {
+	var algo x509.SignatureAlgorithm
+	switch e.SignatureVersion {
+	case "1":
+		algo = x509.SHA1WithRSA
+	case "2":
+		algo = x509.SHA256WithRSA
+	default:
+		return fmt.Errorf("Unsupported signature version %q", e.SignatureVersion)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(e.Signature)
+	if err != nil {
+		return fmt.Errorf("Error decoding signature: %v", err)
+	}
+
+	cert, err := certs.Certificate(e.SigningCertURL)
+	if err != nil {
+		return err
+	}
+
+	if err := cert.CheckSignature(algo, []byte(e.stringToSign()), sig); err != nil {
+		return fmt.Errorf("Invalid message signature: %v", err)
+	}
+	return nil
+}
+
+// certSource supplies SNS signing certificates by URL.
+type certSource interface {
+	// Certificate returns the certificate found at certURL. An error is
+	// returned if the URL is not trusted, or the certificate cannot be
+	// loaded.
+	Certificate(certURL string) (*x509.Certificate, error)
+}
+
+// validateSNSURL checks that rawURL is a HTTPS URL with a host that matches
+// hostPattern, and returns the parsed URL.
+func validateSNSURL(rawURL string, hostPattern *regexp.Regexp) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing URL %q: %v", rawURL, err)
+	}
+	if u.Scheme != "https" || !hostPattern.MatchString(u.Host) {
+		return nil, fmt.Errorf("URL %q is not a trusted SNS URL", rawURL)
+	}
+	return u, nil
+}
+
+// parsePEMCertificate parses the first certificate in a PEM-encoded block of
+// data.
+func parsePEMCertificate(raw []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("No PEM data found in certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// httpCertSource is a certSource that downloads certificates from SNS,
+// caching them by URL.
+type httpCertSource struct {
+	// The HTTP client to use for downloads.
+	client *http.Client
+
+	// The pattern that certificate URL hosts must match.
+	hostPattern *regexp.Regexp
+
+	// The certificate cache, and the lock that protects it.
+	mu    sync.Mutex
+	cache map[string]*x509.Certificate
+}
+
+// newHTTPCertSource returns a httpCertSource that only trusts URLs hosted
+// by SNS.
+func newHTTPCertSource() *httpCertSource {
+	return &httpCertSource{
+		client:      &http.Client{Timeout: time.Second * 10},
+		hostPattern: snsHostPattern,
+		cache:       make(map[string]*x509.Certificate),
+	}
+}
+
+// Certificate implements certSource for httpCertSource.
+func (s *httpCertSource) Certificate(certURL string) (*x509.Certificate, error) {
+	if _, err := validateSNSURL(certURL, s.hostPattern); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cert, ok := s.cache[certURL]; ok {
+		return cert, nil
+	}
+
+	defaultLogger.Infof("Fetching SNS signing certificate: %s", certURL)
+	resp, err := s.client.Get(certURL)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching signing certificate: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error fetching signing certificate: HTTP %d", resp.StatusCode)
+	}
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading signing certificate: %v", err)
+	}
+	cert, err := parsePEMCertificate(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing signing certificate: %v", err)
+	}
+
+	s.cache[certURL] = cert
+	return cert, nil
+}
+
+// dirCertSource is a certSource that loads pre-provisioned certificates from
+// a local directory, for hosts that cannot reach SNS to download them. The
+// certificate is looked up by the file name in the certificate URL.
+type dirCertSource struct {
+	// The directory to load certificates from.
+	dir string
+
+	// The pattern that certificate URL hosts must match.
+	hostPattern *regexp.Regexp
+}
+
+// Certificate implements certSource for dirCertSource.
+func (s *dirCertSource) Certificate(certURL string) (*x509.Certificate, error) {
+	u, err := validateSNSURL(certURL, s.hostPattern)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := ioutil.ReadFile(filepath.Join(s.dir, path.Base(u.Path)))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading signing certificate: %v", err)
+	}
+	return parsePEMCertificate(raw)
+}
+
+// snsServer is a http.Handler that acts as an SNS HTTP(S) subscription
+// endpoint. Notifications are verified, acknowledged, and then passed to
+// processMessage in the background.
+type snsServer struct {
+	// An AWS client instance.
+	client *awsClient
+
+	// The source for signing certificates.
+	certs certSource
+
+	// The topic ARNs that the server accepts messages from. If empty,
+	// messages from any topic are accepted.
+	topics map[string]bool
+
+	// The HTTP client used to confirm subscriptions.
+	httpClient *http.Client
+
+	// The pattern that subscription confirmation URL hosts must match.
+	hostPattern *regexp.Regexp
+
+	// The in-flight message count, and the wait group that tracks it.
+	inFlight     sync.WaitGroup
+	mu           sync.Mutex
+	inFlightSize int
+}
+
+// newSNSServer returns a new snsServer using the supplied client and
+// certificate source, accepting messages from the supplied topic ARNs.
+func newSNSServer(client *awsClient, certs certSource, topics []string) *snsServer {
+	s := &snsServer{
+		client:      client,
+		certs:       certs,
+		topics:      make(map[string]bool),
+		httpClient:  &http.Client{Timeout: time.Second * 10},
+		hostPattern: snsHostPattern,
+	}
+	for _, topic := range topics {
+		s.topics[topic] = true
+	}
+	return s
+}
+
+// ServeHTTP implements http.Handler for snsServer.
+func (s *snsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	raw, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSNSBodySize))
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+
+	envelope := snsEnvelope{}
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		defaultLogger.Errorf("Error parsing SNS envelope JSON: %v", err)
+		http.Error(w, "Error parsing request body", http.StatusBadRequest)
+		return
+	}
+	if envelope.Type != r.Header.Get(snsMessageTypeHeader) {
+		defaultLogger.Warnf("SNS message type %q does not match header %q", envelope.Type, r.Header.Get(snsMessageTypeHeader))
+		http.Error(w, "Message type mismatch", http.StatusBadRequest)
+		return
+	}
+	if len(s.topics) > 0 && !s.topics[envelope.TopicARN] {
+		defaultLogger.Warnf("Rejecting message from unknown topic %s", envelope.TopicARN)
+		http.Error(w, "Unknown topic", http.StatusForbidden)
+		return
+	}
+	if err := envelope.verify(s.certs); err != nil {
+		defaultLogger.Errorf("Error verifying SNS message %s: %v", envelope.MessageID, err)
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+
+	switch envelope.Type {
+	case snsTypeSubscriptionConfirmation:
+		if err := s.confirmSubscription(envelope); err != nil {
+			defaultLogger.Errorf("Error confirming subscription to %s: %v", envelope.TopicARN, err)
+			http.Error(w, "Error confirming subscription", http.StatusBadGateway)
+			return
+		}
+	case snsTypeUnsubscribeConfirmation:
+		defaultLogger.Infof("Unsubscribed from topic %s", envelope.TopicARN)
+	case snsTypeNotification:
+		defaultLogger.Infof("Received SNS message %s from topic %s", envelope.MessageID, envelope.TopicARN)
+		message, args, err := parseMessage([]byte(envelope.Message))
+		if err != nil {
+			http.Error(w, "Error parsing message", http.StatusBadRequest)
+			return
+		}
+		s.dispatch(message, args)
+	default:
+		http.Error(w, "Unsupported message type", http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// confirmSubscription confirms a subscription by visiting its SubscribeURL.
+func (s *snsServer) confirmSubscription(envelope snsEnvelope) error {
+	if _, err := validateSNSURL(envelope.SubscribeURL, s.hostPattern); err != nil {
+		return err
+	}
+
+	s.client.logger().Infof("Confirming subscription to topic %s", envelope.TopicARN)
+	resp, err := s.httpClient.Get(envelope.SubscribeURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// dispatch processes a message in the background, tracking it as in-flight
+// until it completes.
+//
+// Messages are processed after the request has been acknowledged, as waiting
+// for Route 53 to sync can take longer than SNS will wait for a response.
+func (s *snsServer) dispatch(message snsMessage, args messageArgs) {
+	s.mu.Lock()
+	s.inFlight.Add(1)
+	s.inFlightSize++
+	s.mu.Unlock()
+
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			s.inFlightSize--
+			s.mu.Unlock()
+			s.inFlight.Done()
+		}()
+		if err := processMessage(s.client, message, args); err != nil {
+			s.client.logger().Errorf("Error processing message for %s: %v", message.EC2InstanceID, err)
+		}
+	}()
+}
+
+// InFlight returns the number of messages currently being processed.
+func (s *snsServer) InFlight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inFlightSize
+}
+
+// Wait waits for all in-flight messages to finish processing, or for ctx to
+// be cancelled, whichever comes first.
+func (s *snsServer) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("Timed out waiting for %d in-flight messages", s.InFlight())
+	}
+}
+
+// runServer is the entry point for the server command. It runs an HTTP(S)
+// server until it receives SIGINT or SIGTERM, after which it stops accepting
+// new requests and waits for in-flight messages to finish processing.
+func runServer(args []string) error {
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	listen := flags.String("listen", ":8080", "The address to listen on.")
+	tlsCert := flags.String("tls-cert", "", "The TLS certificate file. Enables HTTPS when set with -tls-key.")
+	tlsKey := flags.String("tls-key", "", "The TLS key file. Enables HTTPS when set with -tls-cert.")
+	certDir := flags.String("sns-cert-dir", "", "Load SNS signing certificates from this directory instead of downloading them.")
+	topics := flags.String("topic-arn", "", "A comma-separated list of SNS topic ARNs to accept messages from. Defaults to any topic.")
+	shutdownTimeout := flags.Duration("shutdown-timeout", time.Minute*5, "How long to wait for in-flight messages on shutdown.")
+	coalesceWindow := flags.Duration("coalesce-window", 0, "If set, coalesce changes to the same zone received within this window into one batch.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	client, err := newAWSClient()
+	if err != nil {
+		return err
+	}
+	if *coalesceWindow > 0 {
+		client.aggregator = newChangeAggregator(client, *coalesceWindow)
+	}
+
+	var certs certSource = newHTTPCertSource()
+	if *certDir != "" {
+		certs = &dirCertSource{dir: *certDir, hostPattern: snsHostPattern}
+	}
+
+	var topicList []string
+	if *topics != "" {
+		topicList = strings.Split(*topics, ",")
+	}
+
+	s := newSNSServer(client, certs, topicList)
+	srv := &http.Server{Addr: *listen, Handler: s}
+
+	errCh := make(chan error, 1)
+	go func() {
+		defaultLogger.Infof("asg53 server listening on %s", *listen)
+		if *tlsCert != "" && *tlsKey != "" {
+			errCh <- srv.ListenAndServeTLS(*tlsCert, *tlsKey)
+		} else {
+			errCh <- srv.ListenAndServe()
+		}
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errCh:
+		return err
+	case sig := <-sigCh:
+		defaultLogger.Infof("Received %s, shutting down with %d messages in flight", sig, s.InFlight())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		return err
+	}
+	if err := s.Wait(ctx); err != nil {
+		return err
+	}
+
+	defaultLogger.Infof("asg53 server stopped.")
+	return nil
+}
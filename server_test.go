@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// testSNSCertURL is the signing certificate URL used in test SNS messages.
+const testSNSCertURL = "https://sns.us-west-2.amazonaws.com/SimpleNotificationService-test.pem"
+
+// testCertSource is a certSource that returns a single certificate for
+// testSNSCertURL.
+type testCertSource struct {
+	cert *x509.Certificate
+}
+
+// Certificate implements certSource for testCertSource.
+func (s *testCertSource) Certificate(certURL string) (*x509.Certificate, error) {
+	if certURL != testSNSCertURL {
+		return nil, errors.New("unknown certificate")
+	}
+	return s.cert, nil
+}
+
+// testSigningKey generates a key and self-signed certificate to sign test SNS
+// messages with.
+func testSigningKey(t *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.amazonaws.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	return key, cert
+}
+
+// signTestEnvelope signs an envelope with the supplied key and signature
+// version.
+func signTestEnvelope(t *testing.T, key *rsa.PrivateKey, e *snsEnvelope, version string) {
+	e.SignatureVersion = version
+	e.SigningCertURL = testSNSCertURL
+	var sig []byte
+	var err error
+	switch version {
+	case "1":
+		sum := sha1.Sum([]byte(e.stringToSign()))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA1, sum[:])
+	default:
+		sum := sha256.Sum256([]byte(e.stringToSign()))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	}
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	e.Signature = base64.StdEncoding.EncodeToString(sig)
+}
+
+// postEnvelope sends an envelope to the server and returns the response code.
+func postEnvelope(s *snsServer, e snsEnvelope) int {
+	body, _ := json.Marshal(e)
+	req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	req.Header.Set(snsMessageTypeHeader, e.Type)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestSNSEnvelopeVerify(t *testing.T) {
+	key, cert := testSigningKey(t)
+	certs := &testCertSource{cert: cert}
+
+	for _, version := range []string{"1", "2"} {
+		e := snsEnvelope{
+			Type:      snsTypeNotification,
+			MessageID: "message",
+			TopicARN:  "arn:aws:sns:us-west-2:123456789012:asg53",
+			Message:   testMessageJSON,
+			Timestamp: "2016-11-11T21:30:34.000Z",
+		}
+		signTestEnvelope(t, key, &e, version)
+
+		if err := e.verify(certs); err != nil {
+			t.Fatalf("Bad (version %s): %v", version, err)
+		}
+
+		e.Message = "tampered"
+		if err := e.verify(certs); err == nil {
+			t.Fatalf("Expected error on tampered message (version %s), got none", version)
+		}
+	}
+}
+
+func TestValidateSNSURL(t *testing.T) {
+	cases := map[string]bool{
+		"https://sns.us-west-2.amazonaws.com/cert.pem":     true,
+		"https://sns.cn-north-1.amazonaws.com.cn/cert.pem": true,
+		"http://sns.us-west-2.amazonaws.com/cert.pem":      false,
+		"https://sns.us-west-2.amazonaws.com.evil.com/":    false,
+		"https://evil.com/sns.us-west-2.amazonaws.com/":    false,
+	}
+
+	for u, expected := range cases {
+		_, err := validateSNSURL(u, snsHostPattern)
+		if (err == nil) != expected {
+			t.Fatalf("Expected %s valid to be %t, got error %v", u, expected, err)
+		}
+	}
+}
+
+func TestSNSServer_notification(t *testing.T) {
+	key, cert := testSigningKey(t)
+	s := newSNSServer(testAwsClient(), &testCertSource{cert: cert}, nil)
+
+	msg, _ := json.Marshal(map[string]string{
+		"EC2InstanceId":        "i-123456789",
+		"AutoScalingGroupName": "ASGName",
+		"LifecycleHookName":    "Lifecycle",
+		"LifecycleActionToken": "Token",
+		"LifecycleTransition":  transitionLaunch,
+		"NotificationMetadata": testMetadataJSON,
+	})
+	e := snsEnvelope{
+		Type:      snsTypeNotification,
+		MessageID: "message",
+		TopicARN:  "arn:aws:sns:us-west-2:123456789012:asg53",
+		Message:   string(msg),
+		Timestamp: "2016-11-11T21:30:34.000Z",
+	}
+	signTestEnvelope(t, key, &e, "2")
+
+	if code := postEnvelope(s, e); code != http.StatusOK {
+		t.Fatalf("Expected HTTP 200, got %d", code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if err := s.Wait(ctx); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if s.InFlight() != 0 {
+		t.Fatalf("Expected no messages in flight, got %d", s.InFlight())
+	}
+}
+
+func TestSNSServer_shouldReject(t *testing.T) {
+	key, cert := testSigningKey(t)
+	s := newSNSServer(testAwsClient(), &testCertSource{cert: cert}, []string{"arn:aws:sns:us-west-2:123456789012:asg53"})
+
+	e := snsEnvelope{
+		Type:      snsTypeNotification,
+		MessageID: "message",
+		TopicARN:  "arn:aws:sns:us-west-2:123456789012:asg53",
+		Message:   testMessageJSON,
+		Timestamp: "2016-11-11T21:30:34.000Z",
+	}
+	signTestEnvelope(t, key, &e, "2")
+
+	bad := e
+	bad.Signature = base64.StdEncoding.EncodeToString([]byte("bad"))
+	if code := postEnvelope(s, bad); code != http.StatusForbidden {
+		t.Fatalf("Expected HTTP 403 for bad signature, got %d", code)
+	}
+
+	other := e
+	other.TopicARN = "arn:aws:sns:us-west-2:123456789012:other"
+	signTestEnvelope(t, key, &other, "2")
+	if code := postEnvelope(s, other); code != http.StatusForbidden {
+		t.Fatalf("Expected HTTP 403 for unknown topic, got %d", code)
+	}
+}
+
+func TestSNSServer_subscriptionConfirmation(t *testing.T) {
+	key, cert := testSigningKey(t)
+
+	confirmed := false
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		confirmed = r.URL.Query().Get("Token") == "token"
+	}))
+	defer ts.Close()
+
+	s := newSNSServer(testAwsClient(), &testCertSource{cert: cert}, nil)
+	s.httpClient = ts.Client()
+	s.hostPattern = regexp.MustCompile(`^127\.0\.0\.1:\d+$`)
+
+	e := snsEnvelope{
+		Type:         snsTypeSubscriptionConfirmation,
+		MessageID:    "message",
+		Token:        "token",
+		TopicARN:     "arn:aws:sns:us-west-2:123456789012:asg53",
+		Message:      "You have chosen to subscribe to the topic",
+		SubscribeURL: ts.URL + "/?Action=ConfirmSubscription&Token=token",
+		Timestamp:    "2016-11-11T21:30:34.000Z",
+	}
+	signTestEnvelope(t, key, &e, "1")
+
+	if code := postEnvelope(s, e); code != http.StatusOK {
+		t.Fatalf("Expected HTTP 200, got %d", code)
+	}
+	if !confirmed {
+		t.Fatal("Expected subscription to be confirmed")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/private/protocol/query"
+)
+
+// The SNS service is not vendored with the SDK, so this file implements the
+// Publish API for failure notifications, using the same client plumbing and
+// query protocol handlers as the generated service clients.
+
+// snsServiceName is the service name used for endpoint and signing lookups.
+const snsServiceName = "sns"
+
+// snsPublishInput is the input for the SNS Publish API.
+type snsPublishInput struct {
+	_ struct{} `type:"structure"`
+
+	Message *string `type:"string" required:"true"`
+
+	Subject *string `type:"string"`
+
+	TopicArn *string `type:"string"`
+}
+
+// snsPublishOutput is the output for the SNS Publish API.
+type snsPublishOutput struct {
+	_ struct{} `type:"structure"`
+
+	MessageId *string `type:"string"`
+}
+
+// snsClient is a minimal SNS client.
+type snsClient struct {
+	*client.Client
+}
+
+// newSNSClient returns an snsClient using the supplied config provider
+// (usually a session), with cfgs applied on top.
+func newSNSClient(p client.ConfigProvider, cfgs ...*aws.Config) *snsClient {
+	c := p.ClientConfig(snsServiceName, cfgs...)
+	s := &snsClient{
+		Client: client.New(
+			*c.Config,
+			metadata.ClientInfo{
+				ServiceName:   snsServiceName,
+				SigningRegion: c.SigningRegion,
+				Endpoint:      c.Endpoint,
+				APIVersion:    "2010-03-31",
+			},
+			c.Handlers,
+		),
+	}
+
+	s.Handlers.Sign.PushBackNamed(v4.SignRequestHandler)
+	s.Handlers.Build.PushBackNamed(query.BuildHandler)
+	s.Handlers.Unmarshal.PushBackNamed(query.UnmarshalHandler)
+	s.Handlers.UnmarshalMeta.PushBackNamed(query.UnmarshalMetaHandler)
+	s.Handlers.UnmarshalError.PushBackNamed(query.UnmarshalErrorHandler)
+
+	return s
+}
+
+// Publish publishes a message to the supplied topic, and returns its message
+// ID.
+func (s *snsClient) Publish(topicARN, subject, message string) (string, error) {
+	op := &request.Operation{
+		Name:       "Publish",
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}
+	params := &snsPublishInput{
+		Message:  aws.String(message),
+		Subject:  aws.String(subject),
+		TopicArn: aws.String(topicARN),
+	}
+	out := &snsPublishOutput{}
+	if err := s.NewRequest(op, params, out).Send(); err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.MessageId), nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// Route 53 limits for a single ChangeResourceRecordSets request. For more
+// information, see
+// http://docs.aws.amazon.com/Route53/latest/DeveloperGuide/DNSLimitations.html#limits-api-requests-changeresourcerecordsets.
+const (
+	// The maximum number of changes in a request.
+	maxBatchChanges = 1000
+
+	// The maximum number of resource records in a request. UPSERTs count
+	// twice.
+	maxBatchRecords = 1000
+
+	// The maximum number of characters in all resource record values in a
+	// request. UPSERTs count twice.
+	maxBatchValueChars = 32000
+)
+
+// changeUnit is a group of adjacent changes that must be sent in the same
+// change batch, such as a DELETE and CREATE pair that replaces a resource
+// record set.
+type changeUnit struct {
+	// The changes in the unit.
+	changes []*route53.Change
+
+	// The number of resource records in the unit, as Route 53 counts them.
+	records int
+
+	// The number of value characters in the unit, as Route 53 counts them.
+	valueChars int
+}
+
+// add adds a change to the unit, updating its counts.
+func (u *changeUnit) add(change *route53.Change) {
+	weight := 1
+	if aws.StringValue(change.Action) == route53.ChangeActionUpsert {
+		weight = 2
+	}
+	u.changes = append(u.changes, change)
+	for _, rr := range change.ResourceRecordSet.ResourceRecords {
+		u.records += weight
+		u.valueChars += len(aws.StringValue(rr.Value)) * weight
+	}
+}
+
+// groupChangeUnits groups a change batch into changeUnits. Adjacent changes
+// that operate on the same resource record set are kept in the same unit.
+func groupChangeUnits(batch []*route53.Change) []*changeUnit {
+	units := []*changeUnit{}
+	var current *changeUnit
+	for n, change := range batch {
+		if current == nil || rrSetKey(change) != rrSetKey(batch[n-1]) {
+			current = &changeUnit{}
+			units = append(units, current)
+		}
+		current.add(change)
+	}
+	return units
+}
+
+// splitChangeBatch splits a change batch into batches that fit within the
+// Route 53 request limits, preserving the order of the changes. Adjacent
+// changes that operate on the same resource record set, such as a DELETE and
+// CREATE pair, are never split across batches.
+//
+// An error is returned if a single group of changes exceeds the limits on
+// its own.
+func splitChangeBatch(batch []*route53.Change) ([][]*route53.Change, error) {
+	chunks := [][]*route53.Change{}
+	chunk := []*route53.Change{}
+	records, valueChars := 0, 0
+
+	for _, unit := range groupChangeUnits(batch) {
+		if len(unit.changes) > maxBatchChanges || unit.records > maxBatchRecords || unit.valueChars > maxBatchValueChars {
+			return nil, fmt.Errorf("Changes for %s exceed the Route 53 change batch limits", *unit.changes[0].ResourceRecordSet.Name)
+		}
+		if len(chunk)+len(unit.changes) > maxBatchChanges || records+unit.records > maxBatchRecords || valueChars+unit.valueChars > maxBatchValueChars {
+			chunks = append(chunks, chunk)
+			chunk = []*route53.Change{}
+			records, valueChars = 0, 0
+		}
+		chunk = append(chunk, unit.changes...)
+		records += unit.records
+		valueChars += unit.valueChars
+	}
+
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+func TestSplitChangeBatch(t *testing.T) {
+	batch := []*route53.Change{}
+	for i := 0; i < 1500; i++ {
+		batch = append(batch, testChange("CREATE", fmt.Sprintf("%d.example.com.", i), "10.0.0.1"))
+	}
+
+	chunks, err := splitChangeBatch(batch)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if len(chunks) != 2 || len(chunks[0]) != 1000 || len(chunks[1]) != 500 {
+		t.Fatalf("Expected chunks of 1000 and 500, got %d chunks", len(chunks))
+	}
+	if *chunks[1][0].ResourceRecordSet.Name != "1000.example.com." {
+		t.Fatalf("Expected order to be preserved, got %s", *chunks[1][0].ResourceRecordSet.Name)
+	}
+}
+
+func TestSplitChangeBatch_upsertCountsDouble(t *testing.T) {
+	batch := []*route53.Change{}
+	for i := 0; i < 600; i++ {
+		batch = append(batch, testChange("UPSERT", fmt.Sprintf("%d.example.com.", i), "10.0.0.1"))
+	}
+
+	chunks, err := splitChangeBatch(batch)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if len(chunks) != 2 || len(chunks[0]) != 500 {
+		t.Fatalf("Expected chunks of 500 and 100, got %d chunks", len(chunks))
+	}
+}
+
+func TestSplitChangeBatch_valueChars(t *testing.T) {
+	value := strings.Repeat("a", 255)
+	batch := []*route53.Change{}
+	for i := 0; i < 200; i++ {
+		batch = append(batch, testChange("CREATE", fmt.Sprintf("%d.example.com.", i), value))
+	}
+
+	chunks, err := splitChangeBatch(batch)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if len(chunks) != 2 || len(chunks[0]) != 32000/255 {
+		t.Fatalf("Expected first chunk to have %d changes, got %d chunks", 32000/255, len(chunks))
+	}
+}
+
+func TestSplitChangeBatch_keepsPairs(t *testing.T) {
+	batch := []*route53.Change{}
+	for i := 0; i < 999; i++ {
+		batch = append(batch, testChange("CREATE", fmt.Sprintf("%d.example.com.", i), "10.0.0.1"))
+	}
+	batch = append(batch,
+		testChange("DELETE", "pair.example.com.", "10.0.0.1"),
+		testChange("CREATE", "pair.example.com.", "10.0.0.2"),
+	)
+
+	chunks, err := splitChangeBatch(batch)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if len(chunks) != 2 || len(chunks[0]) != 999 || len(chunks[1]) != 2 {
+		t.Fatalf("Expected DELETE and CREATE pair to be kept together, got %d chunks", len(chunks))
+	}
+}
+
+func TestSplitChangeBatch_shouldError(t *testing.T) {
+	change := testChange("CREATE", "big.example.com.", "10.0.0.1")
+	for i := 0; i < 1000; i++ {
+		change.ResourceRecordSet.ResourceRecords = append(change.ResourceRecordSet.ResourceRecords, change.ResourceRecordSet.ResourceRecords[0])
+	}
+
+	if _, err := splitChangeBatch([]*route53.Change{change}); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+}
+
+func TestSendRoute53ChangeBatch_split(t *testing.T) {
+	batch := []*route53.Change{}
+	for i := 0; i < 2500; i++ {
+		batch = append(batch, testChange("CREATE", fmt.Sprintf("%d.example.com.", i), "10.0.0.1"))
+	}
+
+	client := testAwsClient()
+	if err := client.SendRoute53ChangeBatch("ABCDEF0123456789", batch); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/private/protocol/query"
+)
+
+// The SQS service is not vendored with the SDK, so this file implements the
+// small subset of the SQS API that the worker needs, using the same client
+// plumbing and query protocol handlers as the generated service clients.
+
+// sqsServiceName is the service name used for endpoint and signing lookups.
+const sqsServiceName = "sqs"
+
+// sqsReceiveMessageInput is the input for the SQS ReceiveMessage API.
+type sqsReceiveMessageInput struct {
+	_ struct{} `type:"structure"`
+
+	MaxNumberOfMessages *int64 `type:"integer"`
+
+	QueueUrl *string `type:"string" required:"true"`
+
+	VisibilityTimeout *int64 `type:"integer"`
+
+	WaitTimeSeconds *int64 `type:"integer"`
+}
+
+// sqsMessage is a message returned by the SQS ReceiveMessage API.
+type sqsMessage struct {
+	_ struct{} `type:"structure"`
+
+	Body *string `type:"string"`
+
+	MessageId *string `type:"string"`
+
+	ReceiptHandle *string `type:"string"`
+}
+
+// sqsReceiveMessageOutput is the output for the SQS ReceiveMessage API.
+type sqsReceiveMessageOutput struct {
+	_ struct{} `type:"structure"`
+
+	Messages []*sqsMessage `locationNameList:"Message" type:"list" flattened:"true"`
+}
+
+// sqsDeleteMessageInput is the input for the SQS DeleteMessage API.
+type sqsDeleteMessageInput struct {
+	_ struct{} `type:"structure"`
+
+	QueueUrl *string `type:"string" required:"true"`
+
+	ReceiptHandle *string `type:"string" required:"true"`
+}
+
+// sqsChangeMessageVisibilityInput is the input for the SQS
+// ChangeMessageVisibility API.
+type sqsChangeMessageVisibilityInput struct {
+	_ struct{} `type:"structure"`
+
+	QueueUrl *string `type:"string" required:"true"`
+
+	ReceiptHandle *string `type:"string" required:"true"`
+
+	VisibilityTimeout *int64 `type:"integer" required:"true"`
+}
+
+// sqsEmptyOutput is the output for SQS APIs that return no data.
+type sqsEmptyOutput struct {
+	_ struct{} `type:"structure"`
+}
+
+// sqsQueue is a messageQueue backed by an SQS queue.
+type sqsQueue struct {
+	// The SQS client.
+	*client.Client
+
+	// The URL of the queue.
+	queueURL string
+}
+
+// newSQSQueue returns a sqsQueue for the supplied queue URL, using the
+// supplied config provider (usually a session).
+func newSQSQueue(p client.ConfigProvider, queueURL string) *sqsQueue {
+	c := p.ClientConfig(sqsServiceName)
+	q := &sqsQueue{
+		Client: client.New(
+			*c.Config,
+			metadata.ClientInfo{
+				ServiceName:   sqsServiceName,
+				SigningRegion: c.SigningRegion,
+				Endpoint:      c.Endpoint,
+				APIVersion:    "2012-11-05",
+			},
+			c.Handlers,
+		),
+		queueURL: queueURL,
+	}
+
+	q.Handlers.Sign.PushBackNamed(v4.SignRequestHandler)
+	q.Handlers.Build.PushBackNamed(query.BuildHandler)
+	q.Handlers.Unmarshal.PushBackNamed(query.UnmarshalHandler)
+	q.Handlers.UnmarshalMeta.PushBackNamed(query.UnmarshalMetaHandler)
+	q.Handlers.UnmarshalError.PushBackNamed(query.UnmarshalErrorHandler)
+
+	return q
+}
+
+// send sends a request for the named SQS operation.
+func (q *sqsQueue) send(name string, params, data interface{}) error {
+	op := &request.Operation{
+		Name:       name,
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}
+	return q.NewRequest(op, params, data).Send()
+}
+
+// Receive implements messageQueue for sqsQueue.
+func (q *sqsQueue) Receive(max int, wait time.Duration) ([]queueMessage, error) {
+	params := &sqsReceiveMessageInput{
+		MaxNumberOfMessages: aws.Int64(int64(max)),
+		QueueUrl:            aws.String(q.queueURL),
+		WaitTimeSeconds:     aws.Int64(int64(wait / time.Second)),
+	}
+	out := &sqsReceiveMessageOutput{}
+	if err := q.send("ReceiveMessage", params, out); err != nil {
+		return nil, err
+	}
+
+	msgs := []queueMessage{}
+	for _, m := range out.Messages {
+		msgs = append(msgs, queueMessage{
+			ID:            aws.StringValue(m.MessageId),
+			Body:          aws.StringValue(m.Body),
+			ReceiptHandle: aws.StringValue(m.ReceiptHandle),
+		})
+	}
+	return msgs, nil
+}
+
+// Delete implements messageQueue for sqsQueue.
+func (q *sqsQueue) Delete(msg queueMessage) error {
+	params := &sqsDeleteMessageInput{
+		QueueUrl:      aws.String(q.queueURL),
+		ReceiptHandle: aws.String(msg.ReceiptHandle),
+	}
+	return q.send("DeleteMessage", params, &sqsEmptyOutput{})
+}
+
+// ExtendVisibility implements messageQueue for sqsQueue.
+func (q *sqsQueue) ExtendVisibility(msg queueMessage, timeout time.Duration) error {
+	params := &sqsChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(q.queueURL),
+		ReceiptHandle:     aws.String(msg.ReceiptHandle),
+		VisibilityTimeout: aws.Int64(int64(timeout / time.Second)),
+	}
+	return q.send("ChangeMessageVisibility", params, &sqsEmptyOutput{})
+}
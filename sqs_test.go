@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// testSQSReceiveResponse is a test SQS ReceiveMessage response.
+const testSQSReceiveResponse = `<ReceiveMessageResponse>
+  <ReceiveMessageResult>
+    <Message>
+      <MessageId>message-1</MessageId>
+      <ReceiptHandle>receipt-1</ReceiptHandle>
+      <Body>body-1</Body>
+    </Message>
+    <Message>
+      <MessageId>message-2</MessageId>
+      <ReceiptHandle>receipt-2</ReceiptHandle>
+      <Body>body-2</Body>
+    </Message>
+  </ReceiveMessageResult>
+  <ResponseMetadata>
+    <RequestId>request</RequestId>
+  </ResponseMetadata>
+</ReceiveMessageResponse>`
+
+// testSQSQueue returns a sqsQueue that sends requests to the supplied test
+// server.
+func testSQSQueue(ts *httptest.Server) *sqsQueue {
+	sess := session.New(&aws.Config{
+		Endpoint:    aws.String(ts.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+	})
+	return newSQSQueue(sess, "https://sqs.us-west-2.amazonaws.com/123456789012/asg53")
+}
+
+func TestSQSQueue(t *testing.T) {
+	actions := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		actions = append(actions, r.Form.Get("Action"))
+		switch r.Form.Get("Action") {
+		case "ReceiveMessage":
+			if r.Form.Get("WaitTimeSeconds") != "20" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, testSQSReceiveResponse)
+		case "DeleteMessage", "ChangeMessageVisibility":
+			if r.Form.Get("ReceiptHandle") != "receipt-1" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintf(w, "<%sResponse></%sResponse>", r.Form.Get("Action"), r.Form.Get("Action"))
+		}
+	}))
+	defer ts.Close()
+
+	q := testSQSQueue(ts)
+
+	msgs, err := q.Receive(10, time.Second*20)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if len(msgs) != 2 || msgs[1].Body != "body-2" || msgs[0].ReceiptHandle != "receipt-1" {
+		t.Fatalf("Unexpected messages: %#v", msgs)
+	}
+
+	if err := q.ExtendVisibility(msgs[0], time.Minute); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if err := q.Delete(msgs[0]); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	expected := []string{"ReceiveMessage", "ChangeMessageVisibility", "DeleteMessage"}
+	if fmt.Sprint(actions) != fmt.Sprint(expected) {
+		t.Fatalf("Expected actions %v, got %v", expected, actions)
+	}
+}
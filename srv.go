@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+const (
+	// defaultSRVPoolTTL is the TTL of SRV pools that are created without a
+	// TTL.
+	defaultSRVPoolTTL = 300
+
+	// srvPoolAttempts is the number of times a batch with SRV pool updates is
+	// attempted, when it conflicts with a concurrent update to the same pool.
+	srvPoolAttempts = 5
+)
+
+// srvMember is an instance's entry in a shared SRV resource record set, such
+// as one used for service discovery. On launch, the instance's entry is added
+// to the record set, and on termination it is removed again, leaving the
+// entries for other instances in place. The record set is deleted when its
+// last entry is removed.
+//
+// Entries are matched on Port and the rendered Target, so Target should not
+// depend on data that is missing on termination, such as IP addresses.
+type srvMember struct {
+	// The name of the SRV resource record set. Can be templated.
+	Name string
+
+	// The TTL of the resource record set. If not set, the TTL of the existing
+	// record set is kept, or 300 is used for a new record set.
+	TTL int64
+
+	// The priority, weight, and port of the entry.
+	Priority int64
+	Weight   int64
+	Port     int64
+
+	// The target host name of the entry. Can be templated.
+	Target string
+}
+
+// srvPoolUpdate is a rendered change to the membership of an SRV pool.
+type srvPoolUpdate struct {
+	// The name of the SRV resource record set.
+	Name string
+
+	// The TTL to use for the record set, or 0 to keep the existing TTL.
+	TTL int64
+
+	// The entry to add or remove.
+	Priority int64
+	Weight   int64
+	Port     int64
+	Target   string
+
+	// true if the entry is to be removed.
+	Remove bool
+}
+
+// value returns the SRV record value for the entry.
+func (u *srvPoolUpdate) value() string {
+	return fmt.Sprintf("%d %d %d %s", u.Priority, u.Weight, u.Port, u.Target)
+}
+
+// key returns the key that identifies the entry in the pool.
+func (u *srvPoolUpdate) key() string {
+	return fmt.Sprintf("%d %s", u.Port, normalizeZoneName(u.Target))
+}
+
+// inverse returns the update that undoes u.
+func (u *srvPoolUpdate) inverse() *srvPoolUpdate {
+	inverse := *u
+	inverse.Remove = !u.Remove
+	return &inverse
+}
+
+// srvValueKey returns the key that identifies the SRV record value in its
+// pool - its port and target. The value is returned as-is if it is not a
+// valid SRV record value.
+func srvValueKey(value string) string {
+	fields := strings.Fields(value)
+	if len(fields) != 4 {
+		return value
+	}
+	return fields[2] + " " + normalizeZoneName(fields[3])
+}
+
+// apply returns values with the entry added or removed. An existing entry
+// with the same port and target is replaced when adding.
+func (u *srvPoolUpdate) apply(values []string) []string {
+	updated := []string{}
+	for _, value := range values {
+		if srvValueKey(value) != u.key() {
+			updated = append(updated, value)
+		}
+	}
+	if !u.Remove {
+		updated = append(updated, u.value())
+	}
+	return updated
+}
+
+// renderSRVMembers renders the SRV pool members in args with the data for the
+// supplied instance ID. Members are added on launch and removed on
+// termination. Nothing is returned for any other transition.
+func renderSRVMembers(client *awsClient, instanceID string, args zoneArgs, transition string) ([]*srvPoolUpdate, error) {
+	if len(args.SRVMembers) < 1 || (transition != transitionLaunch && transition != transitionTerminate) {
+		return nil, nil
+	}
+
+	data, err := populate(client, instanceID, args.HostedZoneID, nil)
+	if err != nil {
+		client.logger().Errorf("Error fetching instance information: %v", err)
+		return nil, err
+	}
+
+	updates := []*srvPoolUpdate{}
+	for n, member := range args.SRVMembers {
+		name, err := data.render(fmt.Sprintf("SRV member #%d .Name", n), member.Name)
+		if err != nil {
+			return nil, err
+		}
+		target, err := data.render(fmt.Sprintf("SRV member #%d .Target", n), member.Target)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" || target == "" {
+			return nil, fmt.Errorf("SRV member #%d needs a Name and Target", n)
+		}
+		updates = append(updates, &srvPoolUpdate{
+			Name:     name,
+			TTL:      member.TTL,
+			Priority: member.Priority,
+			Weight:   member.Weight,
+			Port:     member.Port,
+			Target:   target,
+			Remove:   transition == transitionTerminate,
+		})
+		client.logger().Infof("SRV pool entry rendered: %s %s (remove: %t)", name, updates[n].value(), updates[n].Remove)
+	}
+	return updates, nil
+}
+
+// poolChanges reads the current state of the SRV pools in updates, and
+// returns the changes that apply the updates to them. Each pool that changes
+// is replaced with a DELETE of the exact existing record set and a CREATE of
+// the updated one, so that the batch fails if another update to the pool
+// lands in between, instead of overwriting it.
+func (c *awsClient) poolChanges(zoneID string, updates []*srvPoolUpdate) ([]*route53.Change, error) {
+	names := []string{}
+	byName := make(map[string][]*srvPoolUpdate)
+	for _, u := range updates {
+		name := normalizeZoneName(u.Name)
+		if _, ok := byName[name]; !ok {
+			names = append(names, name)
+		}
+		byName[name] = append(byName[name], u)
+	}
+
+	changes := []*route53.Change{}
+	for _, name := range names {
+		lookup := &route53.Change{ResourceRecordSet: &route53.ResourceRecordSet{Name: aws.String(name), Type: aws.String(route53.RRTypeSrv)}}
+		existing, err := c.findExistingRRSet(zoneID, lookup)
+		if err != nil {
+			return nil, err
+		}
+
+		before := []string{}
+		ttl := int64(defaultSRVPoolTTL)
+		if existing != nil {
+			for _, rr := range existing.ResourceRecords {
+				before = append(before, aws.StringValue(rr.Value))
+			}
+			ttl = aws.Int64Value(existing.TTL)
+		}
+
+		after := before
+		for _, u := range byName[name] {
+			after = u.apply(after)
+			if u.TTL > 0 {
+				ttl = u.TTL
+			}
+		}
+
+		if existing != nil && ttl == aws.Int64Value(existing.TTL) && strings.Join(before, "\n") == strings.Join(after, "\n") {
+			c.logger().With("zone_id", zoneID).Infof("SRV pool %s is already up to date", name)
+			continue
+		}
+		if existing != nil {
+			changes = append(changes, &route53.Change{Action: aws.String(route53.ChangeActionDelete), ResourceRecordSet: existing})
+		}
+		if len(after) > 0 {
+			rrSet := &route53.ResourceRecordSet{
+				Name: aws.String(name),
+				Type: aws.String(route53.RRTypeSrv),
+				TTL:  aws.Int64(ttl),
+			}
+			for _, value := range after {
+				rrSet.ResourceRecords = append(rrSet.ResourceRecords, &route53.ResourceRecord{Value: aws.String(value)})
+			}
+			changes = append(changes, &route53.Change{Action: aws.String(route53.ChangeActionCreate), ResourceRecordSet: rrSet})
+		}
+	}
+	return changes, nil
+}
+
+// changeConflictMessages are the parts of InvalidChangeBatch messages that
+// Route 53 returns for a DELETE of a record set that has been deleted or
+// changed since it was read, or a CREATE of a record set that has been
+// created since it was read, such as by another instance joining an empty
+// SRV pool at the same time.
+var changeConflictMessages = []string{
+	"but it was not found",
+	"values provided do not match the current values",
+	"but it already exists",
+}
+
+// isChangeConflict returns true if err is from a change batch that Route 53
+// rejected because a DELETE or CREATE does not match the current record set,
+// which happens when it has been changed since it was read. Other invalid change
+// batches, such as ones with bad values, are not conflicts.
+func isChangeConflict(err error) bool {
+	if batchErr, ok := err.(*changeBatchError); ok {
+		err = batchErr.err
+	}
+	awsErr, ok := err.(awserr.Error)
+	if !ok || awsErr.Code() != "InvalidChangeBatch" {
+		return false
+	}
+	for _, msg := range changeConflictMessages {
+		if strings.Contains(awsErr.Message(), msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// send sends the batch to Route 53 with submitChanges, along with the
+// changes for its SRV pool updates. If the batch conflicts with a concurrent
+// update to one of the pools, the pools are read again and the batch is
+// retried, up to srvPoolAttempts times.
+func (b zoneBatch) send(c *awsClient) error {
+	client := b.clientFor(c)
+	for attempt := 1; ; attempt++ {
+		poolChanges, err := client.poolChanges(b.ZoneID, b.pools)
+		if err != nil {
+			return err
+		}
+		changes := append(append([]*route53.Change{}, b.Changes...), poolChanges...)
+		if len(changes) < 1 {
+			client.logger().With("zone_id", b.ZoneID).Infof("No changes to send to zone ID %s", b.ZoneID)
+			return nil
+		}
+
+		err = client.submitChanges(b.ZoneID, changes)
+		if err == nil || len(b.pools) < 1 || !isChangeConflict(err) || attempt >= srvPoolAttempts {
+			return err
+		}
+		client.logger().With("zone_id", b.ZoneID).Warnf("Change batch for zone ID %s conflicts with a concurrent SRV pool update, retrying (attempt %d of %d): %v", b.ZoneID, attempt, srvPoolAttempts, err)
+	}
+}
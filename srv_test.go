@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/paybyphone/asg53/teststubs"
+)
+
+// testSRVMetadataJSON is a test SNS message in JSON form, with an SRV pool
+// member.
+const testSRVMetadataJSON = `
+{
+  "HostedZoneID": "ABCDEF0123456789",
+  "SRVMembers": [
+    {
+      "Name": "_app._tcp.example.com.",
+      "Priority": 10,
+      "Weight": 5,
+      "Port": 8080,
+      "Target": "{{.InstanceID}}.example.com."
+    }
+  ]
+}
+`
+
+func TestSRVPoolUpdateApply(t *testing.T) {
+	values := []string{"10 5 8080 a.example.com.", "10 5 8080 b.example.com."}
+
+	add := &srvPoolUpdate{Priority: 20, Weight: 1, Port: 8080, Target: "c.example.com"}
+	expected := []string{"10 5 8080 a.example.com.", "10 5 8080 b.example.com.", "20 1 8080 c.example.com"}
+	if actual := add.apply(values); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+
+	replace := &srvPoolUpdate{Priority: 20, Weight: 1, Port: 8080, Target: "A.example.com"}
+	expected = []string{"10 5 8080 b.example.com.", "20 1 8080 A.example.com"}
+	if actual := replace.apply(values); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+
+	remove := &srvPoolUpdate{Priority: 10, Weight: 5, Port: 8080, Target: "b.example.com.", Remove: true}
+	expected = []string{"10 5 8080 a.example.com."}
+	if actual := remove.apply(values); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+
+	otherPort := &srvPoolUpdate{Port: 9090, Target: "a.example.com.", Remove: true}
+	if actual := otherPort.apply(values); !reflect.DeepEqual(actual, values) {
+		t.Fatalf("Expected %v, got %v", values, actual)
+	}
+}
+
+func TestPoolChanges(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Update   *srvPoolUpdate
+		Expected []string
+	}{
+		{
+			"add to existing",
+			&srvPoolUpdate{Name: "_app._tcp.example.com.", Priority: 10, Weight: 5, Port: 8080, Target: "i-123456789.example.com."},
+			[]string{"DELETE 10 5 8080 i-987654321.example.com.", "CREATE 10 5 8080 i-987654321.example.com.,10 5 8080 i-123456789.example.com."},
+		},
+		{
+			"remove last",
+			&srvPoolUpdate{Name: "_app._tcp.example.com.", Port: 8080, Target: "i-987654321.example.com.", Remove: true},
+			[]string{"DELETE 10 5 8080 i-987654321.example.com."},
+		},
+		{
+			"create",
+			&srvPoolUpdate{Name: "_web._tcp.example.com.", Priority: 10, Weight: 5, Port: 80, Target: "i-123456789.example.com."},
+			[]string{"CREATE 10 5 80 i-123456789.example.com."},
+		},
+		{
+			"already member",
+			&srvPoolUpdate{Name: "_app._tcp.example.com.", Priority: 10, Weight: 5, Port: 8080, Target: "i-987654321.example.com."},
+			[]string{},
+		},
+		{
+			"already removed",
+			&srvPoolUpdate{Name: "_app._tcp.example.com.", Port: 8080, Target: "i-123456789.example.com.", Remove: true},
+			[]string{},
+		},
+	}
+
+	client := testAwsClient()
+	for _, c := range cases {
+		changes, err := client.poolChanges("ABCDEF0123456789", []*srvPoolUpdate{c.Update})
+		if err != nil {
+			t.Fatalf("%s: bad: %v", c.Name, err)
+		}
+		actual := []string{}
+		for _, change := range changes {
+			values := ""
+			for n, rr := range change.ResourceRecordSet.ResourceRecords {
+				if n > 0 {
+					values += ","
+				}
+				values += *rr.Value
+			}
+			actual = append(actual, *change.Action+" "+values)
+		}
+		if !reflect.DeepEqual(actual, c.Expected) {
+			t.Fatalf("%s: expected %v, got %v", c.Name, c.Expected, actual)
+		}
+	}
+}
+
+func TestRenderZoneBatches_srv(t *testing.T) {
+	defer teststubs.ResetRoute53ChangeLog()
+	teststubs.ResetRoute53ChangeLog()
+
+	metadata, err := parseSNSMetadata([]byte(testSRVMetadataJSON))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+
+	client := testAwsClient()
+	batches, err := renderZoneBatches(client, "i-123456789", metadata, transitionLaunch, "")
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if len(batches) != 1 || len(batches[0].pools) != 1 || batches[0].pools[0].value() != "10 5 8080 i-123456789.example.com." {
+		t.Fatalf("Expected one SRV pool update, got %#v", batches)
+	}
+
+	if err := client.applyZoneBatches(batches); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	log := teststubs.Route53ChangeLog()
+	if len(log) != 1 || len(log[0].ChangeBatch.Changes) != 2 {
+		t.Fatalf("Expected one change batch with a DELETE and CREATE, got %v", log)
+	}
+
+	batches, err = renderZoneBatches(client, "i-123456789", metadata, transitionTerminate, "")
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if len(batches) != 1 || !batches[0].pools[0].Remove {
+		t.Fatalf("Expected SRV pool removal on termination, got %#v", batches)
+	}
+}
+
+func TestZoneBatchSend_conflict(t *testing.T) {
+	defer teststubs.ResetRoute53ChangeLog()
+	defer teststubs.ResetRoute53Errors()
+	teststubs.ResetRoute53ChangeLog()
+	teststubs.InjectRoute53Errors("ChangeResourceRecordSets",
+		"InvalidChangeBatch: [Tried to delete resource record set [name='_app._tcp.example.com.', type='SRV'] but it was not found]",
+		"InvalidChangeBatch: [Tried to delete resource record set [name='_app._tcp.example.com.', type='SRV'] but the values provided do not match the current values]",
+	)
+
+	batch := zoneBatch{
+		ZoneID: "ABCDEF0123456789",
+		pools:  []*srvPoolUpdate{{Name: "_app._tcp.example.com.", Priority: 10, Weight: 5, Port: 8080, Target: "i-123456789.example.com."}},
+	}
+	if err := batch.send(testAwsClient()); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if log := teststubs.Route53ChangeLog(); len(log) != 1 {
+		t.Fatalf("Expected one successful change batch, got %d", len(log))
+	}
+
+	// Other invalid change batches are not retried.
+	teststubs.ResetRoute53ChangeLog()
+	teststubs.InjectRoute53Errors("ChangeResourceRecordSets", "InvalidChangeBatch: [Invalid Resource Record: FATAL problem: InvalidSRVRecordData]")
+	if err := batch.send(testAwsClient()); err == nil || isChangeConflict(err) {
+		t.Fatalf("Expected InvalidChangeBatch error that is not a conflict, got %v", err)
+	}
+	if log := teststubs.Route53ChangeLog(); len(log) != 0 {
+		t.Fatalf("Expected no retry, got %d change batches", len(log))
+	}
+
+	// Batches without pools are not retried.
+	teststubs.InjectRoute53Errors("ChangeResourceRecordSets", "InvalidChangeBatch: [Tried to delete resource record set [name='a.example.com.', type='A'] but it was not found]")
+	batch = zoneBatch{
+		ZoneID:  "ABCDEF0123456789",
+		Changes: []*route53.Change{testChange("CREATE", "a.example.com.", "10.0.0.1")},
+	}
+	err := batch.send(testAwsClient())
+	if err == nil || !isChangeConflict(err) {
+		t.Fatalf("Expected InvalidChangeBatch error, got %v", err)
+	}
+}
+
+func TestZoneBatchSend_racingCreate(t *testing.T) {
+	defer teststubs.ResetRoute53ChangeLog()
+	defer teststubs.ResetRoute53Errors()
+	teststubs.ResetRoute53ChangeLog()
+
+	// Both instances find the pool empty, and one CREATE loses the race.
+	teststubs.InjectRoute53Errors("ChangeResourceRecordSets",
+		"InvalidChangeBatch: [Tried to create resource record set [name='_web._tcp.example.com.', type='SRV'] but it already exists]",
+	)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for _, target := range []string{"i-123456789.example.com.", "i-987654321.example.com."} {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			batch := zoneBatch{
+				ZoneID: "ABCDEF0123456789",
+				pools:  []*srvPoolUpdate{{Name: "_web._tcp.example.com.", Priority: 10, Weight: 5, Port: 8080, Target: target}},
+			}
+			errs <- batch.send(testAwsClient())
+		}(target)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Expected the losing update to be retried, got %v", err)
+		}
+	}
+	if log := teststubs.Route53ChangeLog(); len(log) != 2 {
+		t.Fatalf("Expected 2 successful change batches, got %d", len(log))
+	}
+}
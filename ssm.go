@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/private/protocol/rest"
+)
+
+// The SSM service is not vendored with the SDK, and neither is the JSON RPC
+// protocol it uses, so this file implements the GetParameter API with small
+// JSON handlers, using the same client plumbing as the generated service
+// clients.
+
+// ssmServiceName is the service name used for endpoint and signing lookups.
+const ssmServiceName = "ssm"
+
+// ssmTargetPrefix is the prefix of the X-Amz-Target header for SSM
+// operations.
+const ssmTargetPrefix = "AmazonSSM"
+
+// ssmGetParameterInput is the input for the SSM GetParameter API.
+type ssmGetParameterInput struct {
+	Name           string
+	WithDecryption bool
+}
+
+// ssmParameter is a parameter returned by the SSM GetParameter API.
+type ssmParameter struct {
+	Name  string
+	Type  string
+	Value string
+}
+
+// ssmGetParameterOutput is the output for the SSM GetParameter API.
+type ssmGetParameterOutput struct {
+	Parameter ssmParameter
+}
+
+// ssmClient is a minimal SSM client.
+type ssmClient struct {
+	*client.Client
+}
+
+// newSSMClient returns an ssmClient using the supplied config provider
+// (usually a session), with cfgs applied on top.
+func newSSMClient(p client.ConfigProvider, cfgs ...*aws.Config) *ssmClient {
+	c := p.ClientConfig(ssmServiceName, cfgs...)
+	s := &ssmClient{
+		Client: client.New(
+			*c.Config,
+			metadata.ClientInfo{
+				ServiceName:   ssmServiceName,
+				SigningRegion: c.SigningRegion,
+				Endpoint:      c.Endpoint,
+				APIVersion:    "2014-11-06",
+				JSONVersion:   "1.1",
+				TargetPrefix:  ssmTargetPrefix,
+			},
+			c.Handlers,
+		),
+	}
+
+	s.Handlers.Sign.PushBackNamed(v4.SignRequestHandler)
+	s.Handlers.Build.PushBackNamed(request.NamedHandler{Name: "asg53.ssm.Build", Fn: ssmBuild})
+	s.Handlers.Unmarshal.PushBackNamed(request.NamedHandler{Name: "asg53.ssm.Unmarshal", Fn: ssmUnmarshal})
+	s.Handlers.UnmarshalMeta.PushBackNamed(rest.UnmarshalMetaHandler)
+	s.Handlers.UnmarshalError.PushBackNamed(request.NamedHandler{Name: "asg53.ssm.UnmarshalError", Fn: ssmUnmarshalError})
+
+	return s
+}
+
+// ssmBuild encodes the request parameters as JSON, and sets the headers that
+// select the operation.
+func ssmBuild(r *request.Request) {
+	raw, err := json.Marshal(r.Params)
+	if err != nil {
+		r.Error = awserr.New("SerializationError", "failed to encode SSM request", err)
+		return
+	}
+	r.SetBufferBody(raw)
+	r.HTTPRequest.Header.Set("X-Amz-Target", ssmTargetPrefix+"."+r.Operation.Name)
+	r.HTTPRequest.Header.Set("Content-Type", "application/x-amz-json-1.1")
+}
+
+// ssmUnmarshal decodes a JSON response into the request's output.
+func ssmUnmarshal(r *request.Request) {
+	defer r.HTTPResponse.Body.Close()
+	if err := json.NewDecoder(r.HTTPResponse.Body).Decode(r.Data); err != nil {
+		r.Error = awserr.New("SerializationError", "failed to decode SSM response", err)
+	}
+}
+
+// ssmErrorResponse is the body of an SSM error response.
+type ssmErrorResponse struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+// ssmUnmarshalError decodes an SSM error response.
+func ssmUnmarshalError(r *request.Request) {
+	defer r.HTTPResponse.Body.Close()
+
+	raw, err := ioutil.ReadAll(r.HTTPResponse.Body)
+	if err != nil {
+		r.Error = awserr.New("SerializationError", "failed to read SSM error response", err)
+		return
+	}
+	resp := ssmErrorResponse{}
+	if err := json.NewDecoder(bytes.NewReader(raw)).Decode(&resp); err != nil || resp.Type == "" {
+		resp.Type = r.HTTPResponse.Status
+		resp.Message = string(raw)
+	}
+	// Error types can be prefixed with a namespace, such as
+	// "com.amazonaws.ssm#ParameterNotFound".
+	code := resp.Type[strings.LastIndex(resp.Type, "#")+1:]
+	r.Error = awserr.NewRequestFailure(awserr.New(code, resp.Message, nil), r.HTTPResponse.StatusCode, r.RequestID)
+}
+
+// GetParameter returns the value of the named parameter, decrypting
+// SecureString parameters.
+func (s *ssmClient) GetParameter(name string) (string, error) {
+	op := &request.Operation{
+		Name:       "GetParameter",
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}
+	params := &ssmGetParameterInput{Name: name, WithDecryption: true}
+	out := &ssmGetParameterOutput{}
+	if err := s.NewRequest(op, params, out).Send(); err != nil {
+		return "", err
+	}
+	return out.Parameter.Value, nil
+}
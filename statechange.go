@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// stateChangeDetailType is the detail type for EC2 instance state-change
+// events sent through CloudWatch Events.
+const stateChangeDetailType = "EC2 Instance State-change Notification"
+
+// configTagKey is the EC2 instance tag that holds the configuration key for
+// instances managed through state-change events. The tag's value is looked
+// up in the config source.
+const configTagKey = "asg53:config"
+
+// stateChangeEvent represents an abridged version of an EC2 instance
+// state-change event, sent directly to Lambda through CloudWatch Events.
+type stateChangeEvent struct {
+	// The detail type of the event. This is "EC2 Instance State-change
+	// Notification" for the events that we handle.
+	DetailType string `json:"detail-type"`
+
+	// The event details.
+	Detail stateChangeDetail `json:"detail"`
+}
+
+// stateChangeDetail represents the details of an EC2 instance state-change
+// event.
+type stateChangeDetail struct {
+	// The ID of the instance that changed state.
+	InstanceID string `json:"instance-id"`
+
+	// The state the instance changed to.
+	State string `json:"state"`
+}
+
+// transition returns the lifecycle transition that corresponds to the
+// event's instance state. An empty string is returned for states that we
+// do not act on. Termination is handled on shutting-down only, as a
+// terminated event follows for the same instance, and acting on both would
+// run the terminate changes twice.
+func (e stateChangeEvent) transition() string {
+	switch e.Detail.State {
+	case ec2.InstanceStateNameRunning:
+		return transitionLaunch
+	case ec2.InstanceStateNameShuttingDown:
+		return transitionTerminate
+	}
+	return ""
+}
+
+// parseStateChangeEvent attempts to parse raw as an EC2 instance
+// state-change event. The second return value is false if the event is
+// not a state-change event, in which case it should be parsed as an SNS
+// event instead.
+func parseStateChangeEvent(raw []byte) (stateChangeEvent, bool) {
+	parsed := stateChangeEvent{}
+	if err := json.Unmarshal(raw, &parsed); err != nil {
+		return parsed, false
+	}
+	return parsed, parsed.DetailType == stateChangeDetailType
+}
+
+// instanceConfigKey returns the value of the configuration tag on the
+// supplied instance. An empty string is returned if the tag is not present.
+func instanceConfigKey(instance *ec2.Instance) string {
+	return instanceTag(instance, configTagKey)
+}
+
+// instanceTag returns the value of the tag with the supplied key on the
+// instance. An empty string is returned if the tag is not present.
+func instanceTag(instance *ec2.Instance, key string) string {
+	for _, tag := range instance.Tags {
+		if tag.Key != nil && *tag.Key == key && tag.Value != nil {
+			return *tag.Value
+		}
+	}
+	return ""
+}
+
+// stateChangeArgs loads the messageArgs for the instance in a state-change
+// event, resolving the configuration key from the instance's tags. The
+// second return value is false if the instance is not tagged for
+// management.
+func stateChangeArgs(client *awsClient, evt stateChangeEvent) (messageArgs, bool, error) {
+	instance, err := client.FetchEC2InstanceData(evt.Detail.InstanceID)
+	if err != nil {
+		return messageArgs{}, false, err
+	}
+
+	key := instanceConfigKey(instance)
+	if key == "" {
+		return messageArgs{}, false, nil
+	}
+
+	src, err := loadConfigSource()
+	if err != nil {
+		return messageArgs{}, true, err
+	}
+	cfg, err := src.Lookup(key)
+	if err != nil {
+		return messageArgs{}, true, err
+	}
+	args, err := cfg.argsFor(evt.transition())
+	return args, true, err
+}
+
+// handleStateChange processes an EC2 instance state-change event. Instances
+// that are not tagged with the configuration tag, or states that we do not
+// act on, are ignored.
+//
+// As there is no lifecycle action to complete, errors after the change
+// batch has been sent are logged and not returned, so that Lambda does not
+// retry the event.
+func handleStateChange(client *awsClient, evt stateChangeEvent) error {
+	client = client.forEvent("", evt.Detail.InstanceID, "")
+	client.logger().Infof("State change event for %s: %s", evt.Detail.InstanceID, evt.Detail.State)
+
+	if evt.transition() == "" {
+		client.logger().Infof("Instance state %s is not handled - ignoring and exiting.", evt.Detail.State)
+		return nil
+	}
+
+	args, ok, err := stateChangeArgs(client, evt)
+	if err != nil {
+		client.logger().Errorf("Error loading configuration for instance: %v", err)
+		return err
+	}
+	if !ok {
+		client.logger().Infof("Instance %s does not have the %s tag - ignoring and exiting.", evt.Detail.InstanceID, configTagKey)
+		return nil
+	}
+
+	err = runInstanceChanges(client, evt.Detail.InstanceID, args, evt.transition())
+	if _, notSent := err.(*changesNotSentError); notSent {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	client.logger().Infof("Completed Route 53 action for state change")
+	return nil
+}
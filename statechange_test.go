@@ -0,0 +1,192 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/paybyphone/asg53/teststubs"
+)
+
+// testStateChangeEventJSON is a test EC2 instance state-change event in
+// JSON form.
+const testStateChangeEventJSON = `
+{
+  "version": "0",
+  "id": "ee376907-2647-4179-9203-343cfb3017a4",
+  "detail-type": "EC2 Instance State-change Notification",
+  "source": "aws.ec2",
+  "account": "123456789012",
+  "time": "2016-11-11T21:30:34Z",
+  "region": "us-west-2",
+  "resources": [
+    "arn:aws:ec2:us-west-2:123456789012:instance/i-123456789"
+  ],
+  "detail": {
+    "instance-id": "i-123456789",
+    "state": "running"
+  }
+}
+`
+
+func TestParseStateChangeEvent(t *testing.T) {
+	evt, ok := parseStateChangeEvent([]byte(testStateChangeEventJSON))
+	if !ok {
+		t.Fatal("Expected event to be a state-change event")
+	}
+
+	if evt.Detail.InstanceID != "i-123456789" {
+		t.Fatalf("Expected InstanceID to be i-123456789, got %s", evt.Detail.InstanceID)
+	}
+	if evt.transition() != transitionLaunch {
+		t.Fatalf("Expected transition to be %s, got %s", transitionLaunch, evt.transition())
+	}
+}
+
+func TestParseStateChangeEvent_snsEvent(t *testing.T) {
+	if _, ok := parseStateChangeEvent([]byte(testNotificationEventJSON)); ok {
+		t.Fatal("Expected SNS event to not be a state-change event")
+	}
+}
+
+func TestStateChangeEventTransition(t *testing.T) {
+	cases := map[string]string{
+		"pending":       "",
+		"running":       transitionLaunch,
+		"stopping":      "",
+		"stopped":       "",
+		"shutting-down": transitionTerminate,
+		"terminated":    "",
+	}
+
+	for state, expected := range cases {
+		evt := stateChangeEvent{Detail: stateChangeDetail{State: state}}
+		if actual := evt.transition(); actual != expected {
+			t.Fatalf("Expected transition for %s to be %q, got %q", state, expected, actual)
+		}
+	}
+}
+
+func TestInstanceConfigKey(t *testing.T) {
+	instance := &ec2.Instance{
+		Tags: []*ec2.Tag{
+			&ec2.Tag{Key: aws.String("Name"), Value: aws.String("web")},
+			&ec2.Tag{Key: aws.String(configTagKey), Value: aws.String("ASGName")},
+		},
+	}
+
+	if key := instanceConfigKey(instance); key != "ASGName" {
+		t.Fatalf("Expected key to be ASGName, got %s", key)
+	}
+	if key := instanceConfigKey(&ec2.Instance{}); key != "" {
+		t.Fatalf("Expected empty key, got %s", key)
+	}
+}
+
+func TestHandleStateChange(t *testing.T) {
+	os.Setenv(configEnvVar, testConfigJSON)
+	defer os.Unsetenv(configEnvVar)
+
+	evt, _ := parseStateChangeEvent([]byte(testStateChangeEventJSON))
+	client := testAwsClient()
+
+	if err := handleStateChange(client, evt); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+}
+
+func TestHandleStateChange_shouldError(t *testing.T) {
+	os.Setenv(configEnvVar, testConfigJSON)
+	defer os.Unsetenv(configEnvVar)
+
+	evt, _ := parseStateChangeEvent([]byte(testStateChangeEventJSON))
+	evt.Detail.State = ec2.InstanceStateNameShuttingDown
+	client := testAwsClient()
+
+	// testConfigJSON has no Terminate section.
+	if err := handleStateChange(client, evt); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+}
+
+// testDryRunConfigJSON is a test configuration document with a dry run and a
+// health check for both transitions.
+const testDryRunConfigJSON = `
+{
+  "ASGName": {
+    "Launch": {
+      "HostedZoneID": "ABCDEF0123456789",
+      "DryRun": true,
+      "HealthCheck": {"Type": "TCP", "IPAddress": "{{.InstancePublicIPAddress}}", "Port": 80},
+      "Changes": [
+        {
+          "Action": "UPSERT",
+          "ResourceRecordSet": {
+            "Name": "{{.InstanceID}}.example.com.",
+            "TTL": 60,
+            "Type": "A",
+            "SetIdentifier": "{{.InstanceID}}",
+            "Weight": 10,
+            "HealthCheckId": "{{.HealthCheckID}}",
+            "ResourceRecords": [{"Value": "{{.InstancePublicIPAddress}}"}]
+          }
+        }
+      ]
+    },
+    "Terminate": {
+      "HostedZoneID": "ABCDEF0123456789",
+      "DryRun": true,
+      "HealthCheck": {"Type": "TCP", "IPAddress": "{{.InstancePublicIPAddress}}", "Port": 80},
+      "Changes": [
+        {
+          "Action": "DELETE",
+          "ResourceRecordSet": {
+            "Name": "{{.InstanceID}}.example.com.",
+            "TTL": 3600,
+            "Type": "A",
+            "ResourceRecords": [{"Value": "54.0.0.1"}]
+          }
+        }
+      ]
+    }
+  }
+}
+`
+
+func TestHandleStateChange_dryRun(t *testing.T) {
+	os.Setenv(configEnvVar, testDryRunConfigJSON)
+	defer os.Unsetenv(configEnvVar)
+	defer teststubs.ResetRoute53HealthChecks()
+	defer teststubs.ResetRoute53ChangeLog()
+	defer teststubs.ResetEC2InstanceTags()
+	teststubs.ResetRoute53HealthChecks()
+	teststubs.ResetRoute53ChangeLog()
+	teststubs.ResetEC2InstanceTags()
+
+	evt, _ := parseStateChangeEvent([]byte(testStateChangeEventJSON))
+	client := testAwsClient()
+	if err := handleStateChange(client, evt); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if len(teststubs.Route53ChangeLog()) != 0 || len(teststubs.Route53HealthChecks()) != 0 {
+		t.Fatal("Expected nothing to be changed on launch in a dry run")
+	}
+
+	// A health check from an earlier launch is found, but not deleted.
+	id, err := client.CreateRoute53HealthCheck("asg53-i-123456789-0", &route53.HealthCheckConfig{Type: aws.String("TCP")})
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if err := client.TagEC2Instance("i-123456789", healthCheckTagKey, id); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	evt.Detail.State = ec2.InstanceStateNameShuttingDown
+	if err := handleStateChange(client, evt); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if len(teststubs.Route53ChangeLog()) != 0 || len(teststubs.Route53HealthChecks()) != 1 {
+		t.Fatal("Expected nothing to be changed on termination in a dry run")
+	}
+}
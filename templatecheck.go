@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// instanceDataType is the type of the data that templates are executed with.
+var instanceDataType = reflect.TypeOf((*instanceData)(nil))
+
+// builtinArity holds the minimum and maximum number of arguments for the
+// text/template builtin functions. A maximum of -1 means any number.
+var builtinArity = map[string][2]int{
+	"and":      {1, -1},
+	"call":     {1, -1},
+	"eq":       {1, -1},
+	"ge":       {2, 2},
+	"gt":       {2, 2},
+	"html":     {0, -1},
+	"index":    {1, -1},
+	"js":       {0, -1},
+	"le":       {2, 2},
+	"len":      {1, 1},
+	"lt":       {2, 2},
+	"ne":       {2, 2},
+	"not":      {1, 1},
+	"or":       {1, -1},
+	"print":    {0, -1},
+	"printf":   {1, -1},
+	"println":  {0, -1},
+	"slice":    {1, -1},
+	"urlquery": {0, -1},
+}
+
+// templateChecker checks a parsed template against the data and functions
+// it will be executed with, so that mistakes are found before an instance
+// launches, rather than when the template is rendered.
+type templateChecker struct {
+	// The functions available to the template.
+	funcs template.FuncMap
+
+	// The tree being checked, for error locations.
+	tree *parse.Tree
+
+	// The problems found, each prefixed with its line.
+	errs []string
+}
+
+// checkTemplate parses text with the functions available to instanceData
+// templates, and checks that every field and method it references exists on
+// instanceData, and that functions and methods get the right number of
+// arguments. All of the problems found are returned.
+func checkTemplate(text string) []string {
+	funcs := (*instanceData)(nil).funcs()
+	tmpl, err := template.New("check").Funcs(funcs).Parse(text)
+	if err != nil {
+		return []string{"line " + strings.TrimPrefix(err.Error(), "template: check:")}
+	}
+	c := &templateChecker{funcs: funcs}
+	for _, t := range tmpl.Templates() {
+		if t.Tree == nil || t.Tree.Root == nil {
+			continue
+		}
+		c.tree = t.Tree
+		c.walk(t.Tree.Root, instanceDataType)
+	}
+	return c.errs
+}
+
+// addf records a problem at node.
+func (c *templateChecker) addf(node parse.Node, format string, args ...interface{}) {
+	location, _ := c.tree.ErrorContext(node)
+	// location is "name:line:col".
+	parts := strings.SplitN(location, ":", 3)
+	line := parts[len(parts)-2]
+	c.errs = append(c.errs, fmt.Sprintf("line %s: %s", line, fmt.Sprintf(format, args...)))
+}
+
+// walk checks node and its children. dot is the type of dot at node, or nil
+// if it is not known.
+func (c *templateChecker) walk(node parse.Node, dot reflect.Type) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			c.walk(child, dot)
+		}
+	case *parse.ActionNode:
+		c.pipe(n.Pipe, dot)
+	case *parse.IfNode:
+		c.pipe(n.Pipe, dot)
+		c.walk(n.List, dot)
+		c.walk(n.ElseList, dot)
+	case *parse.RangeNode:
+		c.walk(n.List, elemType(c.pipe(n.Pipe, dot)))
+		c.walk(n.ElseList, dot)
+	case *parse.WithNode:
+		c.walk(n.List, c.pipe(n.Pipe, dot))
+		c.walk(n.ElseList, dot)
+	case *parse.TemplateNode:
+		c.pipe(n.Pipe, dot)
+	}
+}
+
+// pipe checks a pipeline, and returns the type of its result, or nil if it
+// is not known.
+func (c *templateChecker) pipe(p *parse.PipeNode, dot reflect.Type) reflect.Type {
+	if p == nil {
+		return nil
+	}
+	var result reflect.Type
+	for i, cmd := range p.Cmds {
+		// Commands after the first get the result of the previous command as
+		// their final argument.
+		result = c.command(cmd, dot, i > 0)
+	}
+	return result
+}
+
+// command checks a command in a pipeline, and returns the type of its
+// result, or nil if it is not known.
+func (c *templateChecker) command(cmd *parse.CommandNode, dot reflect.Type, piped bool) reflect.Type {
+	nargs := len(cmd.Args) - 1
+	if piped {
+		nargs++
+	}
+	for _, arg := range cmd.Args[1:] {
+		c.arg(arg, dot)
+	}
+
+	switch n := cmd.Args[0].(type) {
+	case *parse.FieldNode:
+		return c.fields(n, dot, n.Ident, nargs)
+	case *parse.VariableNode:
+		if n.Ident[0] == "$" && len(n.Ident) > 1 {
+			return c.fields(n, instanceDataType, n.Ident[1:], nargs)
+		}
+	case *parse.IdentifierNode:
+		return c.function(n, nargs)
+	case *parse.PipeNode:
+		return c.pipe(n, dot)
+	case *parse.ChainNode:
+		c.arg(n.Node, dot)
+	case *parse.DotNode:
+		return dot
+	}
+	return nil
+}
+
+// arg checks an argument to a command.
+func (c *templateChecker) arg(node parse.Node, dot reflect.Type) {
+	switch n := node.(type) {
+	case *parse.FieldNode:
+		c.fields(n, dot, n.Ident, 0)
+	case *parse.VariableNode:
+		if n.Ident[0] == "$" && len(n.Ident) > 1 {
+			c.fields(n, instanceDataType, n.Ident[1:], 0)
+		}
+	case *parse.PipeNode:
+		c.pipe(n, dot)
+	case *parse.ChainNode:
+		c.arg(n.Node, dot)
+	}
+}
+
+// function checks a call to a function with nargs arguments, and returns the
+// type of its result, or nil if it is not known.
+func (c *templateChecker) function(n *parse.IdentifierNode, nargs int) reflect.Type {
+	if fn, ok := c.funcs[n.Ident]; ok {
+		t := reflect.TypeOf(fn)
+		if err := checkArity(n.Ident, t, 0, nargs); err != nil {
+			c.addf(n, "%v", err)
+		}
+		if t.NumOut() > 0 {
+			return t.Out(0)
+		}
+		return nil
+	}
+	if arity, ok := builtinArity[n.Ident]; ok {
+		if nargs < arity[0] || (arity[1] >= 0 && nargs > arity[1]) {
+			c.addf(n, "wrong number of args for %s: want %s got %d", n.Ident, arityString(arity), nargs)
+		}
+	}
+	return nil
+}
+
+// fields checks a chain of field and method names, starting from type t, and
+// returns the type of the result, or nil if it is not known. The last name
+// is called with nargs arguments.
+func (c *templateChecker) fields(node parse.Node, t reflect.Type, idents []string, nargs int) reflect.Type {
+	for i, ident := range idents {
+		n := 0
+		if i == len(idents)-1 {
+			n = nargs
+		}
+		var err error
+		if t, err = lookupField(t, ident, n); err != nil {
+			c.addf(node, "%v", err)
+			return nil
+		}
+		if t == nil {
+			return nil
+		}
+	}
+	return t
+}
+
+// lookupField returns the type of the field or method name on t, called
+// with nargs arguments. nil is returned if t is nil or the type of the
+// result cannot be known.
+func lookupField(t reflect.Type, name string, nargs int) (reflect.Type, error) {
+	if t == nil {
+		return nil, nil
+	}
+
+	candidates := []reflect.Type{t}
+	if t.Kind() != reflect.Ptr && t.Kind() != reflect.Interface {
+		candidates = append(candidates, reflect.PtrTo(t))
+	}
+	for _, mt := range candidates {
+		if m, ok := mt.MethodByName(name); ok {
+			skip := 1
+			if mt.Kind() == reflect.Interface {
+				skip = 0
+			}
+			if err := checkArity(name, m.Type, skip, nargs); err != nil {
+				return nil, err
+			}
+			if m.Type.NumOut() > 0 {
+				return m.Type.Out(0), nil
+			}
+			return nil, nil
+		}
+	}
+
+	base := t
+	if base.Kind() == reflect.Ptr {
+		base = base.Elem()
+	}
+	switch base.Kind() {
+	case reflect.Struct:
+		if f, ok := base.FieldByName(name); ok && f.PkgPath == "" {
+			if nargs > 0 {
+				return nil, fmt.Errorf("%s has arguments but cannot be invoked as function", name)
+			}
+			return f.Type, nil
+		}
+	case reflect.Map:
+		if base.Key().Kind() == reflect.String {
+			return base.Elem(), nil
+		}
+	case reflect.Interface:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("can't evaluate field %s in type %s", name, t)
+}
+
+// checkArity returns an error if a function or method of type t, with skip
+// leading receiver arguments, cannot be called with nargs arguments.
+func checkArity(name string, t reflect.Type, skip, nargs int) error {
+	in := t.NumIn() - skip
+	if t.IsVariadic() {
+		if nargs < in-1 {
+			return fmt.Errorf("wrong number of args for %s: want at least %d got %d", name, in-1, nargs)
+		}
+		return nil
+	}
+	if nargs != in {
+		return fmt.Errorf("wrong number of args for %s: want %d got %d", name, in, nargs)
+	}
+	return nil
+}
+
+// arityString returns a builtin arity for display.
+func arityString(arity [2]int) string {
+	switch {
+	case arity[1] < 0:
+		return fmt.Sprintf("at least %d", arity[0])
+	case arity[0] == arity[1]:
+		return fmt.Sprintf("%d", arity[0])
+	}
+	return fmt.Sprintf("%d to %d", arity[0], arity[1])
+}
+
+// elemType returns the type of the elements that ranging over t yields, or
+// nil if it is not known.
+func elemType(t reflect.Type) reflect.Type {
+	if t == nil {
+		return nil
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return t.Elem()
+	}
+	return nil
+}
+
+// validateTemplate adds the problems with the template text, found at path,
+// to errs. Empty values are skipped.
+func validateTemplate(errs *schemaErrors, path string, text *string) {
+	if text == nil || *text == "" {
+		return
+	}
+	for _, problem := range checkTemplate(*text) {
+		errs.add(path, "%s", problem)
+	}
+}
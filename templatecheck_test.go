@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckTemplate(t *testing.T) {
+	cases := []struct {
+		text     string
+		expected []string
+	}{
+		{"{{.InstanceID}}.example.com.", nil},
+		{"{{.ExistingRDataValue 0 1}}", nil},
+		{"{{with .InstancePublicIPAddress}}{{.}}{{else}}{{.InstancePrivateIPAddress}}{{end}}", nil},
+		{`{{printf "%s-%s" .InstanceID $.HealthCheckID | len}}`, nil},
+		{"{{.InstancePublicIp}}", []string{"line 1: can't evaluate field InstancePublicIp in type *main.instanceData"}},
+		{"{{.ExistingRDataValue 0}}", []string{"line 1: wrong number of args for ExistingRDataValue: want 2 got 1"}},
+		{"{{.InstanceID 1}}", []string{"line 1: InstanceID has arguments but cannot be invoked as function"}},
+		{"{{.InstanceID.Foo}}", []string{"line 1: can't evaluate field Foo in type string"}},
+		{"{{.client}}", []string{"line 1: can't evaluate field client in type *main.instanceData"}},
+		{"{{len}}", []string{"line 1: wrong number of args for len: want 1 got 0"}},
+		{`{{range existing "www.example.com." "A"}}{{.}}{{end}}`, nil},
+		{`{{existingValue "www.example.com." "A"}}`, []string{"line 1: wrong number of args for existingValue: want 3 got 2"}},
+		{`{{"A" | existing "www.example.com."}}`, nil},
+		{`{{if gt (existingTTL "www.example.com." "CNAME") 300}}long{{end}}`, nil},
+		{`{{"A" | existingTTL "www.example.com." "A"}}`, []string{"line 1: wrong number of args for existingTTL: want 2 got 3"}},
+		{"{{.InstanceID}}\n{{if .Bad}}{{eq 1 .Worse}}{{end}}", []string{
+			"line 2: can't evaluate field Bad in type *main.instanceData",
+			"line 2: can't evaluate field Worse in type *main.instanceData",
+		}},
+		{"{{nope .InstanceID}}", []string{`line 1: function "nope" not defined`}},
+		{"{{.InstanceID", []string{"line 1: unclosed action"}},
+	}
+	for _, tc := range cases {
+		actual := checkTemplate(tc.text)
+		if strings.Join(actual, "\n") != strings.Join(tc.expected, "\n") {
+			t.Errorf("checkTemplate(%q): expected %q, got %q", tc.text, tc.expected, actual)
+		}
+	}
+}
+
+func TestParseSNSMetadata_templateErrors(t *testing.T) {
+	_, err := parseSNSMetadata([]byte(`{
+  "HostedZoneID": "ABCDEF0123456789",
+  "HealthCheck": {"Type": "HTTP", "IPAddress": "{{.InstancePublicIp}}"},
+  "SRVMembers": [{"Name": "_app._tcp.example.com.", "Port": 80, "Target": "{{.InstanceId}}.example.com."}],
+  "Changes": [
+    {
+      "Action": "UPSERT",
+      "ResourceRecordSet": {
+        "Name": "{{.InstanceID}}.example.com.",
+        "Type": "A",
+        "TTL": 60,
+        "ResourceRecords": [{"Value": "{{.ExistingRDataValue 0}}"}]
+      }
+    }
+  ]
+}`))
+	expected := []string{
+		"$.SRVMembers[0].Target: line 1: can't evaluate field InstanceId in type *main.instanceData",
+		"$.Changes[0].ResourceRecordSet.ResourceRecords[0].Value: line 1: wrong number of args for ExistingRDataValue: want 2 got 1",
+		"$.HealthCheck.IPAddress: line 1: can't evaluate field InstancePublicIp in type *main.instanceData",
+	}
+	if actual := schemaPaths(t, err); strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected errors:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+}
@@ -14,7 +14,7 @@ import (
 // Note that the unstubbed function does not return anything useful, so we
 // don't try to mock anything here.
 func testCompleteLifecycleAction(input *autoscaling.CompleteLifecycleActionInput) (*autoscaling.CompleteLifecycleActionOutput, error) {
-	if *input.LifecycleActionResult == "bad" {
+	if *input.LifecycleActionResult == "bad" || *input.LifecycleActionToken == "bad" {
 		return nil, fmt.Errorf("error")
 	}
 	return &autoscaling.CompleteLifecycleActionOutput{}, nil
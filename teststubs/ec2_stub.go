@@ -2,6 +2,8 @@ package teststubs
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/request"
@@ -22,19 +24,67 @@ func testEC2Reservation() *ec2.Reservation {
 					Name: aws.String("running"),
 				},
 				InstanceId:       aws.String("i-123456789"),
+				LaunchTime:       aws.Time(time.Date(2016, 11, 1, 12, 0, 0, 0, time.UTC)),
 				PrivateIpAddress: aws.String("10.0.0.1"),
 				PublicIpAddress:  aws.String("54.0.0.1"),
+				Tags: []*ec2.Tag{
+					&ec2.Tag{
+						Key:   aws.String("asg53:config"),
+						Value: aws.String("ASGName"),
+					},
+				},
 			},
 		},
 	}
 }
 
+// ec2InstanceTags holds the tags added to the test instance with
+// ec2.CreateTags, on top of the tags in testEC2Reservation.
+var ec2InstanceTags = struct {
+	sync.Mutex
+	tags map[string]string
+}{}
+
+// ResetEC2InstanceTags removes the tags added to the test instance with
+// ec2.CreateTags.
+func ResetEC2InstanceTags() {
+	ec2InstanceTags.Lock()
+	defer ec2InstanceTags.Unlock()
+	ec2InstanceTags.tags = nil
+}
+
+// testCreateTags is a stub function for testing the ec2.CreateTags
+// function.
+func testCreateTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	if *input.Resources[0] == "bad" {
+		return nil, fmt.Errorf("error")
+	}
+	ec2InstanceTags.Lock()
+	defer ec2InstanceTags.Unlock()
+	if ec2InstanceTags.tags == nil {
+		ec2InstanceTags.tags = make(map[string]string)
+	}
+	for _, tag := range input.Tags {
+		ec2InstanceTags.tags[*tag.Key] = *tag.Value
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
 // testDescribeInstancesOutput provides a test ec2.DescribeInstancesOutput
 // object.
 func testDescribeInstancesOutput() *ec2.DescribeInstancesOutput {
+	reservation := testEC2Reservation()
+	ec2InstanceTags.Lock()
+	defer ec2InstanceTags.Unlock()
+	for key, value := range ec2InstanceTags.tags {
+		reservation.Instances[0].Tags = append(reservation.Instances[0].Tags, &ec2.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(value),
+		})
+	}
 	return &ec2.DescribeInstancesOutput{
 		Reservations: []*ec2.Reservation{
-			testEC2Reservation(),
+			reservation,
 		},
 	}
 }
@@ -62,6 +112,12 @@ func CreateTestEC2InstanceMock() *ec2.EC2 {
 				*r.Data.(*ec2.DescribeInstancesOutput) = *out
 			}
 			r.Error = err
+		case *ec2.CreateTagsInput:
+			out, err := testCreateTags(p)
+			if out != nil {
+				*r.Data.(*ec2.CreateTagsOutput) = *out
+			}
+			r.Error = err
 		default:
 			panic(fmt.Errorf("Unsupported input type %T", p))
 		}
@@ -2,14 +2,185 @@ package teststubs
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/route53"
 )
 
+// route53Faults holds the error codes queued to be returned by the Route 53
+// mock, keyed by operation name.
+var route53Faults = struct {
+	sync.Mutex
+	codes map[string][]string
+}{codes: make(map[string][]string)}
+
+// InjectRoute53Errors queues AWS errors with the supplied codes to be
+// returned by the next calls to the named Route 53 operation (such as
+// "ChangeResourceRecordSets"), one per call, before the operation succeeds
+// again. This is useful for testing retries on errors such as Throttling and
+// PriorRequestNotComplete. A code can be followed by ": " and the message
+// to return with it.
+func InjectRoute53Errors(operation string, codes ...string) {
+	route53Faults.Lock()
+	defer route53Faults.Unlock()
+	route53Faults.codes[operation] = append(route53Faults.codes[operation], codes...)
+}
+
+// ResetRoute53Errors clears all queued Route 53 errors.
+func ResetRoute53Errors() {
+	route53Faults.Lock()
+	defer route53Faults.Unlock()
+	route53Faults.codes = make(map[string][]string)
+}
+
+// nextRoute53Error returns the next queued error for the named operation, or
+// nil if there is none.
+func nextRoute53Error(operation string) error {
+	route53Faults.Lock()
+	defer route53Faults.Unlock()
+	codes := route53Faults.codes[operation]
+	if len(codes) < 1 {
+		return nil
+	}
+	route53Faults.codes[operation] = codes[1:]
+	parts := strings.SplitN(codes[0], ": ", 2)
+	if len(parts) > 1 {
+		return awserr.New(parts[0], parts[1], nil)
+	}
+	return awserr.New(codes[0], "injected error", nil)
+}
+
+// route53ChangeLog records the change batches sent to the Route 53 mock.
+var route53ChangeLog = struct {
+	sync.Mutex
+	inputs []*route53.ChangeResourceRecordSetsInput
+}{}
+
+// Route53ChangeLog returns the change batch requests that have been sent to
+// the Route 53 mock, in order, since the last call to ResetRoute53ChangeLog.
+// Requests that fail are not recorded.
+func Route53ChangeLog() []*route53.ChangeResourceRecordSetsInput {
+	route53ChangeLog.Lock()
+	defer route53ChangeLog.Unlock()
+	return append([]*route53.ChangeResourceRecordSetsInput{}, route53ChangeLog.inputs...)
+}
+
+// ResetRoute53ChangeLog clears the recorded change batch requests.
+func ResetRoute53ChangeLog() {
+	route53ChangeLog.Lock()
+	defer route53ChangeLog.Unlock()
+	route53ChangeLog.inputs = nil
+}
+
+// route53HealthChecks holds the health checks created in the Route 53 mock.
+var route53HealthChecks = struct {
+	sync.Mutex
+	checks []*route53.HealthCheck
+	nextID int
+
+	// The caller references of deleted health checks, which cannot be used
+	// again.
+	deleted map[string]bool
+}{}
+
+// Route53HealthChecks returns the health checks that currently exist in the
+// Route 53 mock.
+func Route53HealthChecks() []*route53.HealthCheck {
+	route53HealthChecks.Lock()
+	defer route53HealthChecks.Unlock()
+	return append([]*route53.HealthCheck{}, route53HealthChecks.checks...)
+}
+
+// ResetRoute53HealthChecks deletes all health checks in the Route 53 mock.
+func ResetRoute53HealthChecks() {
+	route53HealthChecks.Lock()
+	defer route53HealthChecks.Unlock()
+	route53HealthChecks.checks = nil
+	route53HealthChecks.deleted = nil
+}
+
+// testCreateHealthCheck is a stub function for testing the
+// route53.CreateHealthCheck function.
+//
+// Like the real function, a request with the caller reference of an
+// existing health check returns that health check, and a request with the
+// caller reference of a deleted health check fails.
+func testCreateHealthCheck(input *route53.CreateHealthCheckInput) (*route53.CreateHealthCheckOutput, error) {
+	route53HealthChecks.Lock()
+	defer route53HealthChecks.Unlock()
+	if route53HealthChecks.deleted[*input.CallerReference] {
+		return nil, awserr.New("HealthCheckAlreadyExists", "A health check with the caller reference "+*input.CallerReference+" was deleted", nil)
+	}
+	for _, hc := range route53HealthChecks.checks {
+		if *hc.CallerReference == *input.CallerReference {
+			return &route53.CreateHealthCheckOutput{HealthCheck: hc}, nil
+		}
+	}
+	route53HealthChecks.nextID++
+	hc := &route53.HealthCheck{
+		CallerReference:    input.CallerReference,
+		HealthCheckConfig:  input.HealthCheckConfig,
+		HealthCheckVersion: aws.Int64(1),
+		Id:                 aws.String(fmt.Sprintf("hc-%d", route53HealthChecks.nextID)),
+	}
+	route53HealthChecks.checks = append(route53HealthChecks.checks, hc)
+	return &route53.CreateHealthCheckOutput{HealthCheck: hc}, nil
+}
+
+// testListHealthChecks is a stub function for testing the
+// route53.ListHealthChecks function. One health check is returned per page,
+// to exercise pagination.
+func testListHealthChecks(input *route53.ListHealthChecksInput) (*route53.ListHealthChecksOutput, error) {
+	route53HealthChecks.Lock()
+	defer route53HealthChecks.Unlock()
+	start := 0
+	if input.Marker != nil {
+		for n, hc := range route53HealthChecks.checks {
+			if *hc.Id == *input.Marker {
+				start = n
+			}
+		}
+	}
+	out := &route53.ListHealthChecksOutput{
+		HealthChecks: []*route53.HealthCheck{},
+		IsTruncated:  aws.Bool(false),
+		MaxItems:     aws.String("1"),
+	}
+	if start < len(route53HealthChecks.checks) {
+		out.HealthChecks = append(out.HealthChecks, route53HealthChecks.checks[start])
+	}
+	if start+1 < len(route53HealthChecks.checks) {
+		out.IsTruncated = aws.Bool(true)
+		out.NextMarker = route53HealthChecks.checks[start+1].Id
+	}
+	return out, nil
+}
+
+// testDeleteHealthCheck is a stub function for testing the
+// route53.DeleteHealthCheck function.
+func testDeleteHealthCheck(input *route53.DeleteHealthCheckInput) (*route53.DeleteHealthCheckOutput, error) {
+	route53HealthChecks.Lock()
+	defer route53HealthChecks.Unlock()
+	for n, hc := range route53HealthChecks.checks {
+		if *hc.Id == *input.HealthCheckId {
+			if route53HealthChecks.deleted == nil {
+				route53HealthChecks.deleted = make(map[string]bool)
+			}
+			route53HealthChecks.deleted[*hc.CallerReference] = true
+			route53HealthChecks.checks = append(route53HealthChecks.checks[:n], route53HealthChecks.checks[n+1:]...)
+			return &route53.DeleteHealthCheckOutput{}, nil
+		}
+	}
+	return nil, awserr.New("NoSuchHealthCheck", "No health check exists with the specified ID "+*input.HealthCheckId, nil)
+}
+
 // testChangeInfo provides a mock *route53.ChangeInfo struct.
 func testChangeInfo() *route53.ChangeInfo {
 	return &route53.ChangeInfo{
@@ -35,12 +206,217 @@ func testGetChangeOutput() *route53.GetChangeOutput {
 	}
 }
 
+// testResourceRecordSets provides a mock list of the resource record sets
+// that exist in the test hosted zone, sorted by name, type, and set
+// identifier. Names are escaped the way Route 53 returns them.
+func testResourceRecordSets() []*route53.ResourceRecordSet {
+	return []*route53.ResourceRecordSet{
+		&route53.ResourceRecordSet{
+			Name: aws.String("\\052.example.com."),
+			TTL:  aws.Int64(300),
+			Type: aws.String("A"),
+			ResourceRecords: []*route53.ResourceRecord{
+				&route53.ResourceRecord{
+					Value: aws.String("54.0.0.100"),
+				},
+			},
+		},
+		&route53.ResourceRecordSet{
+			Name: aws.String("_app._tcp.example.com."),
+			TTL:  aws.Int64(60),
+			Type: aws.String("SRV"),
+			ResourceRecords: []*route53.ResourceRecord{
+				&route53.ResourceRecord{
+					Value: aws.String("10 5 8080 i-987654321.example.com."),
+				},
+			},
+		},
+		&route53.ResourceRecordSet{
+			Name: aws.String("i-123456789.example.com."),
+			TTL:  aws.Int64(3600),
+			Type: aws.String("A"),
+			ResourceRecords: []*route53.ResourceRecord{
+				&route53.ResourceRecord{
+					Value: aws.String("54.0.0.1"),
+				},
+			},
+		},
+		&route53.ResourceRecordSet{
+			Name:          aws.String("weighted.example.com."),
+			TTL:           aws.Int64(60),
+			Type:          aws.String("A"),
+			SetIdentifier: aws.String("blue"),
+			Weight:        aws.Int64(10),
+			ResourceRecords: []*route53.ResourceRecord{
+				&route53.ResourceRecord{
+					Value: aws.String("54.0.0.2"),
+				},
+			},
+		},
+		&route53.ResourceRecordSet{
+			Name:          aws.String("weighted.example.com."),
+			TTL:           aws.Int64(60),
+			Type:          aws.String("A"),
+			SetIdentifier: aws.String("green"),
+			Weight:        aws.Int64(10),
+			ResourceRecords: []*route53.ResourceRecord{
+				&route53.ResourceRecord{
+					Value: aws.String("54.0.0.3"),
+				},
+			},
+		},
+		&route53.ResourceRecordSet{
+			Name: aws.String("www.example.com."),
+			TTL:  aws.Int64(3600),
+			Type: aws.String("CNAME"),
+			ResourceRecords: []*route53.ResourceRecord{
+				&route53.ResourceRecord{
+					Value: aws.String("i-123456789.example.com."),
+				},
+			},
+		},
+	}
+}
+
+// testListResourceRecordSets is a stub function for testing the
+// route53.ListResourceRecordSets function.
+//
+// Like the real function when called with a MaxItems of 1, this returns the
+// first record set that sorts at or after the supplied name, type, and set
+// identifier, regardless of whether or not it matches exactly. The name is
+// matched case-insensitively, and a "*" in it matches the escaped form.
+func testListResourceRecordSets(input *route53.ListResourceRecordSetsInput) (*route53.ListResourceRecordSetsOutput, error) {
+	if *input.HostedZoneId == "bad" {
+		return nil, fmt.Errorf("error")
+	}
+	out := &route53.ListResourceRecordSetsOutput{
+		IsTruncated:        aws.Bool(false),
+		MaxItems:           input.MaxItems,
+		ResourceRecordSets: []*route53.ResourceRecordSet{},
+	}
+	start := strings.Replace(strings.ToLower(*input.StartRecordName), "*", "\\052", -1)
+	for _, rrSet := range testResourceRecordSets() {
+		if *rrSet.Name < start || (*rrSet.Name == start && *rrSet.Type < *input.StartRecordType) {
+			continue
+		}
+		if *rrSet.Name == start && *rrSet.Type == *input.StartRecordType && input.StartRecordIdentifier != nil &&
+			aws.StringValue(rrSet.SetIdentifier) < *input.StartRecordIdentifier {
+			continue
+		}
+		out.ResourceRecordSets = append(out.ResourceRecordSets, rrSet)
+		break
+	}
+	return out, nil
+}
+
+// testHostedZones provides a mock list of the hosted zones in the test
+// account, sorted the way Route 53 sorts them: by name with the labels
+// reversed, then by ID. There is a public and a private zone for
+// example.com., and a private zone for internal.example.com..
+func testHostedZones() []*route53.HostedZone {
+	return []*route53.HostedZone{
+		&route53.HostedZone{
+			Id:     aws.String("/hostedzone/9876543210FEDCBA"),
+			Name:   aws.String("example.com."),
+			Config: &route53.HostedZoneConfig{PrivateZone: aws.Bool(true)},
+		},
+		&route53.HostedZone{
+			Id:     aws.String("/hostedzone/ABCDEF0123456789"),
+			Name:   aws.String("example.com."),
+			Config: &route53.HostedZoneConfig{PrivateZone: aws.Bool(false)},
+		},
+		&route53.HostedZone{
+			Id:     aws.String("/hostedzone/0123456789ABCDEF"),
+			Name:   aws.String("internal.example.com."),
+			Config: &route53.HostedZoneConfig{PrivateZone: aws.Bool(true)},
+		},
+	}
+}
+
+// testHostedZoneVPCs provides the VPCs associated with the private test
+// hosted zones, by zone ID.
+var testHostedZoneVPCs = map[string][]*route53.VPC{
+	"9876543210FEDCBA": []*route53.VPC{
+		&route53.VPC{VPCId: aws.String("vpc-123456"), VPCRegion: aws.String("us-west-2")},
+	},
+	"0123456789ABCDEF": []*route53.VPC{
+		&route53.VPC{VPCId: aws.String("vpc-123456"), VPCRegion: aws.String("us-west-2")},
+	},
+}
+
+// reversedZoneName returns a zone name with its labels reversed, which is
+// the order Route 53 sorts hosted zones by.
+func reversedZoneName(name string) string {
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, ".")
+}
+
+// testListHostedZonesByName is a stub function for testing the
+// route53.ListHostedZonesByName function.
+//
+// Like the real function, this returns up to MaxItems zones (default 100),
+// starting with the first zone that sorts at or after the supplied DNSName
+// and HostedZoneId, regardless of whether or not its name matches.
+func testListHostedZonesByName(input *route53.ListHostedZonesByNameInput) (*route53.ListHostedZonesByNameOutput, error) {
+	max := 100
+	if input.MaxItems != nil {
+		var err error
+		if max, err = strconv.Atoi(*input.MaxItems); err != nil {
+			return nil, err
+		}
+	}
+
+	zones := []*route53.HostedZone{}
+	for _, zone := range testHostedZones() {
+		if input.DNSName != nil {
+			name, start := reversedZoneName(*zone.Name), reversedZoneName(*input.DNSName)
+			if name < start || (name == start && input.HostedZoneId != nil && "/hostedzone/"+*input.HostedZoneId > *zone.Id) {
+				continue
+			}
+		}
+		zones = append(zones, zone)
+	}
+
+	out := &route53.ListHostedZonesByNameOutput{
+		DNSName:     input.DNSName,
+		IsTruncated: aws.Bool(len(zones) > max),
+		MaxItems:    aws.String(strconv.Itoa(max)),
+	}
+	if len(zones) > max {
+		out.NextDNSName = zones[max].Name
+		out.NextHostedZoneId = aws.String(strings.TrimPrefix(*zones[max].Id, "/hostedzone/"))
+		zones = zones[:max]
+	}
+	out.HostedZones = zones
+	return out, nil
+}
+
+// testGetHostedZone is a stub function for testing the
+// route53.GetHostedZone function.
+func testGetHostedZone(input *route53.GetHostedZoneInput) (*route53.GetHostedZoneOutput, error) {
+	for _, zone := range testHostedZones() {
+		if *zone.Id == "/hostedzone/"+*input.Id {
+			return &route53.GetHostedZoneOutput{
+				HostedZone: zone,
+				VPCs:       testHostedZoneVPCs[*input.Id],
+			}, nil
+		}
+	}
+	return nil, awserr.New("NoSuchHostedZone", "No hosted zone found with ID: "+*input.Id, nil)
+}
+
 // testChangeResourceRecordSets is a stub function for testing the
 // route53.DescribeResourceRecordSets function.
 func testChangeResourceRecordSets(input *route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error) {
 	if *input.HostedZoneId == "bad" {
 		return nil, fmt.Errorf("error")
 	}
+	route53ChangeLog.Lock()
+	defer route53ChangeLog.Unlock()
+	route53ChangeLog.inputs = append(route53ChangeLog.inputs, input)
 	return testChangeResourceRecordSetsOutput(), nil
 }
 
@@ -60,6 +436,11 @@ func CreateTestRoute53Mock() *route53.Route53 {
 	conn.Handlers.Clear()
 
 	conn.Handlers.Send.PushBack(func(r *request.Request) {
+		if err := nextRoute53Error(r.Operation.Name); err != nil {
+			r.Error = err
+			return
+		}
+
 		switch p := r.Params.(type) {
 		case *route53.ChangeResourceRecordSetsInput:
 			out, err := testChangeResourceRecordSets(p)
@@ -67,6 +448,42 @@ func CreateTestRoute53Mock() *route53.Route53 {
 				*r.Data.(*route53.ChangeResourceRecordSetsOutput) = *out
 			}
 			r.Error = err
+		case *route53.ListResourceRecordSetsInput:
+			out, err := testListResourceRecordSets(p)
+			if out != nil {
+				*r.Data.(*route53.ListResourceRecordSetsOutput) = *out
+			}
+			r.Error = err
+		case *route53.ListHostedZonesByNameInput:
+			out, err := testListHostedZonesByName(p)
+			if out != nil {
+				*r.Data.(*route53.ListHostedZonesByNameOutput) = *out
+			}
+			r.Error = err
+		case *route53.GetHostedZoneInput:
+			out, err := testGetHostedZone(p)
+			if out != nil {
+				*r.Data.(*route53.GetHostedZoneOutput) = *out
+			}
+			r.Error = err
+		case *route53.CreateHealthCheckInput:
+			out, err := testCreateHealthCheck(p)
+			if out != nil {
+				*r.Data.(*route53.CreateHealthCheckOutput) = *out
+			}
+			r.Error = err
+		case *route53.ListHealthChecksInput:
+			out, err := testListHealthChecks(p)
+			if out != nil {
+				*r.Data.(*route53.ListHealthChecksOutput) = *out
+			}
+			r.Error = err
+		case *route53.DeleteHealthCheckInput:
+			out, err := testDeleteHealthCheck(p)
+			if out != nil {
+				*r.Data.(*route53.DeleteHealthCheckOutput) = *out
+			}
+			r.Error = err
 		case *route53.GetChangeInput:
 			out, err := testGetChange(p)
 			if out != nil {
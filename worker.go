@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// worker long-polls a messageQueue for lifecycle messages, and runs them
+// through processMessage.
+//
+// Messages are only deleted once they have been fully processed, including
+// completion of the lifecycle action. Messages that fail are left in the
+// queue, and are delivered again once their visibility timeout expires - a
+// redrive policy on the queue should be used to move messages that
+// continually fail out of the way.
+type worker struct {
+	// An AWS client instance.
+	client *awsClient
+
+	// The queue to poll.
+	queue messageQueue
+
+	// The number of messages to process at once.
+	concurrency int
+
+	// The visibility timeout to keep messages hidden for while they are
+	// being processed. Visibility is extended at half this interval.
+	visibilityTimeout time.Duration
+
+	// The long-poll wait time for receives.
+	waitTime time.Duration
+}
+
+// parseQueueMessage parses a message received from the queue. Both raw
+// lifecycle messages, as sent by auto scaling to SQS directly, and SNS
+// notifications delivered to a subscribed queue are supported.
+func parseQueueMessage(raw []byte) (snsMessage, messageArgs, error) {
+	envelope := snsEnvelope{}
+	if err := json.Unmarshal(raw, &envelope); err == nil && envelope.Type == snsTypeNotification {
+		raw = []byte(envelope.Message)
+	}
+	return parseMessage(raw)
+}
+
+// keepInvisible extends the visibility of msg every half visibility timeout,
+// until stop is closed. This keeps the message hidden while long-running
+// steps, such as waiting for Route 53 to sync, are in progress.
+func (w *worker) keepInvisible(msg queueMessage, stop <-chan struct{}) {
+	ticker := time.NewTicker(w.visibilityTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			w.client.logger().Infof("Extending visibility of message %s", msg.ID)
+			if err := w.queue.ExtendVisibility(msg, w.visibilityTimeout); err != nil {
+				w.client.logger().Errorf("Error extending visibility of message %s: %v", msg.ID, err)
+			}
+		}
+	}
+}
+
+// handle processes a single message, deleting it on success.
+func (w *worker) handle(msg queueMessage) {
+	client := w.client.withLog("message_id", msg.ID)
+	client.logger().Infof("Received queue message %s", msg.ID)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go w.keepInvisible(msg, stop)
+
+	message, args, err := parseQueueMessage([]byte(msg.Body))
+	if err != nil {
+		client.logger().Errorf("Error parsing queue message %s, leaving in queue: %v", msg.ID, err)
+		return
+	}
+
+	if err := processMessage(client, message, args); err != nil {
+		client.logger().Errorf("Error processing queue message %s, leaving in queue: %v", msg.ID, err)
+		return
+	}
+
+	if err := w.queue.Delete(msg); err != nil {
+		client.logger().Errorf("Error deleting queue message %s: %v", msg.ID, err)
+		return
+	}
+	client.logger().Infof("Deleted queue message %s", msg.ID)
+}
+
+// poll receives and handles messages one at a time, until stop is closed.
+func (w *worker) poll(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		msgs, err := w.queue.Receive(1, w.waitTime)
+		if err != nil {
+			w.client.logger().Errorf("Error receiving from queue: %v", err)
+			time.Sleep(w.waitTime)
+			continue
+		}
+		for _, msg := range msgs {
+			w.handle(msg)
+		}
+	}
+}
+
+// run starts concurrency pollers, and blocks until stop is closed and all
+// in-flight messages have been processed.
+func (w *worker) run(stop <-chan struct{}) {
+	var wg sync.WaitGroup
+	for i := 0; i < w.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.poll(stop)
+		}()
+	}
+	wg.Wait()
+}
+
+// Limits for the worker options, from the SQS limits on visibility timeouts
+// and long-poll wait times. The visibility timeout also needs to be long
+// enough for keepInvisible to extend it at half the interval.
+const (
+	minVisibilityTimeout = time.Second * 2
+	maxVisibilityTimeout = time.Hour * 12
+	minWaitTime          = time.Second
+	maxWaitTime          = time.Second * 20
+)
+
+// validateWorkerFlags returns an error if the worker options are out of
+// range.
+func validateWorkerFlags(concurrency int, visibilityTimeout, waitTime time.Duration) error {
+	if concurrency < 1 {
+		return errors.New("-concurrency must be at least 1")
+	}
+	if visibilityTimeout < minVisibilityTimeout || visibilityTimeout >= maxVisibilityTimeout {
+		return fmt.Errorf("-visibility-timeout must be at least %s and less than %s", minVisibilityTimeout, maxVisibilityTimeout)
+	}
+	if waitTime < minWaitTime || waitTime > maxWaitTime {
+		return fmt.Errorf("-wait-time must be between %s and %s", minWaitTime, maxWaitTime)
+	}
+	return nil
+}
+
+// runWorker is the entry point for the worker command. It polls the queue
+// until it receives SIGINT or SIGTERM, after which it stops receiving new
+// messages and waits for in-flight messages to finish processing.
+func runWorker(args []string) error {
+	flags := flag.NewFlagSet("worker", flag.ContinueOnError)
+	queueURL := flags.String("queue-url", "", "The URL of the SQS queue to poll.")
+	concurrency := flags.Int("concurrency", 4, "The number of messages to process at once.")
+	visibilityTimeout := flags.Duration("visibility-timeout", time.Minute, "How long to keep messages hidden while processing them, from 2s to under 12h.")
+	waitTime := flags.Duration("wait-time", time.Second*20, "The long-poll wait time, from 1s to 20s.")
+	coalesceWindow := flags.Duration("coalesce-window", 0, "If set, coalesce changes to the same zone received within this window into one batch.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *queueURL == "" {
+		return &usageError{errors.New("-queue-url is required")}
+	}
+	if err := validateWorkerFlags(*concurrency, *visibilityTimeout, *waitTime); err != nil {
+		return &usageError{err}
+	}
+
+	client, err := newAWSClient()
+	if err != nil {
+		return err
+	}
+	if *coalesceWindow > 0 {
+		client.aggregator = newChangeAggregator(client, *coalesceWindow)
+	}
+
+	w := &worker{
+		client:            client,
+		queue:             newSQSQueue(client.session, *queueURL),
+		concurrency:       *concurrency,
+		visibilityTimeout: *visibilityTimeout,
+		waitTime:          *waitTime,
+	}
+
+	stop := make(chan struct{})
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		defaultLogger.Infof("Received %s, finishing in-flight messages", sig)
+		close(stop)
+	}()
+
+	defaultLogger.Infof("asg53 worker polling %s with concurrency %d", *queueURL, *concurrency)
+	w.run(stop)
+	defaultLogger.Infof("asg53 worker stopped.")
+	return nil
+}
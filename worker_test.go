@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// testQueueMessage returns a raw lifecycle message body for the supplied
+// instance ID.
+func testQueueMessage(instanceID string) string {
+	msg, _ := json.Marshal(map[string]string{
+		"EC2InstanceId":        instanceID,
+		"AutoScalingGroupName": "ASGName",
+		"LifecycleHookName":    "Lifecycle",
+		"LifecycleActionToken": "Token",
+		"LifecycleTransition":  transitionLaunch,
+		"NotificationMetadata": testMetadataJSON,
+	})
+	return string(msg)
+}
+
+// testWorker returns a worker using the supplied queue and the stubbed AWS
+// client.
+func testWorker(queue messageQueue) *worker {
+	return &worker{
+		client:            testAwsClient(),
+		queue:             queue,
+		concurrency:       2,
+		visibilityTimeout: time.Second,
+		waitTime:          time.Millisecond * 50,
+	}
+}
+
+// runTestWorker runs the worker for the supplied duration.
+func runTestWorker(w *worker, d time.Duration) {
+	stop := make(chan struct{})
+	time.AfterFunc(d, func() { close(stop) })
+	w.run(stop)
+}
+
+func TestMemoryQueue(t *testing.T) {
+	q := newMemoryQueue(time.Millisecond * 100)
+	q.Send("one")
+
+	msgs, _ := q.Receive(10, 0)
+	if len(msgs) != 1 || msgs[0].Body != "one" {
+		t.Fatalf("Expected 1 message, got %#v", msgs)
+	}
+
+	if msgs, _ := q.Receive(10, 0); len(msgs) != 0 {
+		t.Fatalf("Expected message to be invisible, got %#v", msgs)
+	}
+
+	if err := q.ExtendVisibility(msgs[0], time.Millisecond*300); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	time.Sleep(time.Millisecond * 150)
+	if msgs, _ := q.Receive(10, 0); len(msgs) != 0 {
+		t.Fatalf("Expected message to still be invisible, got %#v", msgs)
+	}
+
+	again, _ := q.Receive(10, time.Second)
+	if len(again) != 1 {
+		t.Fatalf("Expected message to be redelivered, got %#v", again)
+	}
+
+	if err := q.Delete(msgs[0]); err == nil {
+		t.Fatal("Expected error deleting with stale receipt handle, got none")
+	}
+	if err := q.Delete(again[0]); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if q.Len() != 0 {
+		t.Fatalf("Expected empty queue, got %d messages", q.Len())
+	}
+}
+
+func TestParseQueueMessage_snsEnvelope(t *testing.T) {
+	body, _ := json.Marshal(snsEnvelope{
+		Type:    snsTypeNotification,
+		Message: testQueueMessage("i-123456789"),
+	})
+
+	message, args, err := parseQueueMessage(body)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if message.EC2InstanceID != "i-123456789" {
+		t.Fatalf("Expected EC2InstanceID to be i-123456789, got %s", message.EC2InstanceID)
+	}
+	if args.HostedZoneID != "ABCDEF0123456789" {
+		t.Fatalf("Expected HostedZoneID to be ABCDEF0123456789, got %s", args.HostedZoneID)
+	}
+}
+
+func TestWorker(t *testing.T) {
+	q := newMemoryQueue(time.Second)
+	q.Send(testQueueMessage("i-123456789"))
+	q.Send(testQueueMessage("i-123456789"))
+
+	runTestWorker(testWorker(q), time.Millisecond*200)
+
+	if q.Len() != 0 {
+		t.Fatalf("Expected all messages to be deleted, got %d remaining", q.Len())
+	}
+}
+
+func TestWorker_shouldKeepFailed(t *testing.T) {
+	q := newMemoryQueue(time.Second)
+	q.Send(testQueueMessage("bad"))
+
+	runTestWorker(testWorker(q), time.Millisecond*200)
+
+	if q.Len() != 1 {
+		t.Fatalf("Expected failed message to be kept, got %d remaining", q.Len())
+	}
+}
+
+func TestValidateWorkerFlags(t *testing.T) {
+	if err := validateWorkerFlags(4, time.Minute, time.Second*20); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	bad := []struct {
+		concurrency       int
+		visibilityTimeout time.Duration
+		waitTime          time.Duration
+	}{
+		{0, time.Minute, time.Second * 20},
+		{4, 0, time.Second * 20},
+		{4, time.Nanosecond, time.Second * 20},
+		{4, time.Hour * 12, time.Second * 20},
+		{4, time.Minute, 0},
+		{4, time.Minute, time.Second * 21},
+	}
+	for _, tc := range bad {
+		if err := validateWorkerFlags(tc.concurrency, tc.visibilityTimeout, tc.waitTime); err == nil {
+			t.Fatalf("Expected error for %#v, got none", tc)
+		}
+	}
+}
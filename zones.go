@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// zoneBatch is a rendered change batch for a single hosted zone.
+type zoneBatch struct {
+	// The hosted zone ID.
+	ZoneID string
+
+	// The rendered changes.
+	Changes []*route53.Change
+
+	// The client to send the changes with, if the zone is managed through an
+	// assumed role. If nil, the client applying the batches is used.
+	client *awsClient
+
+	// Updates to SRV pools in the zone. The changes for these are worked out
+	// when the batch is sent - see send.
+	pools []*srvPoolUpdate
+}
+
+// clientFor returns the client to send b with.
+func (b zoneBatch) clientFor(c *awsClient) *awsClient {
+	if b.client != nil {
+		return b.client
+	}
+	return c
+}
+
+// findExistingRRSet looks up the resource record set that a change operates
+// on. nil is returned if the resource record set does not exist.
+func (c *awsClient) findExistingRRSet(zoneID string, change *route53.Change) (*route53.ResourceRecordSet, error) {
+	rrSet := change.ResourceRecordSet
+	existing, err := c.FindRoute53ResourceRecordSet(zoneID, aws.StringValue(rrSet.Name), aws.StringValue(rrSet.Type), aws.StringValue(rrSet.SetIdentifier))
+	if isRRSetNotFound(err) {
+		return nil, nil
+	}
+	return existing, err
+}
+
+// compensatingChanges returns the changes that undo batch, in reverse
+// order. This needs to be called before batch is sent, as UPSERTs are undone
+// by restoring the resource record set as it exists before the change.
+//
+// CREATEs are undone with a DELETE, and DELETEs with a CREATE. UPSERTs are
+// undone by UPSERTing the existing resource record set, or with a DELETE if
+// it does not exist yet.
+func (c *awsClient) compensatingChanges(zoneID string, batch []*route53.Change) ([]*route53.Change, error) {
+	undo := []*route53.Change{}
+	for i := len(batch) - 1; i >= 0; i-- {
+		change := batch[i]
+		switch aws.StringValue(change.Action) {
+		case route53.ChangeActionCreate:
+			undo = append(undo, &route53.Change{Action: aws.String(route53.ChangeActionDelete), ResourceRecordSet: change.ResourceRecordSet})
+		case route53.ChangeActionDelete:
+			undo = append(undo, &route53.Change{Action: aws.String(route53.ChangeActionCreate), ResourceRecordSet: change.ResourceRecordSet})
+		case route53.ChangeActionUpsert:
+			existing, err := c.findExistingRRSet(zoneID, change)
+			if err != nil {
+				return nil, err
+			}
+			if existing == nil {
+				undo = append(undo, &route53.Change{Action: aws.String(route53.ChangeActionDelete), ResourceRecordSet: change.ResourceRecordSet})
+			} else {
+				undo = append(undo, &route53.Change{Action: aws.String(route53.ChangeActionUpsert), ResourceRecordSet: existing})
+			}
+		default:
+			return nil, fmt.Errorf("Unsupported change action %q", aws.StringValue(change.Action))
+		}
+	}
+	return undo, nil
+}
+
+// applyZoneBatches sends the change batches for one or more hosted zones.
+//
+// A single batch is simply sent with send. Multiple batches are sent in
+// parallel, with all-or-nothing semantics: the changes that undo each batch
+// are worked out before anything is sent, and if any zone fails, the zones
+// that succeeded are rolled back, along with any part of a failed batch that
+// Route 53 accepted, such as a batch that did not sync in time. SRV pool updates are rolled back with the
+// inverse update. An error is returned if any zone fails, including any
+// errors encountered during rollback.
+func (c *awsClient) applyZoneBatches(batches []zoneBatch) error {
+	if len(batches) == 1 {
+		return batches[0].send(c)
+	}
+
+	c.logger().Infof("Sending change batches to %d hosted zones", len(batches))
+	undo := make([][]*route53.Change, len(batches))
+	for n, batch := range batches {
+		var err error
+		undo[n], err = batch.clientFor(c).compensatingChanges(batch.ZoneID, batch.Changes)
+		if err != nil {
+			return fmt.Errorf("Error preparing rollback for zone ID %s: %v", batch.ZoneID, err)
+		}
+	}
+
+	errs := make([]error, len(batches))
+	var wg sync.WaitGroup
+	for n, batch := range batches {
+		wg.Add(1)
+		go func(n int, batch zoneBatch) {
+			defer wg.Done()
+			errs[n] = batch.send(c)
+		}(n, batch)
+	}
+	wg.Wait()
+
+	failed := []string{}
+	for n, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("zone ID %s: %v", batches[n].ZoneID, err))
+		}
+	}
+	if len(failed) < 1 {
+		return nil
+	}
+
+	for n, err := range errs {
+		// applied is the number of changes at the start of the batch, followed
+		// by its pool changes, that were applied.
+		applied := len(batches[n].Changes) + 1
+		if partial, ok := err.(*partialBatchError); ok {
+			applied = partial.applied
+		} else if err != nil {
+			continue
+		}
+		if applied < 1 {
+			continue
+		}
+
+		c.logger().With("zone_id", batches[n].ZoneID).Warnf("Rolling back changes to zone ID %s", batches[n].ZoneID)
+		rollback := batches[n].rollback(undo[n], applied)
+		if err := rollback.send(c); err != nil {
+			failed = append(failed, fmt.Sprintf("rollback of zone ID %s: %v", batches[n].ZoneID, err))
+		}
+	}
+	return fmt.Errorf("Error sending change batches: %s", strings.Join(failed, "; "))
+}
+
+// rollback returns the batch that undoes the first applied changes of b,
+// given undo, the compensating changes for all of b.Changes. The SRV pool
+// updates of b are only undone if applied goes past b.Changes, as the pool
+// changes are sent after them.
+func (b zoneBatch) rollback(undo []*route53.Change, applied int) zoneBatch {
+	rollback := zoneBatch{ZoneID: b.ZoneID, client: b.client}
+	if applied <= len(b.Changes) {
+		rollback.Changes = undo[len(undo)-applied:]
+		return rollback
+	}
+	rollback.Changes = undo
+	for i := len(b.pools) - 1; i >= 0; i-- {
+		rollback.pools = append(rollback.pools, b.pools[i].inverse())
+	}
+	return rollback
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/paybyphone/asg53/teststubs"
+)
+
+// testZonesMetadataJSON is a test SNS message in JSON form, with changes to
+// multiple hosted zones.
+const testZonesMetadataJSON = `
+{
+  "Zones": [
+    {
+      "HostedZoneID": "ABCDEF0123456789",
+      "Changes": [
+        {
+          "Action": "UPSERT",
+          "ResourceRecordSet": {
+            "Name": "{{.InstanceID}}.example.com.",
+            "TTL": 3600,
+            "Type": "A",
+            "ResourceRecords": [
+              {
+                "Value": "{{.InstancePublicIPAddress}}"
+              }
+            ]
+          }
+        }
+      ]
+    },
+    {
+      "HostedZoneID": "9876543210FEDCBA",
+      "Changes": [
+        {
+          "Action": "CREATE",
+          "ResourceRecordSet": {
+            "Name": "{{.InstanceID}}.example.internal.",
+            "TTL": 3600,
+            "Type": "A",
+            "ResourceRecords": [
+              {
+                "Value": "{{.InstancePrivateIPAddress}}"
+              }
+            ]
+          }
+        }
+      ]
+    }
+  ]
+}
+`
+
+func TestMessageArgsZones(t *testing.T) {
+	metadata, err := parseSNSMetadata([]byte(testZonesMetadataJSON))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+
+	zones := metadata.zones()
+	if len(zones) != 2 || zones[1].HostedZoneID != "9876543210FEDCBA" {
+		t.Fatalf("Expected 2 zones, got %#v", zones)
+	}
+
+	single, err := parseSNSMetadata([]byte(testMetadataJSON))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+	if zones := single.zones(); len(zones) != 1 || zones[0].HostedZoneID != "ABCDEF0123456789" {
+		t.Fatalf("Expected 1 zone, got %#v", zones)
+	}
+}
+
+func TestRenderZoneBatches(t *testing.T) {
+	metadata, err := parseSNSMetadata([]byte(testZonesMetadataJSON))
+	if err != nil {
+		panic(fmt.Errorf("Bad JSON in test: %v", err))
+	}
+
+	client := testAwsClient()
+	batches, err := renderZoneBatches(client, "i-123456789", metadata, transitionLaunch, "")
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	if len(batches) != 2 {
+		t.Fatalf("Expected 2 batches, got %d", len(batches))
+	}
+	if *batches[1].Changes[0].ResourceRecordSet.ResourceRecords[0].Value != "10.0.0.1" {
+		t.Fatalf("Expected private IP in second zone, got %s", *batches[1].Changes[0].ResourceRecordSet.ResourceRecords[0].Value)
+	}
+}
+
+func TestCompensatingChanges(t *testing.T) {
+	client := testAwsClient()
+	batch := []*route53.Change{
+		testChange("CREATE", "new.example.com.", "10.0.0.1"),
+		testChange("DELETE", "old.example.com.", "10.0.0.2"),
+		// Exists in the stub with a value of 54.0.0.1.
+		testChange("UPSERT", "i-123456789.example.com.", "10.0.0.3"),
+		// Does not exist in the stub.
+		testChange("UPSERT", "j.example.com.", "10.0.0.4"),
+	}
+
+	undo, err := client.compensatingChanges("ABCDEF0123456789", batch)
+	if err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+
+	expected := []struct {
+		Action string
+		Value  string
+	}{
+		{"DELETE", "10.0.0.4"},
+		{"UPSERT", "54.0.0.1"},
+		{"CREATE", "10.0.0.2"},
+		{"DELETE", "10.0.0.1"},
+	}
+	for n, e := range expected {
+		if *undo[n].Action != e.Action || *undo[n].ResourceRecordSet.ResourceRecords[0].Value != e.Value {
+			t.Fatalf("Expected undo[%d] to be %s %s, got %s %s", n, e.Action, e.Value, *undo[n].Action, *undo[n].ResourceRecordSet.ResourceRecords[0].Value)
+		}
+	}
+}
+
+func TestApplyZoneBatches(t *testing.T) {
+	defer teststubs.ResetRoute53ChangeLog()
+	teststubs.ResetRoute53ChangeLog()
+
+	client := testAwsClient()
+	batches := []zoneBatch{
+		{ZoneID: "ABCDEF0123456789", Changes: []*route53.Change{testChange("CREATE", "a.example.com.", "10.0.0.1")}},
+		{ZoneID: "9876543210FEDCBA", Changes: []*route53.Change{testChange("CREATE", "a.example.internal.", "10.0.0.1")}},
+	}
+
+	if err := client.applyZoneBatches(batches); err != nil {
+		t.Fatalf("Bad: %v", err)
+	}
+	if log := teststubs.Route53ChangeLog(); len(log) != 2 {
+		t.Fatalf("Expected 2 change batches, got %d", len(log))
+	}
+}
+
+func TestApplyZoneBatches_rollback(t *testing.T) {
+	defer teststubs.ResetRoute53ChangeLog()
+	teststubs.ResetRoute53ChangeLog()
+
+	client := testAwsClient()
+	batches := []zoneBatch{
+		{ZoneID: "ABCDEF0123456789", Changes: []*route53.Change{testChange("CREATE", "a.example.com.", "10.0.0.1")}},
+		{ZoneID: "bad", Changes: []*route53.Change{testChange("CREATE", "a.example.internal.", "10.0.0.1")}},
+	}
+
+	if err := client.applyZoneBatches(batches); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+
+	log := teststubs.Route53ChangeLog()
+	if len(log) != 2 {
+		t.Fatalf("Expected the change and its rollback, got %d change batches", len(log))
+	}
+	rollback := log[1].ChangeBatch.Changes[0]
+	if *log[1].HostedZoneId != "ABCDEF0123456789" || *rollback.Action != "DELETE" || *rollback.ResourceRecordSet.Name != "a.example.com." {
+		t.Fatalf("Expected DELETE of a.example.com. as rollback, got %s %s", *rollback.Action, *rollback.ResourceRecordSet.Name)
+	}
+}
+
+func TestApplyZoneBatches_rollbackPartial(t *testing.T) {
+	defer teststubs.ResetRoute53ChangeLog()
+	teststubs.ResetRoute53ChangeLog()
+
+	// The second part of the batch for the first zone fails, after the stub
+	// has recorded it.
+	client := testAwsClient()
+	var mu sync.Mutex
+	calls := 0
+	client.Route53.Handlers.Send.PushBack(func(r *request.Request) {
+		input, ok := r.Params.(*route53.ChangeResourceRecordSetsInput)
+		if !ok || *input.HostedZoneId != "ABCDEF0123456789" {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if calls++; calls == 2 {
+			r.Error = awserr.New("InvalidChangeBatch", "error", nil)
+		}
+	})
+
+	big := []*route53.Change{}
+	for i := 0; i < 2500; i++ {
+		big = append(big, testChange("CREATE", fmt.Sprintf("%d.example.com.", i), "10.0.0.1"))
+	}
+	batches := []zoneBatch{
+		{ZoneID: "ABCDEF0123456789", Changes: big},
+		{ZoneID: "9876543210FEDCBA", Changes: []*route53.Change{testChange("CREATE", "a.example.internal.", "10.0.0.1")}},
+	}
+
+	err := client.applyZoneBatches(batches)
+	if err == nil || !strings.Contains(err.Error(), "1 of 3 parts") {
+		t.Fatalf("Expected partial batch error, got %v", err)
+	}
+
+	rollbacks := map[string][]*route53.Change{}
+	for _, input := range teststubs.Route53ChangeLog() {
+		if *input.ChangeBatch.Changes[0].Action == "DELETE" {
+			rollbacks[*input.HostedZoneId] = input.ChangeBatch.Changes
+		}
+	}
+	if undo := rollbacks["9876543210FEDCBA"]; len(undo) != 1 || *undo[0].ResourceRecordSet.Name != "a.example.internal." {
+		t.Fatalf("Expected DELETE of a.example.internal. as rollback, got %#v", undo)
+	}
+	undo := rollbacks["ABCDEF0123456789"]
+	if len(undo) != 1000 || *undo[0].ResourceRecordSet.Name != "999.example.com." || *undo[999].ResourceRecordSet.Name != "0.example.com." {
+		t.Fatalf("Expected DELETEs of the first part in reverse as rollback, got %d changes", len(undo))
+	}
+}
+
+func TestApplyZoneBatches_rollbackNotSynced(t *testing.T) {
+	defer teststubs.ResetRoute53ChangeLog()
+	defer teststubs.ResetRoute53Errors()
+	teststubs.ResetRoute53ChangeLog()
+
+	// The batch for the first zone is accepted, but waiting for it to sync
+	// fails. Only the first zone gets as far as GetChange.
+	teststubs.InjectRoute53Errors("GetChange", "InvalidInput")
+	client := testAwsClient()
+	batches := []zoneBatch{
+		{ZoneID: "ABCDEF0123456789", Changes: []*route53.Change{testChange("CREATE", "a.example.com.", "10.0.0.1")}},
+		{ZoneID: "bad", Changes: []*route53.Change{testChange("CREATE", "a.example.internal.", "10.0.0.1")}},
+	}
+
+	if err := client.applyZoneBatches(batches); err == nil {
+		t.Fatal("Expected error, got none")
+	}
+
+	log := teststubs.Route53ChangeLog()
+	if len(log) != 2 {
+		t.Fatalf("Expected the change and its rollback, got %d change batches", len(log))
+	}
+	rollback := log[1].ChangeBatch.Changes[0]
+	if *log[1].HostedZoneId != "ABCDEF0123456789" || *rollback.Action != "DELETE" || *rollback.ResourceRecordSet.Name != "a.example.com." {
+		t.Fatalf("Expected DELETE of a.example.com. as rollback, got %s %s", *rollback.Action, *rollback.ResourceRecordSet.Name)
+	}
+}